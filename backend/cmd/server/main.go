@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -17,6 +20,8 @@ import (
 	collaborationv1 "github.com/HardMax71/syncwrite/backend/pkg/proto/collaboration/v1"
 	documentv1 "github.com/HardMax71/syncwrite/backend/pkg/proto/document/v1"
 	"github.com/HardMax71/syncwrite/backend/pkg/utils"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/health/grpc_health_v1"
@@ -40,17 +45,76 @@ func main() {
 	}
 	defer db.Close()
 
-	// Initialize MQTT client
-	mqttClient, err := collaboration.NewMQTTClient(cfg.MQTT.BrokerURL)
+	// Initialize Redis client for state shared between replicas
+	redisClient, err := database.NewRedis(&cfg.Redis)
 	if err != nil {
-		logger.Fatal("Failed to connect to MQTT broker", zap.Error(err))
+		logger.Fatal("Failed to connect to Redis", zap.Error(err))
 	}
-	defer mqttClient.Close()
+	defer redisClient.Close()
+
+	// Broker credentials for clients and for our own connection
+	brokerAuth := collaboration.NewBrokerAuth(cfg.JWT.Secret, cfg.MQTT.CredentialTTL)
+
+	// Serve the endpoints the broker checks credentials against; they must be
+	// up before we connect to the broker ourselves
+	brokerAuthListener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.MQTT.AuthPort))
+	if err != nil {
+		logger.Fatal("Failed to create broker auth listener", zap.Error(err))
+	}
+	brokerAuthServer := &http.Server{Handler: brokerAuth.Handler()}
+	go func() {
+		logger.Info("Starting broker auth server", zap.Int("port", cfg.MQTT.AuthPort))
+		if err := brokerAuthServer.Serve(brokerAuthListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatal("Failed to serve broker auth", zap.Error(err))
+		}
+	}()
+
+	// Run the MQTT broker within the server, so MQTT_BROKER can point at
+	// ourselves instead of a separate Mosquitto
+	if cfg.MQTT.Embedded {
+		broker, err := collaboration.NewBroker(brokerAuth,
+			fmt.Sprintf(":%d", cfg.MQTT.EmbeddedTCPPort),
+			fmt.Sprintf(":%d", cfg.MQTT.EmbeddedWSPort))
+		if err != nil {
+			logger.Fatal("Failed to create embedded MQTT broker", zap.Error(err))
+		}
+		if err := broker.Serve(); err != nil {
+			logger.Fatal("Failed to start embedded MQTT broker", zap.Error(err))
+		}
+		defer broker.Close()
+		logger.Info("Started embedded MQTT broker",
+			zap.Int("tcp_port", cfg.MQTT.EmbeddedTCPPort),
+			zap.Int("ws_port", cfg.MQTT.EmbeddedWSPort))
+	}
+
+	// Initialize the transport between replicas
+	pubsub, err := newPubSub(cfg, db.Pool(), redisClient, brokerAuth)
+	if err != nil {
+		logger.Fatal("Failed to initialize pub/sub transport", zap.Error(err))
+	}
+	defer pubsub.Close()
 
 	// Initialize services
 	authService := auth.NewService(db.Pool(), cfg)
 	documentService := document.NewService(db.Pool())
-	collaborationService := collaboration.NewService(db.Pool(), mqttClient)
+	collaborationService := collaboration.NewService(db.Pool(), pubsub, redisClient)
+
+	// Evict users whose clients stopped sending heartbeats
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	collaborationService.StartPresenceReaper(ctx, cfg.Presence.ReapInterval, cfg.Presence.Timeout)
+
+	// Broadcast committed changes queued in the outbox
+	collaborationService.StartOutboxRelay(ctx, cfg.Outbox.PollInterval, cfg.Outbox.Retention)
+
+	// Fold old changes of the collaboration history into snapshots
+	collaborationService.StartHistoryCompactor(ctx, cfg.History.CompactionInterval, cfg.History.Retention)
+
+	// Add versions of live-edited documents to their version history
+	collaborationService.StartCheckpointer(ctx, cfg.Checkpoint.MaxChanges, cfg.Checkpoint.IdleTimeout)
+
+	// Prune old versions that were not pinned
+	documentService.StartVersionPruner(ctx, cfg.Versions.PruneInterval, cfg.Versions.Retention)
 
 	// Create gRPC server
 	authMiddleware := auth.NewAuthMiddleware(authService)
@@ -66,7 +130,7 @@ func main() {
 	// Register services
 	authHandler := auth.NewHandler(authService)
 	documentHandler := document.NewHandler(documentService)
-	collaborationHandler := collaboration.NewHandler(collaborationService, documentService)
+	collaborationHandler := collaboration.NewHandler(collaborationService, documentService, brokerAuth)
 
 	authv1.RegisterAuthServiceServer(server, authHandler)
 	documentv1.RegisterDocumentServiceServer(server, documentHandler)
@@ -98,5 +162,22 @@ func main() {
 
 	// Graceful shutdown
 	server.GracefulStop()
+	brokerAuthServer.Close()
 	logger.Info("Server stopped")
 }
+
+func newPubSub(cfg *config.Config, pool *pgxpool.Pool, redisClient *redis.Client, brokerAuth *collaboration.BrokerAuth) (collaboration.PubSub, error) {
+	switch cfg.PubSub.Driver {
+	case "mqtt":
+		// Reconnect well before the server credentials expire
+		return collaboration.NewMQTTClient(cfg.MQTT.BrokerURL, brokerAuth.ServerCredentials, brokerAuth.ServerCredentialTTL()/2)
+	case "redis":
+		return collaboration.NewRedisStreams(redisClient), nil
+	case "postgres":
+		return collaboration.NewPostgresNotify(pool), nil
+	case "memory":
+		return collaboration.NewMemoryPubSub(), nil
+	default:
+		return nil, fmt.Errorf("unknown pub/sub driver %q", cfg.PubSub.Driver)
+	}
+}
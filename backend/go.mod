@@ -3,23 +3,30 @@ module github.com/HardMax71/syncwrite/backend
 go 1.21
 
 require (
-    github.com/eclipse/paho.mqtt.golang v1.4.3
-    github.com/golang-jwt/jwt/v5 v5.2.0
-    github.com/jackc/pgx/v5 v5.5.0
-    github.com/joho/godotenv v1.5.1
-    go.uber.org/zap v1.26.0
-    golang.org/x/crypto v0.16.0
-    google.golang.org/grpc v1.59.0
-    google.golang.org/protobuf v1.31.0
-    github.com/golang/protobuf v1.5.3
-    github.com/gorilla/websocket v1.5.1
-    github.com/jackc/pgpassfile v1.0.0
-    github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a
-    github.com/jackc/puddle/v2 v2.2.1
-    go.uber.org/multierr v1.11.0
-    golang.org/x/net v0.19.0
-    golang.org/x/sync v0.5.0
-    golang.org/x/sys v0.15.0
-    golang.org/x/text v0.14.0
-    google.golang.org/genproto/googleapis/rpc v0.0.0-20231120223509-83a465c0220f
-)
\ No newline at end of file
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	github.com/golang-jwt/jwt/v5 v5.2.0
+	github.com/jackc/pgx/v5 v5.5.0
+	github.com/mochi-mqtt/server/v2 v2.4.6
+	github.com/redis/go-redis/v9 v9.3.0
+	go.uber.org/zap v1.26.0
+	golang.org/x/crypto v0.16.0
+	google.golang.org/grpc v1.59.0
+	google.golang.org/protobuf v1.31.0
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/gorilla/websocket v1.5.1 // indirect
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
+	github.com/jackc/puddle/v2 v2.2.1 // indirect
+	github.com/rs/xid v1.4.0 // indirect
+	go.uber.org/multierr v1.11.0 // indirect
+	golang.org/x/net v0.19.0 // indirect
+	golang.org/x/sync v0.5.0 // indirect
+	golang.org/x/sys v0.15.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20231120223509-83a465c0220f // indirect
+)
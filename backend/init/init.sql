@@ -16,20 +16,31 @@ CREATE TABLE IF NOT EXISTS documents (
     title VARCHAR(255) NOT NULL,
     content TEXT,
     owner_id UUID NOT NULL REFERENCES users(id),
-    version VARCHAR(255) NOT NULL,
+    version BIGINT NOT NULL DEFAULT 1,
+    sync_mode VARCHAR(20) NOT NULL DEFAULT 'OT',
+    crdt_state JSONB,
+    yjs_state BYTEA,
+    authorship JSONB,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
                              );
 
--- Document versions table
+-- Document version history table, checkpoints meant for people
 CREATE TABLE IF NOT EXISTS document_versions (
                                                  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     document_id UUID NOT NULL REFERENCES documents(id),
     content TEXT NOT NULL,
     editor_id UUID NOT NULL REFERENCES users(id),
-    version VARCHAR(255) NOT NULL,
-    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-                             );
+    version BIGINT NOT NULL,
+    kind VARCHAR(20) NOT NULL DEFAULT 'MANUAL',
+    summary TEXT NOT NULL DEFAULT '',
+    contributor_ids UUID[] NOT NULL DEFAULT '{}',
+    name TEXT,
+    description TEXT NOT NULL DEFAULT '',
+    pinned BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+                             UNIQUE(document_id, version)
+    );
 
 -- Document permissions table
 CREATE TABLE IF NOT EXISTS document_permissions (
@@ -51,6 +62,48 @@ CREATE TABLE IF NOT EXISTS refresh_tokens (
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
                              );
 
+-- Change broadcast outbox table
+CREATE TABLE IF NOT EXISTS change_outbox (
+                                             id BIGSERIAL PRIMARY KEY,
+    document_id UUID NOT NULL,
+    version BIGINT NOT NULL,
+    topic TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMP WITH TIME ZONE
+                             );
+
+-- Payloads of oversized notifications
+CREATE TABLE IF NOT EXISTS pubsub_messages (
+                                               id BIGSERIAL PRIMARY KEY,
+    topic TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+                             );
+
+-- Collaboration change log table
+CREATE TABLE IF NOT EXISTS document_operations (
+                                                   document_id UUID NOT NULL REFERENCES documents(id),
+    version BIGINT NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(id),
+    change JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+                             PRIMARY KEY (document_id, version)
+    );
+
+-- Collaboration snapshots table
+CREATE TABLE IF NOT EXISTS document_snapshots (
+                                                  document_id UUID NOT NULL REFERENCES documents(id),
+    version BIGINT NOT NULL,
+    content TEXT NOT NULL,
+    crdt_state JSONB,
+    yjs_state BYTEA,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+                             PRIMARY KEY (document_id, version)
+    );
+
 -- Create indexes
 CREATE INDEX IF NOT EXISTS idx_users_email ON users(email);
 CREATE INDEX IF NOT EXISTS idx_documents_owner ON documents(owner_id);
@@ -58,4 +111,9 @@ CREATE INDEX IF NOT EXISTS idx_document_versions_document ON document_versions(d
 CREATE INDEX IF NOT EXISTS idx_document_permissions_document ON document_permissions(document_id);
 CREATE INDEX IF NOT EXISTS idx_document_permissions_user ON document_permissions(user_id);
 CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user ON refresh_tokens(user_id);
-CREATE INDEX IF NOT EXISTS idx_refresh_tokens_token ON refresh_tokens(token);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_token ON refresh_tokens(token);
+CREATE INDEX IF NOT EXISTS idx_change_outbox_pending ON change_outbox(id) WHERE delivered_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_change_outbox_delivered ON change_outbox(delivered_at);
+CREATE INDEX IF NOT EXISTS idx_pubsub_messages_created ON pubsub_messages(created_at);
+CREATE INDEX IF NOT EXISTS idx_document_operations_created ON document_operations(created_at);
+CREATE INDEX IF NOT EXISTS idx_document_versions_named ON document_versions(document_id, version) WHERE name IS NOT NULL;
\ No newline at end of file
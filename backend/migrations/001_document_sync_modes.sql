@@ -0,0 +1,4 @@
+-- Per-document sync mode and the state kept for CRDT and Yjs documents
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS sync_mode VARCHAR(20) NOT NULL DEFAULT 'OT';
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS crdt_state JSONB;
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS yjs_state BYTEA;
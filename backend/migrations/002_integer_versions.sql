@@ -0,0 +1,39 @@
+-- Replace UnixNano version strings with per-document sequence numbers.
+-- Documents start at version 1 and every history row is one increment, so
+-- existing rows are renumbered in creation order. Databases whose versions
+-- are already numbers are left alone.
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'documents' AND column_name = 'version' AND data_type = 'bigint'
+    ) THEN
+        RETURN;
+    END IF;
+
+    ALTER TABLE document_versions ADD COLUMN version_seq BIGINT;
+
+    UPDATE document_versions v
+    SET version_seq = numbered.seq
+    FROM (
+        SELECT id, 1 + ROW_NUMBER() OVER (PARTITION BY document_id ORDER BY created_at, version) AS seq
+        FROM document_versions
+    ) numbered
+    WHERE v.id = numbered.id;
+
+    ALTER TABLE document_versions DROP COLUMN version;
+    ALTER TABLE document_versions RENAME COLUMN version_seq TO version;
+    ALTER TABLE document_versions ALTER COLUMN version SET NOT NULL;
+    ALTER TABLE document_versions ADD CONSTRAINT document_versions_document_id_version_key UNIQUE (document_id, version);
+
+    ALTER TABLE documents ADD COLUMN version_seq BIGINT;
+
+    UPDATE documents d
+    SET version_seq = 1 + (SELECT COUNT(*) FROM document_versions v WHERE v.document_id = d.id);
+
+    ALTER TABLE documents DROP COLUMN version;
+    ALTER TABLE documents RENAME COLUMN version_seq TO version;
+    ALTER TABLE documents ALTER COLUMN version SET NOT NULL;
+    ALTER TABLE documents ALTER COLUMN version SET DEFAULT 1;
+END
+$$;
@@ -0,0 +1,16 @@
+-- Outbox of change broadcasts, written in the transaction that commits each
+-- change and drained by the relay of the collaboration service
+CREATE TABLE IF NOT EXISTS change_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    document_id UUID NOT NULL,
+    version BIGINT NOT NULL,
+    topic TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_change_outbox_pending ON change_outbox(id) WHERE delivered_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_change_outbox_delivered ON change_outbox(delivered_at);
@@ -0,0 +1,10 @@
+-- Payloads too large for a Postgres notification, published by the
+-- LISTEN/NOTIFY transport and referenced from the notification by ID
+CREATE TABLE IF NOT EXISTS pubsub_messages (
+    id BIGSERIAL PRIMARY KEY,
+    topic TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_pubsub_messages_created ON pubsub_messages(created_at);
@@ -0,0 +1,28 @@
+-- Collaboration history: the log of live edits, one row per version, and
+-- snapshots of whole document states that the log is replayed from
+CREATE TABLE IF NOT EXISTS document_operations (
+    document_id UUID NOT NULL REFERENCES documents(id),
+    version BIGINT NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(id),
+    change JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (document_id, version)
+);
+
+CREATE TABLE IF NOT EXISTS document_snapshots (
+    document_id UUID NOT NULL REFERENCES documents(id),
+    version BIGINT NOT NULL,
+    content TEXT NOT NULL,
+    crdt_state JSONB,
+    yjs_state BYTEA,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (document_id, version)
+);
+
+CREATE INDEX IF NOT EXISTS idx_document_operations_created ON document_operations(created_at);
+
+-- Every document needs a snapshot for its history to start from
+INSERT INTO document_snapshots (document_id, version, content, crdt_state, yjs_state)
+SELECT id, version, COALESCE(content, ''), crdt_state, yjs_state FROM documents d
+WHERE NOT EXISTS (SELECT 1 FROM document_snapshots s WHERE s.document_id = d.id)
+ON CONFLICT (document_id, version) DO NOTHING;
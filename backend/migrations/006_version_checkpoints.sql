@@ -0,0 +1,19 @@
+-- document_versions only holds checkpoints, versions meant for people: saved
+-- by a user, restored, or taken from live edits. Live edits themselves are
+-- logged in document_operations.
+BEGIN;
+
+-- Changes stored as versions before the operation log have no editor
+INSERT INTO document_operations (document_id, version, user_id, change, created_at)
+SELECT document_id, version, (content::jsonb ->> 'user_id')::uuid, content::jsonb, created_at
+FROM document_versions
+WHERE editor_id IS NULL
+ON CONFLICT (document_id, version) DO NOTHING;
+
+DELETE FROM document_versions WHERE editor_id IS NULL;
+
+ALTER TABLE document_versions ALTER COLUMN editor_id SET NOT NULL;
+ALTER TABLE document_versions ADD COLUMN IF NOT EXISTS kind VARCHAR(20) NOT NULL DEFAULT 'MANUAL';
+ALTER TABLE document_versions ADD COLUMN IF NOT EXISTS summary TEXT NOT NULL DEFAULT '';
+
+COMMIT;
@@ -0,0 +1,18 @@
+-- Users whose edits a version includes; automatic checkpoints of live edits
+-- usually have several. Versions from before the column get their editor
+-- when it is added; versions written since keep the contributors saved with
+-- them.
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'document_versions' AND column_name = 'contributor_ids'
+    ) THEN
+        RETURN;
+    END IF;
+
+    ALTER TABLE document_versions ADD COLUMN contributor_ids UUID[] NOT NULL DEFAULT '{}';
+
+    UPDATE document_versions SET contributor_ids = ARRAY[editor_id];
+END
+$$;
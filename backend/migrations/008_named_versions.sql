@@ -0,0 +1,7 @@
+-- Versions can be named, described and pinned; pinned versions are kept when
+-- old versions are pruned
+ALTER TABLE document_versions ADD COLUMN IF NOT EXISTS name TEXT;
+ALTER TABLE document_versions ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '';
+ALTER TABLE document_versions ADD COLUMN IF NOT EXISTS pinned BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX IF NOT EXISTS idx_document_versions_named ON document_versions(document_id, version) WHERE name IS NOT NULL;
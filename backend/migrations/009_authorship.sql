@@ -0,0 +1,3 @@
+-- Who last edited each part of a document's text; text written before it was
+-- tracked is attributed to no one
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS authorship JSONB;
@@ -0,0 +1,111 @@
+package collaboration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf16"
+
+	"github.com/HardMax71/syncwrite/backend/pkg/document"
+	"github.com/jackc/pgx/v5"
+)
+
+// BlameRange is a run of the current text of a document last edited by one
+// user. Start and Length are UTF-16 code unit offsets, like those of
+// operations. Text written before authorship was tracked has no user.
+type BlameRange struct {
+	Start    int
+	Length   int
+	UserID   string
+	Username string
+	EditedAt time.Time
+}
+
+// spliceAuthorship applies the ranges operations edit to the authorship of the
+// text they apply to.
+func spliceAuthorship(authorship document.Authorship, operations []Operation, userID string, at time.Time) document.Authorship {
+	for _, op := range operations {
+		var deleted, inserted int
+		switch op.Type {
+		case OperationTypeInsert:
+			inserted = len(utf16.Encode([]rune(op.Content)))
+		case OperationTypeDelete:
+			deleted = int(op.Length)
+		case OperationTypeReplace:
+			deleted = int(op.Length)
+			inserted = len(utf16.Encode([]rune(op.Content)))
+		}
+		authorship = authorship.Splice(int(op.Position), deleted, inserted, userID, at)
+	}
+	return authorship
+}
+
+// Blame returns who last edited each part of the current text of a document,
+// along with the version of the text.
+func (s *Service) Blame(ctx context.Context, documentID string) (int64, []*BlameRange, error) {
+	var version int64
+	var content, syncMode string
+	var data []byte
+	err := s.db.QueryRow(ctx, `
+        SELECT version, COALESCE(content, ''), sync_mode, authorship FROM documents WHERE id = $1
+    `, documentID).Scan(&version, &content, &syncMode, &data)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil, document.ErrDocumentNotFound
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("error getting document: %w", err)
+	}
+
+	// Yjs updates do not track who wrote the text
+	if syncMode == document.SyncModeYJS {
+		return 0, nil, document.ErrYjsDocument
+	}
+
+	authorship := document.LoadAuthorship(data, content)
+
+	var userIDs []string
+	for _, span := range authorship {
+		if span.UserID != "" {
+			userIDs = append(userIDs, span.UserID)
+		}
+	}
+
+	usernames := make(map[string]string)
+	if len(userIDs) > 0 {
+		rows, err := s.db.Query(ctx, `
+            SELECT id::text, username FROM users WHERE id::text = ANY($1)
+        `, userIDs)
+		if err != nil {
+			return 0, nil, fmt.Errorf("error querying users: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var userID, username string
+			if err := rows.Scan(&userID, &username); err != nil {
+				return 0, nil, fmt.Errorf("error scanning user: %w", err)
+			}
+			usernames[userID] = username
+		}
+		if err := rows.Err(); err != nil {
+			return 0, nil, fmt.Errorf("error reading users: %w", err)
+		}
+	}
+
+	ranges := make([]*BlameRange, len(authorship))
+	start := 0
+	for i, span := range authorship {
+		ranges[i] = &BlameRange{
+			Start:    start,
+			Length:   span.Length,
+			UserID:   span.UserID,
+			Username: usernames[span.UserID],
+			EditedAt: span.EditedAt,
+		}
+		start += span.Length
+	}
+
+	return version, ranges, nil
+}
@@ -0,0 +1,144 @@
+package collaboration
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/HardMax71/syncwrite/backend/pkg/utils"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"go.uber.org/zap"
+)
+
+// Embedded MQTT broker.
+//
+// For development and tests the server can run the broker itself instead of
+// relying on Mosquitto, with the MQTT transport connecting back to it like any
+// other client. Clients are checked by BrokerAuth directly, applying the same
+// rules the external broker gets from the HTTP endpoints.
+//
+// Like Mosquitto, the broker listens for plain WebSocket connections: browsers
+// connect over wss to the TLS-terminating proxy in front of it, which forwards
+// them to the WebSocket port.
+
+// Broker is an MQTT broker listening for TCP and WebSocket clients.
+type Broker struct {
+	server *mqtt.Server
+	logger *zap.Logger
+}
+
+// NewBroker creates a broker and opens its listeners. It accepts connections
+// once Serve is called.
+func NewBroker(auth *BrokerAuth, tcpAddress, wsAddress string) (*Broker, error) {
+	server := mqtt.New(&mqtt.Options{
+		// The broker logs every connection, and every client closing one as a
+		// warning; denied clients are logged by the auth hook
+		Logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError})),
+	})
+
+	if err := server.AddHook(&brokerAuthHook{auth: auth, logger: utils.Logger()}, nil); err != nil {
+		server.Close()
+		return nil, fmt.Errorf("error adding broker auth hook: %w", err)
+	}
+	if err := server.AddListener(listeners.NewTCP("tcp", tcpAddress, nil)); err != nil {
+		server.Close()
+		return nil, fmt.Errorf("error listening on %s: %w", tcpAddress, err)
+	}
+	if err := server.AddListener(listeners.NewWebsocket("ws", wsAddress, nil)); err != nil {
+		server.Close()
+		return nil, fmt.Errorf("error listening on %s: %w", wsAddress, err)
+	}
+
+	return &Broker{
+		server: server,
+		logger: utils.Logger(),
+	}, nil
+}
+
+// Serve starts accepting clients and returns.
+func (b *Broker) Serve() error {
+	if err := b.server.Serve(); err != nil {
+		return fmt.Errorf("error starting broker: %w", err)
+	}
+	return nil
+}
+
+// Close disconnects every client and closes the listeners.
+func (b *Broker) Close() {
+	if err := b.server.Close(); err != nil {
+		b.logger.Error("Error closing broker", zap.Error(err))
+	}
+}
+
+// brokerAuthHook authenticates clients with their broker token and checks
+// every publish and subscribe against its claims.
+type brokerAuthHook struct {
+	mqtt.HookBase
+	auth   *BrokerAuth
+	logger *zap.Logger
+	// claims holds the claims of every connected client.
+	claims sync.Map
+}
+
+func (h *brokerAuthHook) ID() string {
+	return "broker-auth"
+}
+
+func (h *brokerAuthHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnACLCheck,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// OnConnectAuthenticate takes the token from the password or, failing that,
+// the username, like the HTTP endpoints.
+func (h *brokerAuthHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	token := string(pk.Connect.Password)
+	if token == "" {
+		token = string(pk.Connect.Username)
+	}
+
+	claims, err := h.auth.Authenticate(token)
+	if err != nil {
+		h.logger.Debug("Denied broker connection", zap.String("client_id", cl.ID), zap.Error(err))
+		return false
+	}
+
+	h.claims.Store(cl, claims)
+	return true
+}
+
+// OnACLCheck is called with the filter of a subscription and with the topic of
+// every message published by or delivered to the client. Once its token
+// expires a client is denied everything, as the external broker denies it
+// when checking the token again.
+func (h *brokerAuthHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	value, ok := h.claims.Load(cl)
+	if !ok {
+		return false
+	}
+	claims := value.(*BrokerClaims)
+	if claims.ExpiresAt != nil && time.Now().After(claims.ExpiresAt.Time) {
+		return false
+	}
+
+	access := BrokerAccessRead
+	switch {
+	case write:
+		access = BrokerAccessWrite
+	case isWildcardFilter(topic):
+		access = BrokerAccessSubscribe
+	}
+	return h.auth.Authorize(claims, topic, access)
+}
+
+func (h *brokerAuthHook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.claims.Delete(cl)
+}
@@ -0,0 +1,280 @@
+package collaboration
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HardMax71/syncwrite/backend/pkg/utils"
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+// Broker authorization.
+//
+// Clients connect to the MQTT broker with short-lived credentials minted when
+// they join a session. The credentials are a JWT listing the topics the user
+// may read and write, derived from the user's permission on the document.
+// Only the backend publishes, so clients are never granted write access: the
+// server acts on the presence topic, e.g. ending the stream of a connection
+// that left, so a forged event there could disconnect other users. Clients
+// change their presence through the API instead.
+//
+// The broker checks credentials against the HTTP endpoints of BrokerAuth,
+// which follow the remote JWT backend of mosquitto-go-auth: the token comes in
+// the Authorization header, or as the password or username for the plain
+// HTTP backend, and a status of 200 grants access.
+
+const brokerAudience = "mqtt-broker"
+
+var ErrInvalidBrokerToken = errors.New("invalid broker token")
+
+// BrokerAccess is the access a client asks for, using mosquitto's values.
+type BrokerAccess int
+
+const (
+	BrokerAccessRead      BrokerAccess = 1
+	BrokerAccessWrite     BrokerAccess = 2
+	BrokerAccessReadWrite BrokerAccess = 3
+	BrokerAccessSubscribe BrokerAccess = 4
+)
+
+// BrokerClaims are the claims of a broker token. Read and Write hold topic
+// filters.
+type BrokerClaims struct {
+	Read      []string `json:"read,omitempty"`
+	Write     []string `json:"write,omitempty"`
+	Superuser bool     `json:"superuser,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// BrokerCredentials are what a client connects to the broker with.
+type BrokerCredentials struct {
+	Username  string
+	Password  string
+	ExpiresAt time.Time
+	Read      []string
+	Write     []string
+}
+
+type BrokerAuth struct {
+	secret []byte
+	ttl    time.Duration
+	logger *zap.Logger
+}
+
+func NewBrokerAuth(secret string, ttl time.Duration) *BrokerAuth {
+	return &BrokerAuth{
+		secret: []byte(secret),
+		ttl:    ttl,
+		logger: utils.Logger(),
+	}
+}
+
+// ServerCredentialTTL is how long the credentials of ServerCredentials last.
+func (b *BrokerAuth) ServerCredentialTTL() time.Duration {
+	return b.ttl
+}
+
+// Credentials mints credentials for a member of a document, which may read
+// its topics.
+func (b *BrokerAuth) Credentials(userID, documentID string) (*BrokerCredentials, error) {
+	read := []string{GetDocumentTopic(documentID), GetPresenceTopic(documentID)}
+
+	expiresAt := time.Now().Add(b.ttl)
+	token, err := b.sign(&BrokerClaims{
+		Read: read,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   userID,
+			Audience:  jwt.ClaimStrings{brokerAudience},
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &BrokerCredentials{
+		Username:  token,
+		Password:  token,
+		ExpiresAt: expiresAt,
+		Read:      read,
+	}, nil
+}
+
+// ServerCredentials returns fresh credentials for the backend to connect
+// with. They expire like those of clients, so the backend has to reconnect
+// with new ones within ServerCredentialTTL.
+func (b *BrokerAuth) ServerCredentials() (string, string) {
+	token, err := b.sign(&BrokerClaims{
+		Superuser: true,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "syncwrite-server",
+			Audience:  jwt.ClaimStrings{brokerAudience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(b.ttl)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	})
+	if err != nil {
+		b.logger.Error("Error signing server broker credentials", zap.Error(err))
+	}
+	return token, token
+}
+
+// Authenticate validates a broker token and returns its claims.
+func (b *BrokerAuth) Authenticate(token string) (*BrokerClaims, error) {
+	parsed, err := jwt.ParseWithClaims(token, &BrokerClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		return b.secret, nil
+	}, jwt.WithAudience(brokerAudience))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBrokerToken, err)
+	}
+
+	claims, ok := parsed.Claims.(*BrokerClaims)
+	if !ok || !parsed.Valid {
+		return nil, ErrInvalidBrokerToken
+	}
+	return claims, nil
+}
+
+// Authorize reports whether claims grant access to topic. For a subscription,
+// topic is the filter subscribed to, which must not reach beyond the granted
+// topics.
+func (b *BrokerAuth) Authorize(claims *BrokerClaims, topic string, access BrokerAccess) bool {
+	if claims.Superuser {
+		return true
+	}
+
+	switch access {
+	case BrokerAccessRead:
+		return matchAny(claims.Read, topic)
+	case BrokerAccessSubscribe:
+		// A wildcard subscription could match topics of other documents
+		return !isWildcardFilter(topic) && matchAny(claims.Read, topic)
+	case BrokerAccessWrite:
+		return matchAny(claims.Write, topic)
+	case BrokerAccessReadWrite:
+		return matchAny(claims.Read, topic) && matchAny(claims.Write, topic)
+	default:
+		return false
+	}
+}
+
+func matchAny(filters []string, topic string) bool {
+	for _, filter := range filters {
+		if matchTopic(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *BrokerAuth) sign(claims *BrokerClaims) (string, error) {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(b.secret)
+	if err != nil {
+		return "", fmt.Errorf("error signing broker token: %w", err)
+	}
+	return token, nil
+}
+
+// brokerAuthRequest holds the parameters the broker sends, as JSON or as a
+// form.
+type brokerAuthRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	ClientID string `json:"clientid"`
+	Topic    string `json:"topic"`
+	Acc      int    `json:"acc"`
+}
+
+// Handler serves the endpoints the broker checks clients against: /auth when
+// a client connects, /superuser and /acl for every publish and subscribe.
+func (b *BrokerAuth) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/auth", b.serve(func(claims *BrokerClaims, req *brokerAuthRequest) bool {
+		return true
+	}))
+	mux.HandleFunc("/superuser", b.serve(func(claims *BrokerClaims, req *brokerAuthRequest) bool {
+		return claims.Superuser
+	}))
+	mux.HandleFunc("/acl", b.serve(func(claims *BrokerClaims, req *brokerAuthRequest) bool {
+		return b.Authorize(claims, req.Topic, BrokerAccess(req.Acc))
+	}))
+
+	return mux
+}
+
+func (b *BrokerAuth) serve(allow func(claims *BrokerClaims, req *brokerAuthRequest) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		req, err := parseBrokerAuthRequest(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		claims, err := b.Authenticate(brokerToken(r, req))
+		if err != nil || !allow(claims, req) {
+			b.logger.Debug("Denied broker access",
+				zap.String("path", r.URL.Path),
+				zap.String("client_id", req.ClientID),
+				zap.String("topic", req.Topic),
+				zap.Error(err))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func parseBrokerAuthRequest(r *http.Request) (*brokerAuthRequest, error) {
+	var req brokerAuthRequest
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, fmt.Errorf("error decoding request: %w", err)
+		}
+		return &req, nil
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return nil, fmt.Errorf("error parsing form: %w", err)
+	}
+	req.Username = r.PostForm.Get("username")
+	req.Password = r.PostForm.Get("password")
+	req.ClientID = r.PostForm.Get("clientid")
+	req.Topic = r.PostForm.Get("topic")
+	if acc := r.PostForm.Get("acc"); acc != "" {
+		value, err := strconv.Atoi(acc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid acc %q: %w", acc, err)
+		}
+		req.Acc = value
+	}
+	return &req, nil
+}
+
+// brokerToken finds the token in a request from the broker.
+func brokerToken(r *http.Request, req *brokerAuthRequest) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	if req.Password != "" {
+		return req.Password
+	}
+	return req.Username
+}
@@ -0,0 +1,219 @@
+package collaboration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/HardMax71/syncwrite/backend/pkg/document"
+	"github.com/HardMax71/syncwrite/backend/pkg/utils"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+// Automatic checkpoints.
+//
+// Live edits only reach the operation log, so the checkpointer adds versions
+// of live-edited documents to the version history: after a number of changes,
+// once a document has been idle for a while, and when the last user leaves its
+// session. A checkpoint holds the full text and is attributed to every user
+// whose changes it includes. The checkpointer only tracks the changes this
+// replica committed, but a checkpoint covers every change logged since the
+// previous version, whichever replica committed it.
+//
+// YJS documents are not checkpointed, since the server does not resolve their
+// text.
+
+// Checkpointer takes automatic checkpoints of live-edited documents.
+type Checkpointer struct {
+	db     *pgxpool.Pool
+	logger *zap.Logger
+	// maxChanges is the number of changes after which a document is
+	// checkpointed; zero until the checkpointer is started.
+	maxChanges int
+	pending    map[string]*pendingCheckpoint
+	mutex      sync.Mutex
+	wake       chan struct{}
+}
+
+// pendingCheckpoint tracks the changes committed to a document since its last
+// checkpoint.
+type pendingCheckpoint struct {
+	changes  int
+	lastEdit time.Time
+	// due is set once the document is to be checkpointed right away.
+	due bool
+}
+
+func NewCheckpointer(db *pgxpool.Pool) *Checkpointer {
+	return &Checkpointer{
+		db:      db,
+		logger:  utils.Logger(),
+		pending: make(map[string]*pendingCheckpoint),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Record notes a change committed to a document.
+func (c *Checkpointer) Record(documentID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	pending, exists := c.pending[documentID]
+	if !exists {
+		pending = &pendingCheckpoint{}
+		c.pending[documentID] = pending
+	}
+	pending.changes++
+	pending.lastEdit = time.Now()
+
+	if c.maxChanges > 0 && pending.changes >= c.maxChanges {
+		pending.due = true
+		c.notify()
+	}
+}
+
+// Flush checkpoints a document right away, e.g. when the last user left its
+// session.
+func (c *Checkpointer) Flush(documentID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	pending, exists := c.pending[documentID]
+	if !exists {
+		pending = &pendingCheckpoint{}
+		c.pending[documentID] = pending
+	}
+	pending.due = true
+	c.notify()
+}
+
+func (c *Checkpointer) notify() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start checkpoints documents after maxChanges changes, or once they have been
+// idle for idleTimeout, until ctx is done.
+func (c *Checkpointer) Start(ctx context.Context, maxChanges int, idleTimeout time.Duration) {
+	c.mutex.Lock()
+	c.maxChanges = maxChanges
+	c.mutex.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(max(idleTimeout/4, time.Second))
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-c.wake:
+			case <-ctx.Done():
+				return
+			}
+
+			for _, documentID := range c.takeDue(time.Now().Add(-idleTimeout)) {
+				if err := c.checkpoint(ctx, documentID); err != nil {
+					c.logger.Error("Error checkpointing document",
+						zap.String("document_id", documentID), zap.Error(err))
+				}
+			}
+		}
+	}()
+}
+
+// takeDue removes and returns the documents that are due or were last edited
+// before idleSince.
+func (c *Checkpointer) takeDue(idleSince time.Time) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var due []string
+	for documentID, pending := range c.pending {
+		if pending.due || pending.lastEdit.Before(idleSince) {
+			due = append(due, documentID)
+			delete(c.pending, documentID)
+		}
+	}
+	return due
+}
+
+// checkpoint adds the current text of a document to its version history,
+// unless its current version already is in it.
+func (c *Checkpointer) checkpoint(ctx context.Context, documentID string) error {
+	var version int64
+	var title, content, syncMode string
+	err := c.db.QueryRow(ctx, `
+        SELECT version, title, COALESCE(content, ''), sync_mode FROM documents WHERE id = $1
+    `, documentID).Scan(&version, &title, &content, &syncMode)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error getting document: %w", err)
+	}
+
+	if syncMode == document.SyncModeYJS {
+		return nil
+	}
+
+	// The text of the previous version, or the text the document was created
+	// with
+	var lastVersion int64
+	var lastContent string
+	err = c.db.QueryRow(ctx, `
+        SELECT version, content FROM document_versions
+        WHERE document_id = $1
+        ORDER BY version DESC
+        LIMIT 1
+    `, documentID).Scan(&lastVersion, &lastContent)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = c.db.QueryRow(ctx, `
+            SELECT content FROM document_snapshots
+            WHERE document_id = $1
+            ORDER BY version ASC
+            LIMIT 1
+        `, documentID).Scan(&lastContent)
+		if errors.Is(err, pgx.ErrNoRows) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error getting previous version: %w", err)
+	}
+
+	if version <= lastVersion {
+		return nil
+	}
+
+	// Attribute the checkpoint to the users whose changes it includes, with
+	// the author of the latest change as its editor. Without logged changes,
+	// e.g. once they were compacted, there is no one to attribute it to.
+	tag, err := c.db.Exec(ctx, `
+        INSERT INTO document_versions (document_id, content, editor_id, version, kind, summary, contributor_ids)
+        SELECT $1, $2, (array_agg(user_id ORDER BY version DESC))[1], $3, $4, $5, array_agg(DISTINCT user_id)
+        FROM document_operations
+        WHERE document_id = $1 AND version > $6 AND version <= $3
+        HAVING COUNT(*) > 0
+        ON CONFLICT (document_id, version) DO NOTHING
+    `, documentID, content, version, document.VersionKindAutomatic,
+		document.SummarizeEdit(title, title, lastContent, content), lastVersion)
+
+	if err != nil {
+		return fmt.Errorf("error storing checkpoint: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		c.logger.Debug("Skipped checkpoint",
+			zap.String("document_id", documentID), zap.Int64("version", version))
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package collaboration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/HardMax71/syncwrite/backend/pkg/utils"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+// HistoryCompactor folds logged changes older than the retention into
+// snapshots. A document is compacted up to its latest snapshot that only
+// follows changes older than the retention; those changes and any earlier
+// snapshots are deleted. A document no longer edited is snapshotted first, so
+// its whole log can go. Clients further behind than the retention resync
+// instead of catching up.
+type HistoryCompactor struct {
+	db     *pgxpool.Pool
+	logger *zap.Logger
+}
+
+func NewHistoryCompactor(db *pgxpool.Pool) *HistoryCompactor {
+	return &HistoryCompactor{
+		db:     db,
+		logger: utils.Logger(),
+	}
+}
+
+// Start compacts the history every interval until ctx is done.
+func (c *HistoryCompactor) Start(ctx context.Context, interval, retention time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+
+			if err := c.compact(ctx, retention); err != nil {
+				c.logger.Error("Error compacting history", zap.Error(err))
+			}
+		}
+	}()
+}
+
+func (c *HistoryCompactor) compact(ctx context.Context, retention time.Duration) error {
+	cutoff := time.Now().Add(-retention)
+
+	rows, err := c.db.Query(ctx, `
+        SELECT DISTINCT document_id FROM document_operations WHERE created_at < $1
+    `, cutoff)
+	if err != nil {
+		return fmt.Errorf("error querying documents to compact: %w", err)
+	}
+
+	var documentIDs []string
+	for rows.Next() {
+		var documentID string
+		if err := rows.Scan(&documentID); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning document ID: %w", err)
+		}
+		documentIDs = append(documentIDs, documentID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading documents to compact: %w", err)
+	}
+
+	for _, documentID := range documentIDs {
+		if err := c.compactDocument(ctx, documentID, cutoff); err != nil {
+			c.logger.Error("Error compacting document history",
+				zap.String("document_id", documentID), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+func (c *HistoryCompactor) compactDocument(ctx context.Context, documentID string, cutoff time.Time) error {
+	tx, err := c.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Skip documents being edited; they are compacted on a later run
+	var currentVersion int64
+	err = tx.QueryRow(ctx, `
+        SELECT version FROM documents WHERE id = $1 FOR UPDATE SKIP LOCKED
+    `, documentID).Scan(&currentVersion)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error locking document: %w", err)
+	}
+
+	// Snapshot a document whose last change is older than the retention, so
+	// the tail of its log can be folded too
+	var idle bool
+	err = tx.QueryRow(ctx, `
+        SELECT EXISTS (
+            SELECT 1 FROM document_operations
+            WHERE document_id = $1 AND version = $2 AND created_at < $3
+        )
+    `, documentID, currentVersion, cutoff).Scan(&idle)
+
+	if err != nil {
+		return fmt.Errorf("error checking last change: %w", err)
+	}
+
+	if idle {
+		if err := takeSnapshot(ctx, tx, documentID); err != nil {
+			return err
+		}
+	}
+
+	var base *int64
+	err = tx.QueryRow(ctx, `
+        SELECT MAX(version) FROM document_snapshots
+        WHERE document_id = $1 AND version <= (
+            SELECT MAX(version) FROM document_operations
+            WHERE document_id = $1 AND created_at < $2
+        )
+    `, documentID, cutoff).Scan(&base)
+
+	if err != nil {
+		return fmt.Errorf("error finding snapshot to compact into: %w", err)
+	}
+
+	if base != nil {
+		_, err = tx.Exec(ctx, `
+            DELETE FROM document_operations WHERE document_id = $1 AND version <= $2
+        `, documentID, *base)
+		if err != nil {
+			return fmt.Errorf("error deleting compacted changes: %w", err)
+		}
+
+		_, err = tx.Exec(ctx, `
+            DELETE FROM document_snapshots WHERE document_id = $1 AND version < $2
+        `, documentID, *base)
+		if err != nil {
+			return fmt.Errorf("error deleting superseded snapshots: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return nil
+}
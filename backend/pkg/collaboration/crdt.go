@@ -0,0 +1,260 @@
+package collaboration
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Sequence CRDT for documents in CRDT sync mode.
+//
+// The document is a replicated growable array (RGA): every character carries a
+// unique CharID made of the inserting client's ID and a Lamport clock, and
+// remembers the character it was inserted after (its origin). Deleted
+// characters stay in the sequence as tombstones so later inserts can still
+// reference them. Replicas that apply the same set of operations end up with
+// the same sequence regardless of delivery order, provided each operation is
+// delivered after the operations it references.
+
+var (
+	ErrMissingDependency = errors.New("operation references an unknown character")
+	ErrSyncModeMismatch  = errors.New("operation does not match the document sync mode")
+)
+
+// StateVector maps a client ID to the highest clock seen from that client.
+type StateVector map[string]uint64
+
+// Covers reports whether the operation identified by id is included in sv.
+func (sv StateVector) Covers(id CharID) bool {
+	return id.Clock <= sv[id.ClientID]
+}
+
+func (sv StateVector) observe(id CharID) {
+	if id.Clock > sv[id.ClientID] {
+		sv[id.ClientID] = id.Clock
+	}
+}
+
+// CRDTElement is one character of a CRDTDocument.
+type CRDTElement struct {
+	ID        CharID `json:"id"`
+	Origin    CharID `json:"origin"`
+	Value     string `json:"value"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	DeletedBy CharID `json:"deleted_by"`
+}
+
+type CRDTDocument struct {
+	elements []*CRDTElement
+	index    map[CharID]*CRDTElement
+}
+
+func NewCRDTDocument() *CRDTDocument {
+	return &CRDTDocument{
+		index: make(map[CharID]*CRDTElement),
+	}
+}
+
+// SeedCRDTDocument builds a CRDT document holding content, attributing every
+// character to clientID. It is used to initialise the CRDT state of documents
+// whose text was written outside of the CRDT, so clientID must be unique to
+// that text.
+func SeedCRDTDocument(clientID, content string) *CRDTDocument {
+	doc := NewCRDTDocument()
+	if content != "" {
+		// Seeding cannot fail: the first character has no origin and the
+		// following ones reference their predecessors.
+		_, _ = doc.Apply(CRDTOperation{
+			Type:    CRDTOperationTypeInsert,
+			ID:      CharID{ClientID: clientID, Clock: 1},
+			Content: content,
+		})
+	}
+	return doc
+}
+
+// LoadCRDTDocument restores a document from the JSON produced by MarshalJSON.
+func LoadCRDTDocument(data []byte) (*CRDTDocument, error) {
+	var elements []*CRDTElement
+	if err := json.Unmarshal(data, &elements); err != nil {
+		return nil, fmt.Errorf("error unmarshaling CRDT state: %w", err)
+	}
+
+	doc := NewCRDTDocument()
+	doc.elements = elements
+	for _, element := range elements {
+		doc.index[element.ID] = element
+	}
+	return doc, nil
+}
+
+func (d *CRDTDocument) MarshalJSON() ([]byte, error) {
+	if d.elements == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(d.elements)
+}
+
+// Text returns the visible content of the document.
+func (d *CRDTDocument) Text() string {
+	var b strings.Builder
+	for _, element := range d.elements {
+		if !element.Deleted {
+			b.WriteString(element.Value)
+		}
+	}
+	return b.String()
+}
+
+// StateVector returns the highest clock seen from every client.
+func (d *CRDTDocument) StateVector() StateVector {
+	sv := make(StateVector)
+	for _, element := range d.elements {
+		sv.observe(element.ID)
+		if element.Deleted {
+			sv.observe(element.DeletedBy)
+		}
+	}
+	return sv
+}
+
+// OperationsSince returns the operations needed to bring a replica with state
+// vector sv up to date, in an order that satisfies their dependencies.
+func (d *CRDTDocument) OperationsSince(sv StateVector) []CRDTOperation {
+	var inserts, deletes []CRDTOperation
+	for _, element := range d.elements {
+		if !sv.Covers(element.ID) {
+			inserts = append(inserts, CRDTOperation{
+				Type:    CRDTOperationTypeInsert,
+				ID:      element.ID,
+				Origin:  element.Origin,
+				Content: element.Value,
+			})
+		}
+		if element.Deleted && !sv.Covers(element.DeletedBy) {
+			deletes = append(deletes, CRDTOperation{
+				Type:   CRDTOperationTypeDelete,
+				ID:     element.DeletedBy,
+				Target: element.ID,
+			})
+		}
+	}
+	return append(inserts, deletes...)
+}
+
+// Apply integrates op into the document. It reports false if op had already
+// been applied, which makes redelivery harmless.
+func (d *CRDTDocument) Apply(op CRDTOperation) (bool, error) {
+	switch op.Type {
+	case CRDTOperationTypeInsert:
+		return d.insert(op)
+	case CRDTOperationTypeDelete:
+		return d.delete(op)
+	default:
+		return false, fmt.Errorf("%w: unknown CRDT operation type %d", ErrInvalidOperation, op.Type)
+	}
+}
+
+// insert integrates every character of op.Content. Characters after the first
+// get consecutive clocks and are chained to their predecessor.
+func (d *CRDTDocument) insert(op CRDTOperation) (bool, error) {
+	if op.Content == "" {
+		return false, fmt.Errorf("%w: empty insert", ErrInvalidOperation)
+	}
+
+	applied := false
+	id, origin := op.ID, op.Origin
+	for _, r := range op.Content {
+		inserted, err := d.insertElement(&CRDTElement{ID: id, Origin: origin, Value: string(r)})
+		if err != nil {
+			return applied, err
+		}
+		applied = applied || inserted
+
+		origin = id
+		id.Clock++
+	}
+	return applied, nil
+}
+
+func (d *CRDTDocument) insertElement(element *CRDTElement) (bool, error) {
+	if _, exists := d.index[element.ID]; exists {
+		return false, nil
+	}
+
+	position := 0
+	if !element.Origin.IsZero() {
+		if !element.ID.After(element.Origin) {
+			return false, fmt.Errorf("%w: character %s is not newer than its origin %s",
+				ErrInvalidOperation, element.ID, element.Origin)
+		}
+
+		originPosition := d.position(element.Origin)
+		if originPosition < 0 {
+			return false, fmt.Errorf("%w: %s", ErrMissingDependency, element.Origin)
+		}
+		position = originPosition + 1
+	}
+
+	// Concurrent inserts after the same origin are ordered by descending ID;
+	// anything newer than element, including characters later typed after
+	// those newer inserts, stays in front of it.
+	for position < len(d.elements) && d.elements[position].ID.After(element.ID) {
+		position++
+	}
+
+	d.elements = append(d.elements, nil)
+	copy(d.elements[position+1:], d.elements[position:])
+	d.elements[position] = element
+	d.index[element.ID] = element
+	return true, nil
+}
+
+func (d *CRDTDocument) delete(op CRDTOperation) (bool, error) {
+	element, exists := d.index[op.Target]
+	if !exists {
+		return false, fmt.Errorf("%w: %s", ErrMissingDependency, op.Target)
+	}
+
+	// Of concurrent deletes of the same character the newest is kept, so
+	// replicas agree on it whatever order the deletes arrive in
+	if element.Deleted && !op.ID.After(element.DeletedBy) {
+		return false, nil
+	}
+
+	element.Deleted = true
+	element.DeletedBy = op.ID
+	return true, nil
+}
+
+func (d *CRDTDocument) position(id CharID) int {
+	if _, exists := d.index[id]; !exists {
+		return -1
+	}
+	for i, element := range d.elements {
+		if element.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// IsZero reports whether id is the zero ID, which stands for the start of the
+// document when used as an origin.
+func (id CharID) IsZero() bool {
+	return id.ClientID == "" && id.Clock == 0
+}
+
+// After reports whether id sorts after other: higher clocks win, and client
+// IDs break ties between equal clocks.
+func (id CharID) After(other CharID) bool {
+	if id.Clock != other.Clock {
+		return id.Clock > other.Clock
+	}
+	return id.ClientID > other.ClientID
+}
+
+func (id CharID) String() string {
+	return fmt.Sprintf("%s@%d", id.ClientID, id.Clock)
+}
@@ -0,0 +1,281 @@
+package collaboration
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func crdtInsert(clientID string, clock uint64, origin CharID, content string) CRDTOperation {
+	return CRDTOperation{Type: CRDTOperationTypeInsert, ID: CharID{ClientID: clientID, Clock: clock}, Origin: origin, Content: content}
+}
+
+func crdtDelete(clientID string, clock uint64, target CharID) CRDTOperation {
+	return CRDTOperation{Type: CRDTOperationTypeDelete, ID: CharID{ClientID: clientID, Clock: clock}, Target: target}
+}
+
+// TestCRDTConvergence applies the same operations in every order they can be
+// delivered in and checks that all replicas end up in the same state.
+func TestCRDTConvergence(t *testing.T) {
+	x1 := CharID{ClientID: "x", Clock: 1}
+	x2 := CharID{ClientID: "x", Clock: 2}
+
+	tests := []struct {
+		name string
+		// base is applied first on every replica
+		base       []CRDTOperation
+		operations []CRDTOperation
+		want       string
+	}{
+		{
+			name: "concurrent inserts at the start",
+			operations: []CRDTOperation{
+				crdtInsert("a", 1, CharID{}, "a"),
+				crdtInsert("b", 1, CharID{}, "b"),
+				crdtInsert("c", 1, CharID{}, "c"),
+			},
+			want: "cba",
+		},
+		{
+			name: "concurrent inserts after the same character",
+			base: []CRDTOperation{crdtInsert("x", 1, CharID{}, "xy")},
+			operations: []CRDTOperation{
+				crdtInsert("a", 3, x1, "A"),
+				crdtInsert("b", 3, x1, "B"),
+				crdtInsert("c", 4, x1, "C"),
+			},
+			want: "xCBAy",
+		},
+		{
+			name: "text typed after concurrent inserts stays with them",
+			base: []CRDTOperation{crdtInsert("x", 1, CharID{}, "xy")},
+			operations: []CRDTOperation{
+				crdtInsert("a", 3, x1, "12"),
+				crdtInsert("a", 5, CharID{ClientID: "a", Clock: 4}, "3"),
+				crdtInsert("b", 3, x1, "45"),
+			},
+			want: "x45123y",
+		},
+		{
+			name: "insert after a concurrently deleted character",
+			base: []CRDTOperation{crdtInsert("x", 1, CharID{}, "xy")},
+			operations: []CRDTOperation{
+				crdtDelete("a", 3, x2),
+				crdtInsert("b", 3, x2, "z"),
+				crdtInsert("b", 4, CharID{ClientID: "b", Clock: 3}, "!"),
+			},
+			want: "xz!",
+		},
+		{
+			name: "concurrent deletes of the same character",
+			base: []CRDTOperation{crdtInsert("x", 1, CharID{}, "xy")},
+			operations: []CRDTOperation{
+				crdtDelete("a", 3, x1),
+				crdtDelete("b", 4, x1),
+				crdtInsert("c", 3, x2, "z"),
+			},
+			want: "yz",
+		},
+		{
+			name: "multi-character inserts from several clients",
+			operations: []CRDTOperation{
+				crdtInsert("a", 1, CharID{}, "hello"),
+				crdtInsert("b", 6, CharID{ClientID: "a", Clock: 5}, " world"),
+				crdtInsert("c", 6, CharID{ClientID: "a", Clock: 5}, ","),
+				crdtDelete("c", 7, CharID{ClientID: "a", Clock: 1}),
+				crdtInsert("c", 8, CharID{}, "H"),
+			},
+			want: "Hello, world",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reference *CRDTDocument
+			var referenceState []byte
+			permute(len(tt.operations), func(order []int) {
+				operations := make([]CRDTOperation, len(order))
+				for i, j := range order {
+					operations[i] = tt.operations[j]
+				}
+
+				doc := NewCRDTDocument()
+				deliver(t, doc, tt.base)
+				deliver(t, doc, operations)
+
+				state, err := doc.MarshalJSON()
+				if err != nil {
+					t.Fatalf("MarshalJSON() error = %v", err)
+				}
+
+				if reference == nil {
+					reference, referenceState = doc, state
+					if got := doc.Text(); got != tt.want {
+						t.Fatalf("Text() = %q, want %q", got, tt.want)
+					}
+					return
+				}
+
+				if got, want := doc.Text(), reference.Text(); got != want {
+					t.Fatalf("order %v: Text() = %q, want %q", order, got, want)
+				}
+				if got, want := doc.StateVector(), reference.StateVector(); !reflect.DeepEqual(got, want) {
+					t.Fatalf("order %v: StateVector() = %v, want %v", order, got, want)
+				}
+				if !bytes.Equal(state, referenceState) {
+					t.Fatalf("order %v: state = %s, want %s", order, state, referenceState)
+				}
+			})
+		})
+	}
+}
+
+// TestCRDTSync brings replicas that saw different operations up to date with
+// OperationsSince, and checks that they converge.
+func TestCRDTSync(t *testing.T) {
+	a, b := NewCRDTDocument(), NewCRDTDocument()
+	deliver(t, a, []CRDTOperation{crdtInsert("a", 1, CharID{}, "abc")})
+	deliver(t, b, a.OperationsSince(b.StateVector()))
+
+	deliver(t, a, []CRDTOperation{
+		crdtInsert("a", 4, CharID{ClientID: "a", Clock: 1}, "X"),
+		crdtDelete("a", 5, CharID{ClientID: "a", Clock: 3}),
+	})
+	deliver(t, b, []CRDTOperation{
+		crdtInsert("b", 4, CharID{ClientID: "a", Clock: 1}, "Y"),
+		crdtDelete("b", 5, CharID{ClientID: "a", Clock: 2}),
+	})
+
+	toB := a.OperationsSince(b.StateVector())
+	toA := b.OperationsSince(a.StateVector())
+	deliver(t, b, toB)
+	deliver(t, a, toA)
+
+	if a.Text() != b.Text() {
+		t.Fatalf("a has %q, b has %q", a.Text(), b.Text())
+	}
+	if want := "aYX"; a.Text() != want {
+		t.Errorf("Text() = %q, want %q", a.Text(), want)
+	}
+	if !reflect.DeepEqual(a.StateVector(), b.StateVector()) {
+		t.Errorf("a has state vector %v, b has %v", a.StateVector(), b.StateVector())
+	}
+
+	// Both are up to date, and redelivery changes nothing
+	if ops := a.OperationsSince(b.StateVector()); len(ops) != 0 {
+		t.Errorf("OperationsSince() = %v, want none", ops)
+	}
+	for _, op := range toB {
+		if applied, err := b.Apply(op); err != nil || applied {
+			t.Errorf("redelivered Apply(%v) = %v, %v, want false, nil", op, applied, err)
+		}
+	}
+}
+
+func TestCRDTInvalidOperations(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation CRDTOperation
+		want      error
+	}{
+		{
+			name:      "unknown origin",
+			operation: crdtInsert("a", 5, CharID{ClientID: "b", Clock: 1}, "x"),
+			want:      ErrMissingDependency,
+		},
+		{
+			name:      "unknown target",
+			operation: crdtDelete("a", 5, CharID{ClientID: "b", Clock: 1}),
+			want:      ErrMissingDependency,
+		},
+		{
+			name:      "not newer than its origin",
+			operation: crdtInsert("a", 1, CharID{ClientID: "x", Clock: 1}, "x"),
+			want:      ErrInvalidOperation,
+		},
+		{
+			name:      "empty insert",
+			operation: crdtInsert("a", 5, CharID{}, ""),
+			want:      ErrInvalidOperation,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := SeedCRDTDocument("x", "x")
+			if _, err := doc.Apply(tt.operation); !errors.Is(err, tt.want) {
+				t.Errorf("Apply() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCRDTDocumentRoundTrip(t *testing.T) {
+	doc := SeedCRDTDocument("seed:1", "hello")
+	deliver(t, doc, []CRDTOperation{
+		crdtInsert("a", 6, CharID{ClientID: "seed:1", Clock: 5}, "!"),
+		crdtDelete("a", 7, CharID{ClientID: "seed:1", Clock: 1}),
+	})
+
+	data, err := doc.MarshalJSON()
+	if err != nil {
+		t.Fatalf("MarshalJSON() error = %v", err)
+	}
+	loaded, err := LoadCRDTDocument(data)
+	if err != nil {
+		t.Fatalf("LoadCRDTDocument() error = %v", err)
+	}
+
+	if loaded.Text() != "ello!" {
+		t.Errorf("Text() = %q, want %q", loaded.Text(), "ello!")
+	}
+	if !reflect.DeepEqual(loaded.StateVector(), doc.StateVector()) {
+		t.Errorf("StateVector() = %v, want %v", loaded.StateVector(), doc.StateVector())
+	}
+	if !reflect.DeepEqual(loaded.OperationsSince(nil), doc.OperationsSince(nil)) {
+		t.Errorf("OperationsSince() differs after loading")
+	}
+}
+
+// deliver applies operations the way a replica receives them: an operation
+// whose dependencies have not arrived yet is held back until they have.
+func deliver(t *testing.T, doc *CRDTDocument, operations []CRDTOperation) {
+	t.Helper()
+	pending := operations
+	for len(pending) > 0 {
+		var held []CRDTOperation
+		for _, op := range pending {
+			if _, err := doc.Apply(op); errors.Is(err, ErrMissingDependency) {
+				held = append(held, op)
+			} else if err != nil {
+				t.Fatalf("Apply(%v) error = %v", op, err)
+			}
+		}
+		if len(held) == len(pending) {
+			t.Fatalf("operations %v depend on operations never delivered", held)
+		}
+		pending = held
+	}
+}
+
+// permute calls f with every permutation of 0..n-1.
+func permute(n int, f func([]int)) {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	var generate func(k int)
+	generate = func(k int) {
+		if k == n {
+			f(order)
+			return
+		}
+		for i := k; i < n; i++ {
+			order[k], order[i] = order[i], order[k]
+			generate(k + 1)
+			order[k], order[i] = order[i], order[k]
+		}
+	}
+	generate(0)
+}
@@ -2,26 +2,43 @@ package collaboration
 
 import (
 	"context"
+	"errors"
 	"github.com/HardMax71/syncwrite/backend/pkg/document"
+	"io"
+	"strconv"
 	"time"
 
 	"github.com/HardMax71/syncwrite/backend/pkg/auth"
 	"github.com/HardMax71/syncwrite/backend/pkg/proto/collaboration/v1"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+// resyncVersionTrailer names the trailer carrying the version a client has to
+// resync from when its change stream cannot be resumed.
+const resyncVersionTrailer = "resync-version"
+
+// leaveTimeout bounds leaving the session once a Collaborate stream ended.
+const leaveTimeout = 5 * time.Second
+
+// defaultReplayMaxGap bounds the pause between two changes played back by
+// ReplayHistory, unless the request sets its own.
+const defaultReplayMaxGap = 2 * time.Second
+
 type Handler struct {
 	collaborationv1.UnimplementedCollaborationServiceServer
 	service         *Service
 	documentService *document.Service
+	brokerAuth      *BrokerAuth
 }
 
-func NewHandler(service *Service, documentService *document.Service) *Handler {
+func NewHandler(service *Service, documentService *document.Service, brokerAuth *BrokerAuth) *Handler {
 	return &Handler{
 		service:         service,
 		documentService: documentService,
+		brokerAuth:      brokerAuth,
 	}
 }
 
@@ -32,36 +49,40 @@ func (h *Handler) JoinSession(ctx context.Context, req *collaborationv1.JoinSess
 	}
 
 	// Verify document access
-	if _, err := h.documentService.GetDocument(ctx, req.DocumentId, user.ID); err != nil {
+	doc, err := h.documentService.GetDocument(ctx, req.DocumentId, user.ID)
+	if err != nil {
 		return nil, status.Error(codes.PermissionDenied, "permission denied")
 	}
 
+	credentials, err := h.brokerCredentials(ctx, req.DocumentId, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
 	activeUser := &ActiveUser{
-		UserID:         user.ID,
-		Username:       user.Username,
-		CursorPosition: "",
-		LastActive:     time.Now(),
+		ConnectionID: NewConnectionID(),
+		UserID:       user.ID,
+		Username:     user.Username,
+		Presence:     Presence{Version: doc.Version},
+		LastActive:   time.Now(),
 	}
 
-	activeUsers, err := h.service.JoinSession(req.DocumentId, activeUser)
+	activeUsers, err := h.service.JoinSession(ctx, req.DocumentId, activeUser)
 	if err != nil {
 		return nil, status.Error(codes.Internal, "error joining session")
 	}
 
 	protoUsers := make([]*collaborationv1.ActiveUser, len(activeUsers))
 	for i, u := range activeUsers {
-		protoUsers[i] = &collaborationv1.ActiveUser{
-			UserId:         u.UserID,
-			Username:       u.Username,
-			CursorPosition: u.CursorPosition,
-			LastActive:     timestamppb.New(u.LastActive),
-		}
+		protoUsers[i] = convertActiveUserToProto(u)
 	}
 
 	return &collaborationv1.JoinSessionResponse{
-		SessionId:   req.DocumentId,
-		ActiveUsers: protoUsers,
-		MqttTopic:   GetDocumentTopic(req.DocumentId),
+		SessionId:         req.DocumentId,
+		ActiveUsers:       protoUsers,
+		MqttTopic:         GetDocumentTopic(req.DocumentId),
+		ConnectionId:      activeUser.ConnectionID,
+		BrokerCredentials: credentials,
 	}, nil
 }
 
@@ -71,8 +92,11 @@ func (h *Handler) LeaveSession(ctx context.Context, req *collaborationv1.LeaveSe
 		return nil, err
 	}
 
-	err = h.service.LeaveSession(req.DocumentId, user.ID)
+	err = h.service.LeaveSession(ctx, req.DocumentId, user.ID, req.ConnectionId)
 	if err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			return nil, status.Error(codes.NotFound, "connection not found")
+		}
 		return nil, status.Error(codes.Internal, "error leaving session")
 	}
 
@@ -82,19 +106,14 @@ func (h *Handler) LeaveSession(ctx context.Context, req *collaborationv1.LeaveSe
 }
 
 func (h *Handler) GetActiveUsers(ctx context.Context, req *collaborationv1.GetActiveUsersRequest) (*collaborationv1.GetActiveUsersResponse, error) {
-	users, err := h.service.GetActiveUsers(req.DocumentId)
+	users, err := h.service.GetActiveUsers(ctx, req.DocumentId)
 	if err != nil {
 		return nil, status.Error(codes.Internal, "error getting active users")
 	}
 
 	protoUsers := make([]*collaborationv1.ActiveUser, len(users))
 	for i, u := range users {
-		protoUsers[i] = &collaborationv1.ActiveUser{
-			UserId:         u.UserID,
-			Username:       u.Username,
-			CursorPosition: u.CursorPosition,
-			LastActive:     timestamppb.New(u.LastActive),
-		}
+		protoUsers[i] = convertActiveUserToProto(u)
 	}
 
 	return &collaborationv1.GetActiveUsersResponse{
@@ -108,39 +127,62 @@ func (h *Handler) StreamChanges(req *collaborationv1.StreamChangesRequest, strea
 		return err
 	}
 
-	changes, cleanup, err := h.service.StreamChanges(req.DocumentId, user.ID)
+	// Subscribe before reading the current version so no change falls between
+	// the two
+	subscription, cleanup, err := h.service.StreamChanges(req.DocumentId, user.ID, NewConnectionID())
 	if err != nil {
 		return status.Error(codes.Internal, "error setting up change stream")
 	}
 	defer cleanup()
 
+	// Verify document access
+	doc, err := h.documentService.GetDocument(stream.Context(), req.DocumentId, user.ID)
+	if err != nil {
+		return status.Error(codes.PermissionDenied, "permission denied")
+	}
+
+	lastVersion := doc.Version
+	if req.FromVersion > 0 {
+		if lastVersion, err = h.sendChangesSince(stream, req.DocumentId, req.FromVersion); err != nil {
+			return err
+		}
+	}
+
 	for {
 		select {
-		case change, ok := <-changes:
+		case change, ok := <-subscription.Changes():
 			if !ok {
 				return status.Error(codes.Canceled, "change stream closed")
 			}
 
-			protoChange := &collaborationv1.DocumentChange{
-				DocumentId: change.DocumentID,
-				UserId:     change.UserID,
-				Version:    change.Version,
-				Timestamp:  timestamppb.New(change.Timestamp),
-				Operations: make([]*collaborationv1.Operation, len(change.Operations)),
+			// Skip changes already sent during catch-up
+			if change.Version <= lastVersion {
+				continue
 			}
 
-			for i, op := range change.Operations {
-				protoChange.Operations[i] = &collaborationv1.Operation{
-					Type:     convertOperationTypeToProto(op.Type),
-					Position: op.Position,
-					Content:  op.Content,
-					Length:   op.Length,
+			// Dropped live changes are refilled from history
+			if change.Version > lastVersion+1 {
+				if lastVersion, err = h.sendChangesSince(stream, req.DocumentId, lastVersion); err != nil {
+					return err
+				}
+				if change.Version <= lastVersion {
+					continue
 				}
 			}
 
+			protoChange := convertDocumentChangeToProto(change)
+
 			if err := stream.Send(protoChange); err != nil {
 				return status.Error(codes.Internal, "error sending change")
 			}
+			lastVersion = change.Version
+
+		case <-subscription.Lagged():
+			// The client fell behind; send what it missed from history
+			subscription.Resume()
+			if lastVersion, err = h.sendChangesSince(stream, req.DocumentId, lastVersion); err != nil {
+				return err
+			}
 
 		case <-stream.Context().Done():
 			return status.Error(codes.Canceled, "stream context canceled")
@@ -148,69 +190,853 @@ func (h *Handler) StreamChanges(req *collaborationv1.StreamChangesRequest, strea
 	}
 }
 
-func (h *Handler) SyncDocument(ctx context.Context, req *collaborationv1.SyncDocumentRequest) (*collaborationv1.SyncDocumentResponse, error) {
+// ReplayHistory streams the state of a document at a version followed by the
+// changes made since, paced by when they were originally made.
+func (h *Handler) ReplayHistory(req *collaborationv1.ReplayHistoryRequest, stream collaborationv1.CollaborationService_ReplayHistoryServer) error {
+	ctx := stream.Context()
 	user, err := auth.GetUserFromContext(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Verify document access
 	if _, err := h.documentService.GetDocument(ctx, req.DocumentId, user.ID); err != nil {
-		return nil, status.Error(codes.PermissionDenied, "permission denied")
+		return status.Error(codes.PermissionDenied, "permission denied")
 	}
 
-	operations := make([]Operation, len(req.Operations))
-	for i, op := range req.Operations {
-		operations[i] = Operation{
-			Type:     convertOperationTypeFromProto(op.Type),
-			Position: op.Position,
-			Content:  op.Content,
-			Length:   op.Length,
+	if req.Speed < 0 || req.MaxGapMs < 0 {
+		return status.Error(codes.InvalidArgument, "speed and max gap must not be negative")
+	}
+	maxGap := defaultReplayMaxGap
+	if req.MaxGapMs > 0 {
+		maxGap = time.Duration(req.MaxGapMs) * time.Millisecond
+	}
+
+	state, toVersion, err := h.service.Replay(ctx, req.DocumentId, req.FromVersion, req.ToVersion)
+	if err != nil {
+		return replayHistoryError(err)
+	}
+
+	if err := sendReplayState(stream, state); err != nil {
+		return err
+	}
+
+	// Read the changes a batch at a time, so a long history is never held in
+	// memory at once
+	var previous *DocumentChange
+	for version := state.Version; version < toVersion; {
+		changes, restart, err := h.service.ReplayChanges(ctx, req.DocumentId, version, toVersion)
+		if err != nil {
+			return replayHistoryError(err)
+		}
+
+		for _, change := range changes {
+			if previous != nil {
+				delay := ReplayDelay(previous.Timestamp, change.Timestamp, req.Speed, maxGap)
+				if delay > 0 {
+					timer := time.NewTimer(delay)
+					select {
+					case <-timer.C:
+					case <-ctx.Done():
+						timer.Stop()
+						return status.Error(codes.Canceled, "stream context canceled")
+					}
+				}
+			}
+
+			err := stream.Send(&collaborationv1.ReplayHistoryResponse{
+				Payload: &collaborationv1.ReplayHistoryResponse_Change{
+					Change: convertDocumentChangeToProto(change),
+				},
+			})
+			if err != nil {
+				return status.Error(codes.Internal, "error sending change")
+			}
+			previous = change
+			version = change.Version
+		}
+
+		// The document was replaced outright at a version that has no change
+		// to play back; the client starts over from its state
+		if restart != nil {
+			if err := sendReplayState(stream, restart); err != nil {
+				return err
+			}
+			version = restart.Version
 		}
 	}
 
-	newVersion, concurrentChanges, err := h.service.SyncDocument(ctx, req.DocumentId, operations, req.BaseVersion)
+	return nil
+}
+
+func sendReplayState(stream collaborationv1.CollaborationService_ReplayHistoryServer, state *DocumentState) error {
+	err := stream.Send(&collaborationv1.ReplayHistoryResponse{
+		Payload: &collaborationv1.ReplayHistoryResponse_State{
+			State: &collaborationv1.ReplayState{
+				Version:   state.Version,
+				Content:   state.Content,
+				CrdtState: state.CRDTState,
+				YjsState:  state.YjsState,
+			},
+		},
+	})
 	if err != nil {
-		switch err {
-		case document.ErrVersionMismatch:
-			return nil, status.Error(codes.FailedPrecondition, "version mismatch")
-		default:
-			return nil, status.Error(codes.Internal, "error syncing document")
+		return status.Error(codes.Internal, "error sending state")
+	}
+	return nil
+}
+
+// sendChangesSince sends the persisted changes after fromVersion and returns
+// the version of the last change sent. When the history no longer covers them
+// the client has to resync, and the resync-version trailer tells it from
+// which version.
+func (h *Handler) sendChangesSince(stream collaborationv1.CollaborationService_StreamChangesServer, documentID string, fromVersion int64) (int64, error) {
+	changes, err := h.service.ChangesSince(stream.Context(), documentID, fromVersion)
+	if err != nil {
+		if errors.Is(err, ErrHistoryUnavailable) {
+			stream.SetTrailer(metadata.Pairs(resyncVersionTrailer, strconv.FormatInt(fromVersion, 10)))
+		}
+		return 0, changesSinceError(err)
+	}
+
+	lastVersion := fromVersion
+	for _, change := range changes {
+		if err := stream.Send(convertDocumentChangeToProto(change)); err != nil {
+			return 0, status.Error(codes.Internal, "error sending change")
 		}
+		lastVersion = change.Version
+	}
+	return lastVersion, nil
+}
+
+func (h *Handler) SyncDocument(ctx context.Context, req *collaborationv1.SyncDocumentRequest) (*collaborationv1.SyncDocumentResponse, error) {
+	user, err := auth.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.checkEditPermission(ctx, req.DocumentId, user.ID); err != nil {
+		return nil, err
+	}
+
+	operations := convertOperationsFromProto(req.Operations)
+
+	change, concurrentChanges, err := h.service.SyncDocument(ctx, req.DocumentId, user.ID, operations, req.BaseVersion)
+	if err != nil {
+		return nil, syncDocumentError(err)
 	}
 
 	var protoConcurrentChanges []*collaborationv1.DocumentChange
 	if concurrentChanges != nil {
 		protoConcurrentChanges = make([]*collaborationv1.DocumentChange, len(concurrentChanges))
-		for i, change := range concurrentChanges {
-			protoOps := make([]*collaborationv1.Operation, len(change.Operations))
-			for j, op := range change.Operations {
-				protoOps[j] = &collaborationv1.Operation{
-					Type:     convertOperationTypeToProto(op.Type),
-					Position: op.Position,
-					Content:  op.Content,
-					Length:   op.Length,
-				}
-			}
-
-			protoConcurrentChanges[i] = &collaborationv1.DocumentChange{
-				DocumentId: change.DocumentID,
-				UserId:     change.UserID,
-				Version:    change.Version,
-				Operations: protoOps,
-				Timestamp:  timestamppb.New(change.Timestamp),
-			}
+		for i, concurrentChange := range concurrentChanges {
+			protoConcurrentChanges[i] = convertDocumentChangeToProto(concurrentChange)
 		}
 	}
 
 	return &collaborationv1.SyncDocumentResponse{
 		Success:           true,
-		NewVersion:        newVersion,
+		NewVersion:        change.Version,
 		ConcurrentChanges: protoConcurrentChanges,
+		Operations:        convertOperationsToProto(change.Operations),
+	}, nil
+}
+
+func (h *Handler) MergeOperations(ctx context.Context, req *collaborationv1.MergeOperationsRequest) (*collaborationv1.MergeOperationsResponse, error) {
+	user, err := auth.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.checkEditPermission(ctx, req.DocumentId, user.ID); err != nil {
+		return nil, err
+	}
+
+	operations := make([]CRDTOperation, len(req.Operations))
+	for i, op := range req.Operations {
+		operations[i] = convertCRDTOperationFromProto(op)
+	}
+
+	missing, stateVector, err := h.service.MergeOperations(ctx, req.DocumentId, user.ID, operations, req.StateVector)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidOperation):
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		case errors.Is(err, ErrMissingDependency):
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		case errors.Is(err, ErrSyncModeMismatch):
+			return nil, status.Error(codes.FailedPrecondition, "document does not use CRDT sync mode")
+		default:
+			return nil, status.Error(codes.Internal, "error merging operations")
+		}
+	}
+
+	return &collaborationv1.MergeOperationsResponse{
+		MissingOperations: convertCRDTOperationsToProto(missing),
+		StateVector:       stateVector,
 	}, nil
 }
 
+func (h *Handler) ApplyYjsUpdate(ctx context.Context, req *collaborationv1.ApplyYjsUpdateRequest) (*collaborationv1.ApplyYjsUpdateResponse, error) {
+	user, err := auth.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.checkEditPermission(ctx, req.DocumentId, user.ID); err != nil {
+		return nil, err
+	}
+
+	version, err := h.service.ApplyYjsUpdate(ctx, req.DocumentId, user.ID, req.Update)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidYjsUpdate):
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		case errors.Is(err, ErrSyncModeMismatch):
+			return nil, status.Error(codes.FailedPrecondition, "document does not use Yjs sync mode")
+		default:
+			return nil, status.Error(codes.Internal, "error applying update")
+		}
+	}
+
+	return &collaborationv1.ApplyYjsUpdateResponse{
+		Version: version,
+	}, nil
+}
+
+func (h *Handler) SyncYjs(ctx context.Context, req *collaborationv1.SyncYjsRequest) (*collaborationv1.SyncYjsResponse, error) {
+	user, err := auth.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify document access
+	if _, err := h.documentService.GetDocument(ctx, req.DocumentId, user.ID); err != nil {
+		return nil, status.Error(codes.PermissionDenied, "permission denied")
+	}
+
+	update, stateVector, err := h.service.SyncYjs(ctx, req.DocumentId, req.StateVector)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidYjsUpdate):
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		case errors.Is(err, ErrSyncModeMismatch):
+			return nil, status.Error(codes.FailedPrecondition, "document does not use Yjs sync mode")
+		default:
+			return nil, status.Error(codes.Internal, "error syncing document")
+		}
+	}
+
+	return &collaborationv1.SyncYjsResponse{
+		Update:      update,
+		StateVector: stateVector,
+	}, nil
+}
+
+// Heartbeat keeps a connection returned by JoinSession active. Connections
+// without heartbeats are evicted from the session after the presence timeout.
+func (h *Handler) Heartbeat(ctx context.Context, req *collaborationv1.HeartbeatRequest) (*collaborationv1.HeartbeatResponse, error) {
+	user, err := auth.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.service.Heartbeat(ctx, req.DocumentId, user.ID, req.ConnectionId); err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			return nil, status.Error(codes.NotFound, "connection not found")
+		}
+		return nil, status.Error(codes.Internal, "error recording heartbeat")
+	}
+
+	return &collaborationv1.HeartbeatResponse{}, nil
+}
+
+func (h *Handler) UpdatePresence(ctx context.Context, req *collaborationv1.UpdatePresenceRequest) (*collaborationv1.UpdatePresenceResponse, error) {
+	user, err := auth.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	presence, err := h.service.UpdatePresence(ctx, req.DocumentId, user.ID, req.ConnectionId, convertPresenceFromProto(req.Presence))
+	if err != nil {
+		return nil, updatePresenceError(err)
+	}
+
+	return &collaborationv1.UpdatePresenceResponse{
+		Presence: convertPresenceToProto(presence),
+	}, nil
+}
+
+// GetBrokerCredentials renews the broker credentials returned by
+// JoinSession.
+func (h *Handler) GetBrokerCredentials(ctx context.Context, req *collaborationv1.GetBrokerCredentialsRequest) (*collaborationv1.GetBrokerCredentialsResponse, error) {
+	user, err := auth.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := h.brokerCredentials(ctx, req.DocumentId, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &collaborationv1.GetBrokerCredentialsResponse{
+		Credentials: credentials,
+	}, nil
+}
+
+// brokerCredentials mints broker credentials for a member of a document.
+func (h *Handler) brokerCredentials(ctx context.Context, documentID, userID string) (*collaborationv1.BrokerCredentials, error) {
+	if _, err := h.documentService.GetPermissionLevel(ctx, documentID, userID); err != nil {
+		return nil, status.Error(codes.PermissionDenied, "permission denied")
+	}
+
+	credentials, err := h.brokerAuth.Credentials(userID, documentID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "error issuing broker credentials")
+	}
+
+	return convertBrokerCredentialsToProto(credentials), nil
+}
+
+// checkEditPermission checks that a user may edit a document, not only read
+// it.
+func (h *Handler) checkEditPermission(ctx context.Context, documentID, userID string) error {
+	if err := h.documentService.CheckEditPermission(ctx, documentID, userID); err != nil {
+		return status.Error(codes.PermissionDenied, "permission denied")
+	}
+	return nil
+}
+
+// GetStreamStats reports how far behind the change streams of a document are.
+func (h *Handler) GetStreamStats(ctx context.Context, req *collaborationv1.GetStreamStatsRequest) (*collaborationv1.GetStreamStatsResponse, error) {
+	user, err := auth.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify document access
+	if _, err := h.documentService.GetDocument(ctx, req.DocumentId, user.ID); err != nil {
+		return nil, status.Error(codes.PermissionDenied, "permission denied")
+	}
+
+	stats := h.service.StreamStats(req.DocumentId)
+	protoStats := make([]*collaborationv1.StreamStats, len(stats))
+	for i, st := range stats {
+		protoStats[i] = &collaborationv1.StreamStats{
+			UserId:       st.UserID,
+			ConnectionId: st.ConnectionID,
+			Queued:       int32(st.Queued),
+			Capacity:     int32(st.Capacity),
+			Lagging:      st.Lagging,
+			BehindAt:     st.BehindAt,
+			Dropped:      st.Dropped,
+			Lags:         st.Lags,
+		}
+	}
+
+	return &collaborationv1.GetStreamStatsResponse{
+		Streams: protoStats,
+	}, nil
+}
+
+// GetBlame returns who last edited each part of the current text of a
+// document.
+func (h *Handler) GetBlame(ctx context.Context, req *collaborationv1.GetBlameRequest) (*collaborationv1.GetBlameResponse, error) {
+	user, err := auth.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify document access
+	if _, err := h.documentService.GetDocument(ctx, req.DocumentId, user.ID); err != nil {
+		return nil, status.Error(codes.PermissionDenied, "permission denied")
+	}
+
+	version, ranges, err := h.service.Blame(ctx, req.DocumentId)
+	if err != nil {
+		switch {
+		case errors.Is(err, document.ErrDocumentNotFound):
+			return nil, status.Error(codes.NotFound, "document not found")
+		case errors.Is(err, document.ErrYjsDocument):
+			return nil, status.Error(codes.FailedPrecondition, "documents in Yjs sync mode have no blame")
+		default:
+			return nil, status.Error(codes.Internal, "error getting blame")
+		}
+	}
+
+	protoRanges := make([]*collaborationv1.BlameRange, len(ranges))
+	for i, r := range ranges {
+		protoRanges[i] = convertBlameRangeToProto(r)
+	}
+
+	return &collaborationv1.GetBlameResponse{
+		Version: version,
+		Ranges:  protoRanges,
+	}, nil
+}
+
+// Collaborate carries edits, their acknowledgements, remote changes and
+// presence for one document over a single stream. Every server message is sent
+// from this goroutine, so changes and edit acknowledgements reach the client in
+// version order.
+func (h *Handler) Collaborate(stream collaborationv1.CollaborationService_CollaborateServer) error {
+	ctx := stream.Context()
+	user, err := auth.GetUserFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	join := req.GetJoin()
+	if join == nil {
+		return status.Error(codes.InvalidArgument, "first message must be a join")
+	}
+
+	// Subscribe before reading the current version so no change falls between
+	// the two
+	connectionID := NewConnectionID()
+	subscription, cleanupChanges, err := h.service.StreamChanges(join.DocumentId, user.ID, connectionID)
+	if err != nil {
+		return status.Error(codes.Internal, "error setting up change stream")
+	}
+	defer cleanupChanges()
+
+	presence, cleanupPresence, err := h.service.StreamPresence(join.DocumentId, connectionID)
+	if err != nil {
+		return status.Error(codes.Internal, "error setting up presence stream")
+	}
+	defer cleanupPresence()
+
+	// Verify document access
+	doc, err := h.documentService.GetDocument(ctx, join.DocumentId, user.ID)
+	if err != nil {
+		return status.Error(codes.PermissionDenied, "permission denied")
+	}
+	// Viewers follow the document, but their edits are rejected
+	canEdit := h.documentService.CheckEditPermission(ctx, join.DocumentId, user.ID) == nil
+
+	activeUser := &ActiveUser{
+		ConnectionID: connectionID,
+		UserID:       user.ID,
+		Username:     user.Username,
+		Presence:     Presence{Version: doc.Version},
+		LastActive:   time.Now(),
+	}
+	if _, err := h.service.JoinSession(ctx, join.DocumentId, activeUser); err != nil {
+		return status.Error(codes.Internal, "error joining session")
+	}
+	defer func() {
+		// The stream context is done by now; leave with a fresh one
+		ctx, cancel := context.WithTimeout(context.Background(), leaveTimeout)
+		defer cancel()
+		h.service.LeaveSession(ctx, join.DocumentId, user.ID, connectionID)
+	}()
+
+	c := &collaborateStream{
+		stream:       stream,
+		service:      h.service,
+		documentID:   join.DocumentId,
+		userID:       user.ID,
+		connectionID: connectionID,
+		canEdit:      canEdit,
+		lastVersion:  doc.Version,
+		pendingAcks:  make(map[int64]uint64),
+	}
+	if join.FromVersion > 0 {
+		c.lastVersion = join.FromVersion
+	}
+
+	// Replay what the client is missing, including changes committed before
+	// the session subscribed to the document topic
+	if err := c.catchUp(); err != nil {
+		return err
+	}
+	if err := c.send(&collaborationv1.CollaborateResponse{
+		Payload: &collaborationv1.CollaborateResponse_Ack{
+			Ack: &collaborationv1.CollaborateAck{
+				ClientSeq:    req.ClientSeq,
+				Version:      c.lastVersion,
+				ConnectionId: connectionID,
+			},
+		},
+	}); err != nil {
+		return err
+	}
+
+	requests := make(chan *collaborationv1.CollaborateRequest)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case requests <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case req := <-requests:
+			if err := c.handleRequest(req); err != nil {
+				return err
+			}
+
+		case <-subscription.Lagged():
+			// The client fell behind; send what it missed from history
+			subscription.Resume()
+			if err := c.catchUp(); err != nil {
+				return err
+			}
+
+		case err := <-recvErr:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+
+		case change, ok := <-subscription.Changes():
+			if !ok {
+				return status.Error(codes.Canceled, "change stream closed")
+			}
+			if err := c.receiveChange(change); err != nil {
+				return err
+			}
+
+		case event, ok := <-presence:
+			if !ok {
+				// The connection left the session, e.g. after missing heartbeats
+				return status.Error(codes.Aborted, "connection is no longer part of the session")
+			}
+			if event.ConnectionID == connectionID {
+				continue
+			}
+			if err := c.send(&collaborationv1.CollaborateResponse{
+				Payload: &collaborationv1.CollaborateResponse_Presence{
+					Presence: convertPresenceEventToProto(event),
+				},
+			}); err != nil {
+				return err
+			}
+
+		case <-ctx.Done():
+			return status.Error(codes.Canceled, "stream context canceled")
+		}
+	}
+}
+
+// collaborateStream is the server side state of a Collaborate stream.
+type collaborateStream struct {
+	stream       collaborationv1.CollaborationService_CollaborateServer
+	service      *Service
+	documentID   string
+	userID       string
+	connectionID string
+	// canEdit is whether the user may edit the document, checked when the
+	// stream opened.
+	canEdit bool
+	seq     uint64
+	// lastVersion is the version of the last change or acknowledgement sent.
+	lastVersion int64
+	// pendingAcks maps versions committed by this client's edits, but not yet
+	// reached by the stream, to the client_seq of the edit.
+	pendingAcks map[int64]uint64
+}
+
+func (c *collaborateStream) send(resp *collaborationv1.CollaborateResponse) error {
+	c.seq++
+	resp.Seq = c.seq
+	if err := c.stream.Send(resp); err != nil {
+		return status.Error(codes.Internal, "error sending message")
+	}
+	return nil
+}
+
+func (c *collaborateStream) ack(clientSeq uint64, err error) error {
+	st := status.Convert(err)
+	return c.send(&collaborationv1.CollaborateResponse{
+		Payload: &collaborationv1.CollaborateResponse_Ack{
+			Ack: &collaborationv1.CollaborateAck{
+				ClientSeq:    clientSeq,
+				ErrorCode:    int32(st.Code()),
+				ErrorMessage: st.Message(),
+			},
+		},
+	})
+}
+
+func (c *collaborateStream) handleRequest(req *collaborationv1.CollaborateRequest) error {
+	ctx := c.stream.Context()
+
+	switch payload := req.Payload.(type) {
+	case *collaborationv1.CollaborateRequest_Edit:
+		if !c.canEdit {
+			return c.ack(req.ClientSeq, status.Error(codes.PermissionDenied, "permission denied"))
+		}
+		operations := convertOperationsFromProto(payload.Edit.Operations)
+		change, _, err := c.service.SyncDocument(ctx, c.documentID, c.userID, operations, payload.Edit.BaseVersion)
+		if err != nil {
+			return c.ack(req.ClientSeq, syncDocumentError(err))
+		}
+
+		// The concurrent changes are delivered on the stream ahead of the
+		// acknowledgement, so only the committed version has to be tracked
+		c.pendingAcks[change.Version] = req.ClientSeq
+		return c.catchUp()
+
+	case *collaborationv1.CollaborateRequest_Presence:
+		presence := convertPresenceFromProto(payload.Presence)
+		if _, err := c.service.UpdatePresence(ctx, c.documentID, c.userID, c.connectionID, presence); err != nil {
+			return c.ack(req.ClientSeq, updatePresenceError(err))
+		}
+		return c.ack(req.ClientSeq, nil)
+
+	case *collaborationv1.CollaborateRequest_Heartbeat:
+		if err := c.service.Heartbeat(ctx, c.documentID, c.userID, c.connectionID); err != nil {
+			if errors.Is(err, ErrSessionNotFound) {
+				return c.ack(req.ClientSeq, status.Error(codes.NotFound, "connection not found"))
+			}
+			return c.ack(req.ClientSeq, status.Error(codes.Internal, "error recording heartbeat"))
+		}
+		return c.ack(req.ClientSeq, nil)
+
+	case *collaborationv1.CollaborateRequest_Join:
+		return c.ack(req.ClientSeq, status.Error(codes.FailedPrecondition, "already joined"))
+
+	default:
+		return c.ack(req.ClientSeq, status.Error(codes.InvalidArgument, "empty message"))
+	}
+}
+
+// receiveChange sends a live change, refilling from history any change the
+// stream skipped.
+func (c *collaborateStream) receiveChange(change *DocumentChange) error {
+	if change.Version <= c.lastVersion {
+		return nil
+	}
+	if change.Version > c.lastVersion+1 {
+		return c.catchUp()
+	}
+	return c.deliver(change)
+}
+
+// catchUp sends every change committed after lastVersion. When the history no
+// longer covers them, the client is told to resync before the stream ends.
+func (c *collaborateStream) catchUp() error {
+	changes, err := c.service.ChangesSince(c.stream.Context(), c.documentID, c.lastVersion)
+	if err != nil {
+		if errors.Is(err, ErrHistoryUnavailable) {
+			if err := c.send(&collaborationv1.CollaborateResponse{
+				Payload: &collaborationv1.CollaborateResponse_Resync{
+					Resync: &collaborationv1.CollaborateResync{Version: c.lastVersion},
+				},
+			}); err != nil {
+				return err
+			}
+		}
+		return changesSinceError(err)
+	}
+
+	for _, change := range changes {
+		if err := c.deliver(change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver sends change, or the acknowledgement of the edit that committed it.
+func (c *collaborateStream) deliver(change *DocumentChange) error {
+	resp := &collaborationv1.CollaborateResponse{}
+	if clientSeq, ok := c.pendingAcks[change.Version]; ok {
+		delete(c.pendingAcks, change.Version)
+		resp.Payload = &collaborationv1.CollaborateResponse_Ack{
+			Ack: &collaborationv1.CollaborateAck{
+				ClientSeq:  clientSeq,
+				Version:    change.Version,
+				Operations: convertOperationsToProto(change.Operations),
+			},
+		}
+	} else {
+		resp.Payload = &collaborationv1.CollaborateResponse_Change{
+			Change: convertDocumentChangeToProto(change),
+		}
+	}
+
+	if err := c.send(resp); err != nil {
+		return err
+	}
+	c.lastVersion = change.Version
+	return nil
+}
+
+func syncDocumentError(err error) error {
+	switch {
+	case errors.Is(err, ErrInvalidOperation):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrSyncModeMismatch):
+		return status.Error(codes.FailedPrecondition, "document does not use operational transformation")
+	case errors.Is(err, document.ErrVersionMismatch):
+		return status.Error(codes.FailedPrecondition, "version mismatch")
+	case errors.Is(err, ErrHistoryUnavailable):
+		return status.Error(codes.OutOfRange, err.Error())
+	default:
+		return status.Error(codes.Internal, "error syncing document")
+	}
+}
+
+func updatePresenceError(err error) error {
+	switch {
+	case errors.Is(err, ErrSessionNotFound):
+		return status.Error(codes.NotFound, "connection not found")
+	case errors.Is(err, document.ErrVersionMismatch):
+		return status.Error(codes.InvalidArgument, "version is ahead of the document")
+	default:
+		return status.Error(codes.Internal, "error updating presence")
+	}
+}
+
+func changesSinceError(err error) error {
+	switch {
+	case errors.Is(err, ErrHistoryUnavailable):
+		return status.Error(codes.OutOfRange, err.Error())
+	case errors.Is(err, document.ErrVersionMismatch):
+		return status.Error(codes.InvalidArgument, "version is ahead of the document")
+	default:
+		return status.Error(codes.Internal, "error loading change history")
+	}
+}
+
+func replayHistoryError(err error) error {
+	switch {
+	case errors.Is(err, ErrInvalidVersionRange):
+		return status.Error(codes.InvalidArgument, "from version is after to version")
+	case errors.Is(err, document.ErrDocumentNotFound):
+		return status.Error(codes.NotFound, "document not found")
+	default:
+		return changesSinceError(err)
+	}
+}
+
 // Helper functions for converting between domain and proto types
+func convertBrokerCredentialsToProto(credentials *BrokerCredentials) *collaborationv1.BrokerCredentials {
+	return &collaborationv1.BrokerCredentials{
+		Username:    credentials.Username,
+		Password:    credentials.Password,
+		ExpiresAt:   timestamppb.New(credentials.ExpiresAt),
+		ReadTopics:  credentials.Read,
+		WriteTopics: credentials.Write,
+	}
+}
+
+func convertBlameRangeToProto(r *BlameRange) *collaborationv1.BlameRange {
+	blame := &collaborationv1.BlameRange{
+		Start:    int32(r.Start),
+		Length:   int32(r.Length),
+		UserId:   r.UserID,
+		Username: r.Username,
+	}
+	if !r.EditedAt.IsZero() {
+		blame.EditedAt = timestamppb.New(r.EditedAt)
+	}
+	return blame
+}
+
+func convertActiveUserToProto(user *ActiveUser) *collaborationv1.ActiveUser {
+	return &collaborationv1.ActiveUser{
+		UserId:       user.UserID,
+		Username:     user.Username,
+		LastActive:   timestamppb.New(user.LastActive),
+		ConnectionId: user.ConnectionID,
+		Presence:     convertPresenceToProto(user.Presence),
+	}
+}
+
+func convertPresenceToProto(presence Presence) *collaborationv1.Presence {
+	selections := make([]*collaborationv1.Selection, len(presence.Selections))
+	for i, selection := range presence.Selections {
+		selections[i] = &collaborationv1.Selection{
+			Anchor: selection.Anchor,
+			Head:   selection.Head,
+		}
+	}
+
+	return &collaborationv1.Presence{
+		Selections: selections,
+		Color:      presence.Color,
+		IsTyping:   presence.IsTyping,
+		Version:    presence.Version,
+	}
+}
+
+func convertPresenceFromProto(presence *collaborationv1.Presence) Presence {
+	if presence == nil {
+		return Presence{}
+	}
+
+	selections := make([]Selection, len(presence.Selections))
+	for i, selection := range presence.Selections {
+		selections[i] = Selection{
+			Anchor: selection.Anchor,
+			Head:   selection.Head,
+		}
+	}
+
+	return Presence{
+		Selections: selections,
+		IsTyping:   presence.IsTyping,
+		Version:    presence.Version,
+	}
+}
+
+func convertDocumentChangeToProto(change *DocumentChange) *collaborationv1.DocumentChange {
+	return &collaborationv1.DocumentChange{
+		DocumentId:     change.DocumentID,
+		UserId:         change.UserID,
+		Version:        change.Version,
+		Operations:     convertOperationsToProto(change.Operations),
+		CrdtOperations: convertCRDTOperationsToProto(change.CRDTOperations),
+		YjsUpdate:      change.YjsUpdate,
+		Timestamp:      timestamppb.New(change.Timestamp),
+	}
+}
+
+func convertOperationsToProto(operations []Operation) []*collaborationv1.Operation {
+	protoOps := make([]*collaborationv1.Operation, len(operations))
+	for i, op := range operations {
+		protoOps[i] = &collaborationv1.Operation{
+			Type:     convertOperationTypeToProto(op.Type),
+			Position: op.Position,
+			Content:  op.Content,
+			Length:   op.Length,
+		}
+	}
+	return protoOps
+}
+
+func convertOperationsFromProto(operations []*collaborationv1.Operation) []Operation {
+	result := make([]Operation, len(operations))
+	for i, op := range operations {
+		result[i] = Operation{
+			Type:     convertOperationTypeFromProto(op.Type),
+			Position: op.Position,
+			Content:  op.Content,
+			Length:   op.Length,
+		}
+	}
+	return result
+}
+
 func convertOperationTypeToProto(t OperationType) collaborationv1.Operation_Type {
 	switch t {
 	case OperationTypeInsert:
@@ -236,3 +1062,94 @@ func convertOperationTypeFromProto(t collaborationv1.Operation_Type) OperationTy
 		return OperationTypeInsert
 	}
 }
+
+func convertCRDTOperationsToProto(operations []CRDTOperation) []*collaborationv1.CrdtOperation {
+	protoOps := make([]*collaborationv1.CrdtOperation, len(operations))
+	for i, op := range operations {
+		protoOps[i] = &collaborationv1.CrdtOperation{
+			Type:    convertCRDTOperationTypeToProto(op.Type),
+			Id:      convertCharIDToProto(op.ID),
+			Origin:  convertCharIDToProto(op.Origin),
+			Target:  convertCharIDToProto(op.Target),
+			Content: op.Content,
+		}
+	}
+	return protoOps
+}
+
+func convertCRDTOperationFromProto(op *collaborationv1.CrdtOperation) CRDTOperation {
+	return CRDTOperation{
+		Type:    convertCRDTOperationTypeFromProto(op.Type),
+		ID:      convertCharIDFromProto(op.Id),
+		Origin:  convertCharIDFromProto(op.Origin),
+		Target:  convertCharIDFromProto(op.Target),
+		Content: op.Content,
+	}
+}
+
+func convertCharIDToProto(id CharID) *collaborationv1.CharId {
+	if id.IsZero() {
+		return nil
+	}
+	return &collaborationv1.CharId{
+		ClientId: id.ClientID,
+		Clock:    id.Clock,
+	}
+}
+
+func convertCharIDFromProto(id *collaborationv1.CharId) CharID {
+	return CharID{
+		ClientID: id.GetClientId(),
+		Clock:    id.GetClock(),
+	}
+}
+
+func convertCRDTOperationTypeToProto(t CRDTOperationType) collaborationv1.CrdtOperation_Type {
+	switch t {
+	case CRDTOperationTypeInsert:
+		return collaborationv1.CrdtOperation_TYPE_INSERT
+	case CRDTOperationTypeDelete:
+		return collaborationv1.CrdtOperation_TYPE_DELETE
+	default:
+		return collaborationv1.CrdtOperation_TYPE_UNSPECIFIED
+	}
+}
+
+func convertCRDTOperationTypeFromProto(t collaborationv1.CrdtOperation_Type) CRDTOperationType {
+	switch t {
+	case collaborationv1.CrdtOperation_TYPE_INSERT:
+		return CRDTOperationTypeInsert
+	case collaborationv1.CrdtOperation_TYPE_DELETE:
+		return CRDTOperationTypeDelete
+	default:
+		return -1
+	}
+}
+
+func convertPresenceEventToProto(event *PresenceEvent) *collaborationv1.PresenceEvent {
+	protoEvent := &collaborationv1.PresenceEvent{
+		Type:         convertPresenceEventTypeToProto(event.Type),
+		UserId:       event.UserID,
+		ConnectionId: event.ConnectionID,
+	}
+	if event.User != nil {
+		protoEvent.User = convertActiveUserToProto(event.User)
+	}
+	if event.Presence != nil {
+		protoEvent.Presence = convertPresenceToProto(*event.Presence)
+	}
+	return protoEvent
+}
+
+func convertPresenceEventTypeToProto(t string) collaborationv1.PresenceEvent_Type {
+	switch t {
+	case PresenceEventJoin:
+		return collaborationv1.PresenceEvent_TYPE_JOIN
+	case PresenceEventLeave:
+		return collaborationv1.PresenceEvent_TYPE_LEAVE
+	case PresenceEventUpdate:
+		return collaborationv1.PresenceEvent_TYPE_UPDATE
+	default:
+		return collaborationv1.PresenceEvent_TYPE_UNSPECIFIED
+	}
+}
@@ -0,0 +1,274 @@
+package collaboration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/HardMax71/syncwrite/backend/pkg/document"
+	"github.com/jackc/pgx/v5"
+)
+
+// Collaboration history.
+//
+// Every live edit appends its change to the operation log, document_operations,
+// at the version it created. Snapshots in document_snapshots hold the whole
+// state of a document at a version: one is taken every snapshotInterval
+// versions, and whenever a document is created or replaced outright. The
+// state at any version is the latest snapshot at or before it with the logged
+// changes since replayed on top, so the log never has to be replayed from the
+// start, and the compactor can drop the changes folded into a snapshot once
+// they are old enough.
+
+var ErrInvalidVersionRange = errors.New("invalid version range")
+
+// snapshotInterval is the number of versions between snapshots of a document
+// edited live.
+const snapshotInterval = 100
+
+// replayBatchSize is the number of changes read at a time when playing back
+// the history of a document.
+const replayBatchSize = 500
+
+// DocumentState is the state of a document at a version. CRDTState and
+// YjsState are only set for documents in the matching sync mode.
+type DocumentState struct {
+	DocumentID string
+	Version    int64
+	Content    string
+	CRDTState  []byte
+	YjsState   []byte
+}
+
+// recordChange appends a change to the operation log within the transaction
+// that commits it. payload is the change encoded as JSON. It must be called
+// after the document row was updated, since it may snapshot the new state.
+func recordChange(ctx context.Context, tx pgx.Tx, change *DocumentChange, payload []byte) error {
+	_, err := tx.Exec(ctx, `
+        INSERT INTO document_operations (document_id, version, user_id, change)
+        VALUES ($1, $2, $3, $4)
+    `, change.DocumentID, change.Version, change.UserID, payload)
+	if err != nil {
+		return fmt.Errorf("error storing change: %w", err)
+	}
+
+	if change.Version%snapshotInterval == 0 {
+		return takeSnapshot(ctx, tx, change.DocumentID)
+	}
+	return nil
+}
+
+// takeSnapshot stores the current state of a document at its current version.
+func takeSnapshot(ctx context.Context, tx pgx.Tx, documentID string) error {
+	_, err := tx.Exec(ctx, `
+        INSERT INTO document_snapshots (document_id, version, content, crdt_state, yjs_state)
+        SELECT id, version, COALESCE(content, ''), crdt_state, yjs_state FROM documents WHERE id = $1
+        ON CONFLICT (document_id, version) DO NOTHING
+    `, documentID)
+	if err != nil {
+		return fmt.Errorf("error storing snapshot: %w", err)
+	}
+	return nil
+}
+
+// StateAt rebuilds the state of a document at a version from the latest
+// snapshot at or before it. It fails with ErrHistoryUnavailable when the
+// history no longer reaches back to version.
+func (s *Service) StateAt(ctx context.Context, documentID string, version int64) (*DocumentState, error) {
+	var currentVersion int64
+	err := s.db.QueryRow(ctx, `
+        SELECT version FROM documents WHERE id = $1
+    `, documentID).Scan(&currentVersion)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting current version: %w", err)
+	}
+
+	if version > currentVersion {
+		return nil, document.ErrVersionMismatch
+	}
+
+	state := &DocumentState{DocumentID: documentID}
+	err = s.db.QueryRow(ctx, `
+        SELECT version, content, crdt_state, yjs_state FROM document_snapshots
+        WHERE document_id = $1 AND version <= $2
+        ORDER BY version DESC
+        LIMIT 1
+    `, documentID, version).Scan(&state.Version, &state.Content, &state.CRDTState, &state.YjsState)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: no snapshot at or before version %d", ErrHistoryUnavailable, version)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting snapshot: %w", err)
+	}
+
+	changes, err := loadChanges(ctx, s.db, documentID, state.Version, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := state.replay(changes); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Replay returns the state of a document at fromVersion, for playing back
+// how the document was written from there up to and including toVersion,
+// which it returns as well. A fromVersion of zero starts from the earliest
+// state the history holds, and a toVersion of zero ends at the current
+// version. The changes that follow are read with ReplayChanges.
+func (s *Service) Replay(ctx context.Context, documentID string, fromVersion, toVersion int64) (*DocumentState, int64, error) {
+	var currentVersion int64
+	var earliestVersion *int64
+	err := s.db.QueryRow(ctx, `
+        SELECT d.version, (SELECT MIN(version) FROM document_snapshots WHERE document_id = d.id)
+        FROM documents d WHERE d.id = $1
+    `, documentID).Scan(&currentVersion, &earliestVersion)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, 0, document.ErrDocumentNotFound
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("error getting current version: %w", err)
+	}
+
+	if fromVersion == 0 {
+		if earliestVersion == nil {
+			return nil, 0, fmt.Errorf("%w: no snapshot of the document", ErrHistoryUnavailable)
+		}
+		fromVersion = *earliestVersion
+	}
+	if toVersion == 0 {
+		toVersion = currentVersion
+	}
+
+	if toVersion > currentVersion {
+		return nil, 0, document.ErrVersionMismatch
+	}
+	if fromVersion < 0 || fromVersion > toVersion {
+		return nil, 0, ErrInvalidVersionRange
+	}
+
+	state, err := s.StateAt(ctx, documentID, fromVersion)
+	if err != nil {
+		return nil, 0, err
+	}
+	return state, toVersion, nil
+}
+
+// ReplayChanges returns the next changes to play back after fromVersion, at
+// most replayBatchSize of them and none after toVersion. Versions that
+// replaced the whole document, e.g. through UpdateDocument or RestoreVersion,
+// are not in the log: the changes then stop short of such a version, and the
+// snapshot taken at it is returned to restart playback from.
+func (s *Service) ReplayChanges(ctx context.Context, documentID string, fromVersion, toVersion int64) ([]*DocumentChange, *DocumentState, error) {
+	return replayChanges(ctx, s.db, documentID, fromVersion, toVersion)
+}
+
+func replayChanges(ctx context.Context, q querier, documentID string, fromVersion, toVersion int64) ([]*DocumentChange, *DocumentState, error) {
+	changes, err := loadLoggedChanges(ctx, q, documentID, fromVersion, min(fromVersion+replayBatchSize, toVersion))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	next := fromVersion + int64(len(changes)) + 1
+	if next > toVersion || len(changes) == replayBatchSize {
+		return changes, nil, nil
+	}
+
+	// The next version is not logged; continue from the first snapshot at or
+	// after it, which is at that very version unless the log was compacted
+	state := &DocumentState{DocumentID: documentID}
+	err = q.QueryRow(ctx, `
+        SELECT version, content, crdt_state, yjs_state FROM document_snapshots
+        WHERE document_id = $1 AND version >= $2 AND version <= $3
+        ORDER BY version ASC
+        LIMIT 1
+    `, documentID, next, toVersion).Scan(&state.Version, &state.Content, &state.CRDTState, &state.YjsState)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil, fmt.Errorf("%w: no change or snapshot for version %d", ErrHistoryUnavailable, next)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting snapshot: %w", err)
+	}
+	return changes, state, nil
+}
+
+// ReplayDelay is how long to wait between playing back two changes made at
+// previous and next, compressing time by speed and pausing no longer than
+// maxGap.
+func ReplayDelay(previous, next time.Time, speed float64, maxGap time.Duration) time.Duration {
+	if speed <= 0 {
+		return 0
+	}
+	delay := time.Duration(float64(next.Sub(previous)) / speed)
+	return min(max(delay, 0), maxGap)
+}
+
+// replay applies changes following the state, in order.
+func (st *DocumentState) replay(changes []*DocumentChange) error {
+	var crdt *CRDTDocument
+	var yjsUpdates [][]byte
+
+	for _, change := range changes {
+		switch {
+		case len(change.CRDTOperations) > 0:
+			if crdt == nil {
+				doc, err := st.loadCRDTDocument()
+				if err != nil {
+					return err
+				}
+				crdt = doc
+			}
+			for i, op := range change.CRDTOperations {
+				if _, err := crdt.Apply(op); err != nil {
+					return fmt.Errorf("version %d, operation %d: %w", change.Version, i, err)
+				}
+			}
+		case change.YjsUpdate != nil:
+			yjsUpdates = append(yjsUpdates, change.YjsUpdate)
+		default:
+			content, err := ApplyOperations(st.Content, change.Operations)
+			if err != nil {
+				return fmt.Errorf("version %d: %w", change.Version, err)
+			}
+			st.Content = content
+		}
+		st.Version = change.Version
+	}
+
+	if crdt != nil {
+		state, err := crdt.MarshalJSON()
+		if err != nil {
+			return fmt.Errorf("error marshaling CRDT state: %w", err)
+		}
+		st.Content = crdt.Text()
+		st.CRDTState = state
+	}
+
+	if len(yjsUpdates) > 0 {
+		if st.YjsState != nil {
+			yjsUpdates = append([][]byte{st.YjsState}, yjsUpdates...)
+		}
+		state, err := MergeYjsUpdates(yjsUpdates...)
+		if err != nil {
+			return err
+		}
+		st.YjsState = state
+	}
+
+	return nil
+}
+
+// loadCRDTDocument loads the CRDT state, seeding it from the text the way
+// MergeOperations does when the text was last written outside of the CRDT.
+func (st *DocumentState) loadCRDTDocument() (*CRDTDocument, error) {
+	if st.CRDTState == nil {
+		return SeedCRDTDocument(fmt.Sprintf("seed:%d", st.Version), st.Content), nil
+	}
+	return LoadCRDTDocument(st.CRDTState)
+}
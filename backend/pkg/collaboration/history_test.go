@@ -0,0 +1,238 @@
+package collaboration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// TestReplayChanges plays back a history the way ReplayHistory does, a batch
+// of changes at a time and starting over from the snapshot of every version
+// that is not in the log.
+func TestReplayChanges(t *testing.T) {
+	long := &fakeHistory{
+		changes:   map[int64]*DocumentChange{},
+		snapshots: map[int64]*DocumentState{1: {Version: 1}},
+	}
+	for version := int64(2); version <= 2*replayBatchSize+2; version++ {
+		long.changes[version] = &DocumentChange{Version: version, Operations: []Operation{insertOperation(0, "x")}}
+	}
+
+	tests := []struct {
+		name        string
+		history     *fakeHistory
+		fromVersion int64
+		toVersion   int64
+		want        string
+		restarts    []int64
+	}{
+		{
+			name: "across an UpdateDocument",
+			history: &fakeHistory{
+				changes: map[int64]*DocumentChange{
+					2: {Version: 2, Operations: []Operation{insertOperation(5, " world")}},
+					4: {Version: 4, Operations: []Operation{insertOperation(7, "!")}},
+					5: {Version: 5, Operations: []Operation{deleteOperation(0, 4)}},
+				},
+				snapshots: map[int64]*DocumentState{
+					1: {Version: 1, Content: "hello"},
+					// Written by UpdateDocument, which logs no change
+					3: {Version: 3, Content: "Goodbye"},
+				},
+			},
+			fromVersion: 1,
+			toVersion:   5,
+			want:        "bye!",
+			restarts:    []int64{3},
+		},
+		{
+			name: "replaced twice in a row",
+			history: &fakeHistory{
+				changes: map[int64]*DocumentChange{
+					4: {Version: 4, Operations: []Operation{insertOperation(0, ">")}},
+				},
+				snapshots: map[int64]*DocumentState{
+					1: {Version: 1, Content: "a"},
+					2: {Version: 2, Content: "b"},
+					3: {Version: 3, Content: "c"},
+				},
+			},
+			fromVersion: 1,
+			toVersion:   4,
+			want:        ">c",
+			restarts:    []int64{2, 3},
+		},
+		{
+			name: "ending at a replaced version",
+			history: &fakeHistory{
+				changes: map[int64]*DocumentChange{
+					2: {Version: 2, Operations: []Operation{insertOperation(0, "x")}},
+				},
+				snapshots: map[int64]*DocumentState{
+					1: {Version: 1, Content: "a"},
+					3: {Version: 3, Content: "c"},
+				},
+			},
+			fromVersion: 1,
+			toVersion:   3,
+			want:        "c",
+			restarts:    []int64{3},
+		},
+		{
+			name: "across compacted changes",
+			history: &fakeHistory{
+				changes: map[int64]*DocumentChange{
+					5: {Version: 5, Operations: []Operation{insertOperation(4, "!")}},
+				},
+				snapshots: map[int64]*DocumentState{
+					1: {Version: 1, Content: "a"},
+					4: {Version: 4, Content: "abcd"},
+				},
+			},
+			fromVersion: 1,
+			toVersion:   5,
+			want:        "abcd!",
+			restarts:    []int64{4},
+		},
+		{
+			name:        "a long log in batches",
+			history:     long,
+			fromVersion: 1,
+			toVersion:   2*replayBatchSize + 2,
+			want:        strings.Repeat("x", 2*replayBatchSize+1),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, restarts, err := playBack(tt.history, tt.fromVersion, tt.toVersion)
+			if err != nil {
+				t.Fatalf("playBack() error = %v", err)
+			}
+			if content != tt.want {
+				t.Errorf("played back to %q, want %q", content, tt.want)
+			}
+			if !reflect.DeepEqual(restarts, tt.restarts) {
+				t.Errorf("restarted at %v, want %v", restarts, tt.restarts)
+			}
+		})
+	}
+}
+
+func TestReplayChangesUnavailable(t *testing.T) {
+	history := &fakeHistory{
+		changes: map[int64]*DocumentChange{
+			4: {Version: 4, Operations: []Operation{insertOperation(0, "x")}},
+		},
+		snapshots: map[int64]*DocumentState{1: {Version: 1}},
+	}
+
+	if _, _, err := playBack(history, 1, 4); !errors.Is(err, ErrHistoryUnavailable) {
+		t.Errorf("playBack() error = %v, want ErrHistoryUnavailable", err)
+	}
+}
+
+// playBack returns the content played back from the snapshot at fromVersion
+// to toVersion, and the versions playback started over from.
+func playBack(history *fakeHistory, fromVersion, toVersion int64) (string, []int64, error) {
+	start := *history.snapshots[fromVersion]
+	state := &start
+
+	var restarts []int64
+	for version := state.Version; version < toVersion; {
+		changes, restart, err := replayChanges(context.Background(), history, "doc", version, toVersion)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(changes) == 0 && restart == nil {
+			return "", nil, errors.New("no progress")
+		}
+
+		if err := state.replay(changes); err != nil {
+			return "", nil, err
+		}
+		version = state.Version
+
+		if restart != nil {
+			restarts = append(restarts, restart.Version)
+			state = restart
+			version = restart.Version
+		}
+	}
+	return state.Content, restarts, nil
+}
+
+// fakeHistory answers the queries of replayChanges from the operation log and
+// snapshots of a single document.
+type fakeHistory struct {
+	changes   map[int64]*DocumentChange
+	snapshots map[int64]*DocumentState
+}
+
+// Query reads the changes after args[1] up to and including args[2].
+func (f *fakeHistory) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	from, to := args[1].(int64), args[2].(int64)
+
+	rows := &fakeRows{}
+	for version := from + 1; version <= to; version++ {
+		if change, ok := f.changes[version]; ok {
+			payload, err := json.Marshal(change)
+			if err != nil {
+				return nil, err
+			}
+			rows.values = append(rows.values, []any{payload, version})
+		}
+	}
+	return rows, nil
+}
+
+// QueryRow reads the first snapshot from args[1] up to and including
+// args[2].
+func (f *fakeHistory) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	from, to := args[1].(int64), args[2].(int64)
+
+	for version := from; version <= to; version++ {
+		if st, ok := f.snapshots[version]; ok {
+			snapshot := *st
+			return &fakeRows{values: [][]any{{snapshot.Version, snapshot.Content, snapshot.CRDTState, snapshot.YjsState}}}
+		}
+	}
+	return &fakeRows{}
+}
+
+// fakeRows implements the pgx.Rows methods the history uses; a Scan without a
+// next row fails with pgx.ErrNoRows, as pgx.Row does.
+type fakeRows struct {
+	pgx.Rows
+	values  [][]any
+	current []any
+}
+
+func (r *fakeRows) Next() bool {
+	if len(r.values) == 0 {
+		return false
+	}
+	r.current, r.values = r.values[0], r.values[1:]
+	return true
+}
+
+func (r *fakeRows) Scan(dest ...any) error {
+	if r.current == nil && !r.Next() {
+		return pgx.ErrNoRows
+	}
+	for i, d := range dest {
+		reflect.ValueOf(d).Elem().Set(reflect.ValueOf(r.current[i]))
+	}
+	return nil
+}
+
+func (r *fakeRows) Err() error {
+	return nil
+}
+
+func (r *fakeRows) Close() {}
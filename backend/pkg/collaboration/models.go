@@ -1,23 +1,44 @@
 package collaboration
 
 import (
-	"sync"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
 	"time"
 )
 
+// ActiveUser is one connection of a user to a document session. A user with
+// the document open on several devices has one ActiveUser per connection.
 type ActiveUser struct {
-	UserID         string    `json:"user_id"`
-	Username       string    `json:"username"`
-	CursorPosition string    `json:"cursor_position"`
-	LastActive     time.Time `json:"last_active"`
+	ConnectionID string    `json:"connection_id"`
+	UserID       string    `json:"user_id"`
+	Username     string    `json:"username"`
+	Presence     Presence  `json:"presence"`
+	LastActive   time.Time `json:"last_active"`
 }
 
-type DocumentSession struct {
-	DocumentID  string                 `json:"document_id"`
-	ActiveUsers map[string]*ActiveUser `json:"active_users"`
-	mutex       sync.RWMutex
+// Selection is a selected range of a document in UTF-16 code units. Anchor is
+// where the selection started and Head where the caret is; both are equal for
+// a plain cursor.
+type Selection struct {
+	Anchor int32 `json:"anchor"`
+	Head   int32 `json:"head"`
 }
 
+// Presence is what a connection shares with the other participants of a
+// session.
+type Presence struct {
+	Selections []Selection `json:"selections"`
+	// Color is assigned per user so all connections of a user look alike.
+	Color    string `json:"color"`
+	IsTyping bool   `json:"is_typing"`
+	// Version is the document version the selections refer to.
+	Version int64 `json:"version"`
+}
+
+// Operation is a single edit. Position and Length are offsets in UTF-16 code
+// units; see ApplyOperations.
 type Operation struct {
 	Type     OperationType `json:"type"`
 	Position int32         `json:"position"`
@@ -33,75 +54,75 @@ const (
 	OperationTypeReplace
 )
 
-type DocumentChange struct {
-	DocumentID string      `json:"document_id"`
-	UserID     string      `json:"user_id"`
-	Version    string      `json:"version"`
-	Operations []Operation `json:"operations"`
-	Timestamp  time.Time   `json:"timestamp"`
-}
-
-type SessionManager struct {
-	sessions map[string]*DocumentSession
-	mutex    sync.RWMutex
+// CharID uniquely identifies a character of a CRDT document.
+type CharID struct {
+	ClientID string `json:"client_id"`
+	Clock    uint64 `json:"clock"`
 }
 
-func NewSessionManager() *SessionManager {
-	return &SessionManager{
-		sessions: make(map[string]*DocumentSession),
-	}
+// CRDTOperation is an edit of a document in CRDT sync mode. Inserts place
+// Content after the Origin character, with ID naming the first inserted
+// character; deletes tombstone the Target character.
+type CRDTOperation struct {
+	Type    CRDTOperationType `json:"type"`
+	ID      CharID            `json:"id"`
+	Origin  CharID            `json:"origin"`
+	Target  CharID            `json:"target"`
+	Content string            `json:"content"`
 }
 
-func (sm *SessionManager) GetOrCreateSession(documentID string) *DocumentSession {
-	sm.mutex.Lock()
-	defer sm.mutex.Unlock()
-
-	session, exists := sm.sessions[documentID]
-	if !exists {
-		session = &DocumentSession{
-			DocumentID:  documentID,
-			ActiveUsers: make(map[string]*ActiveUser),
-		}
-		sm.sessions[documentID] = session
-	}
-	return session
-}
+type CRDTOperationType int
 
-func (sm *SessionManager) RemoveSession(documentID string) {
-	sm.mutex.Lock()
-	defer sm.mutex.Unlock()
-	delete(sm.sessions, documentID)
-}
+const (
+	CRDTOperationTypeInsert CRDTOperationType = iota
+	CRDTOperationTypeDelete
+)
 
-func (s *DocumentSession) AddUser(user *ActiveUser) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	s.ActiveUsers[user.UserID] = user
+type DocumentChange struct {
+	DocumentID     string          `json:"document_id"`
+	UserID         string          `json:"user_id"`
+	Version        int64           `json:"version"`
+	Operations     []Operation     `json:"operations"`
+	CRDTOperations []CRDTOperation `json:"crdt_operations,omitempty"`
+	YjsUpdate      []byte          `json:"yjs_update,omitempty"`
+	Timestamp      time.Time       `json:"timestamp"`
 }
 
-func (s *DocumentSession) RemoveUser(userID string) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	delete(s.ActiveUsers, userID)
+// PresenceEvent is published on a document's presence topic when a user joins
+// or leaves the session or updates their presence.
+type PresenceEvent struct {
+	Type         string      `json:"type"`
+	UserID       string      `json:"user_id"`
+	ConnectionID string      `json:"connection_id,omitempty"`
+	User         *ActiveUser `json:"user,omitempty"`
+	Presence     *Presence   `json:"presence,omitempty"`
 }
 
-func (s *DocumentSession) GetActiveUsers() []*ActiveUser {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+const (
+	PresenceEventJoin   = "join"
+	PresenceEventLeave  = "leave"
+	PresenceEventUpdate = "update"
+)
 
-	users := make([]*ActiveUser, 0, len(s.ActiveUsers))
-	for _, user := range s.ActiveUsers {
-		users = append(users, user)
-	}
-	return users
+// presenceColors is the palette user colors are picked from.
+var presenceColors = []string{
+	"#e6194b", "#3cb44b", "#4363d8", "#f58231", "#911eb4", "#46f0f0",
+	"#f032e6", "#bcf60c", "#008080", "#9a6324", "#800000", "#000075",
 }
 
-func (s *DocumentSession) UpdateUserActivity(userID string, cursorPosition string) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+// PresenceColor returns the color of a user, which is stable across
+// connections and sessions.
+func PresenceColor(userID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return presenceColors[h.Sum32()%uint32(len(presenceColors))]
+}
 
-	if user, exists := s.ActiveUsers[userID]; exists {
-		user.CursorPosition = cursorPosition
-		user.LastActive = time.Now()
+// NewConnectionID returns a random ID for a client connection.
+func NewConnectionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("error generating connection ID: %v", err))
 	}
+	return hex.EncodeToString(b)
 }
@@ -2,6 +2,7 @@ package collaboration
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -11,65 +12,193 @@ import (
 	"go.uber.org/zap"
 )
 
+// renewTimeout bounds connecting the client that replaces one whose
+// credentials are about to expire.
+const renewTimeout = 10 * time.Second
+
+// MQTTClient is a PubSub backed by an MQTT broker. The broker holds one
+// subscription per filter however many handlers it has, and every message is
+// dispatched to the handlers of all filters matching its topic.
 type MQTTClient struct {
-	client   mqtt.Client
-	logger   *zap.Logger
-	handlers map[string]func([]byte)
-	mutex    sync.RWMutex
+	brokerURL   string
+	credentials func() (string, string)
+	logger      *zap.Logger
+	handlers    *topicHandlers
+	// clientMutex guards client, which is replaced when it renews its
+	// credentials.
+	clientMutex sync.RWMutex
+	client      mqtt.Client
+	// subscribeMutex serializes changes to the broker subscriptions, so a
+	// handler is only returned once its filter is subscribed and the
+	// unsubscribe of a filter cannot overtake a later subscribe.
+	subscribeMutex sync.Mutex
+	done           chan struct{}
 }
 
-func NewMQTTClient(brokerURL string) (*MQTTClient, error) {
-	logger := utils.Logger()
+// NewMQTTClient connects to the broker at brokerURL, asking credentials for
+// the username and password on every connect. A broker that is not up yet,
+// e.g. one starting alongside the server, is retried until it accepts the
+// connection. Since the broker stops authorizing a connection once its
+// credentials expire, the client reconnects with fresh ones every
+// renewInterval, unless that is zero.
+func NewMQTTClient(brokerURL string, credentials func() (string, string), renewInterval time.Duration) (*MQTTClient, error) {
+	m := &MQTTClient{
+		brokerURL:   brokerURL,
+		credentials: credentials,
+		logger:      utils.Logger(),
+		handlers:    newTopicHandlers(),
+		done:        make(chan struct{}),
+	}
+
+	m.client = m.newClient()
+	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("error connecting to MQTT broker: %w", token.Error())
+	}
+
+	if renewInterval > 0 {
+		go m.renewLoop(renewInterval)
+	}
+	return m, nil
+}
 
+func (m *MQTTClient) newClient() mqtt.Client {
+	// Subscriptions are made without callbacks so every message reaches the
+	// default handler exactly once, even when several filters match it
 	opts := mqtt.NewClientOptions().
-		AddBroker(brokerURL).
+		AddBroker(m.brokerURL).
 		SetClientID(fmt.Sprintf("syncwrite-server-%d", time.Now().UnixNano())).
 		SetCleanSession(true).
 		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(2 * time.Second).
+		SetCredentialsProvider(m.credentials).
+		SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
+			m.handlers.dispatch(msg.Topic(), msg.Payload())
+		}).
 		SetOnConnectHandler(func(client mqtt.Client) {
-			logger.Info("Connected to MQTT broker")
+			m.logger.Info("Connected to MQTT broker")
+			m.resubscribe(client)
 		}).
 		SetConnectionLostHandler(func(client mqtt.Client, err error) {
-			logger.Error("Lost connection to MQTT broker", zap.Error(err))
+			m.logger.Error("Lost connection to MQTT broker", zap.Error(err))
 		})
 
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		return nil, fmt.Errorf("error connecting to MQTT broker: %w", token.Error())
-	}
+	return mqtt.NewClient(opts)
+}
 
-	return &MQTTClient{
-		client:   client,
-		logger:   logger,
-		handlers: make(map[string]func([]byte)),
-	}, nil
+func (m *MQTTClient) currentClient() mqtt.Client {
+	m.clientMutex.RLock()
+	defer m.clientMutex.RUnlock()
+	return m.client
 }
 
-func (m *MQTTClient) Subscribe(topic string, handler func([]byte)) error {
-	m.mutex.Lock()
-	m.handlers[topic] = handler
-	m.mutex.Unlock()
+func (m *MQTTClient) renewLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.renew(); err != nil {
+				m.logger.Error("Error renewing MQTT connection", zap.Error(err))
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
 
-	token := m.client.Subscribe(topic, 1, func(client mqtt.Client, msg mqtt.Message) {
-		m.mutex.RLock()
-		if handler, exists := m.handlers[msg.Topic()]; exists {
-			handler(msg.Payload())
+// renew replaces the connection with one made with fresh credentials. The new
+// connection is subscribed before the old one is closed, so no message is
+// lost in between; messages of the overlap may arrive twice, as they may with
+// QoS 1 anyway.
+func (m *MQTTClient) renew() error {
+	client := m.newClient()
+	token := client.Connect()
+	if !token.WaitTimeout(renewTimeout) || token.Error() != nil {
+		client.Disconnect(0)
+		if token.Error() != nil {
+			return fmt.Errorf("error connecting to MQTT broker: %w", token.Error())
 		}
-		m.mutex.RUnlock()
-	})
+		return errors.New("timed out connecting to MQTT broker")
+	}
+
+	m.subscribeMutex.Lock()
+	for _, filter := range m.handlers.filters() {
+		token := client.Subscribe(filter, 1, nil)
+		token.Wait()
+		if err := token.Error(); err != nil {
+			m.subscribeMutex.Unlock()
+			client.Disconnect(0)
+			return fmt.Errorf("error subscribing to %s: %w", filter, err)
+		}
+	}
 
+	m.clientMutex.Lock()
+	previous := m.client
+	m.client = client
+	m.clientMutex.Unlock()
+	m.subscribeMutex.Unlock()
+
+	previous.Disconnect(250)
+	return nil
+}
+
+// Subscribe adds a handler for filter. The broker subscription is made with
+// the first handler of a filter.
+func (m *MQTTClient) Subscribe(filter string, handler MessageHandler) (string, error) {
+	if err := validateFilter(filter); err != nil {
+		return "", err
+	}
+
+	m.subscribeMutex.Lock()
+	defer m.subscribeMutex.Unlock()
+
+	id, first := m.handlers.add(filter, handler)
+	if !first {
+		return id, nil
+	}
+
+	token := m.currentClient().Subscribe(filter, 1, nil)
 	token.Wait()
-	return token.Error()
+	if err := token.Error(); err != nil {
+		m.handlers.remove(filter, id)
+		return "", fmt.Errorf("error subscribing to %s: %w", filter, err)
+	}
+	return id, nil
 }
 
-func (m *MQTTClient) Unsubscribe(topic string) error {
-	m.mutex.Lock()
-	delete(m.handlers, topic)
-	m.mutex.Unlock()
+// Unsubscribe removes a handler from filter. The broker subscription is
+// dropped with the last handler of a filter.
+func (m *MQTTClient) Unsubscribe(filter, handlerID string) error {
+	m.subscribeMutex.Lock()
+	defer m.subscribeMutex.Unlock()
+
+	if !m.handlers.remove(filter, handlerID) {
+		return nil
+	}
 
-	token := m.client.Unsubscribe(topic)
+	token := m.currentClient().Unsubscribe(filter)
 	token.Wait()
-	return token.Error()
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("error unsubscribing from %s: %w", filter, err)
+	}
+	return nil
+}
+
+// resubscribe restores the broker subscriptions of client after a reconnect;
+// with a clean session the broker forgets them when the connection drops.
+func (m *MQTTClient) resubscribe(client mqtt.Client) {
+	m.subscribeMutex.Lock()
+	defer m.subscribeMutex.Unlock()
+
+	for _, filter := range m.handlers.filters() {
+		token := client.Subscribe(filter, 1, nil)
+		token.Wait()
+		if err := token.Error(); err != nil {
+			m.logger.Error("Error resubscribing", zap.String("filter", filter), zap.Error(err))
+		}
+	}
 }
 
 func (m *MQTTClient) Publish(topic string, payload interface{}) error {
@@ -78,13 +207,14 @@ func (m *MQTTClient) Publish(topic string, payload interface{}) error {
 		return fmt.Errorf("error marshaling payload: %w", err)
 	}
 
-	token := m.client.Publish(topic, 1, false, data)
+	token := m.currentClient().Publish(topic, 1, false, data)
 	token.Wait()
 	return token.Error()
 }
 
 func (m *MQTTClient) Close() {
-	m.client.Disconnect(250)
+	close(m.done)
+	m.currentClient().Disconnect(250)
 }
 
 func GetDocumentTopic(documentID string) string {
@@ -0,0 +1,182 @@
+package collaboration
+
+import (
+	"unicode/utf16"
+)
+
+// Operational transformation for position-based operations.
+//
+// Operations inside a DocumentChange are applied sequentially: the position of
+// each operation refers to the document as left by the previous one. Positions
+// and lengths are counted in UTF-16 code units, matching the string indexing of
+// the browser editor.
+
+// textLength returns the length of s in UTF-16 code units.
+func textLength(s string) int32 {
+	return int32(len(utf16.Encode([]rune(s))))
+}
+
+// normalizeOperations rewrites replace operations as a delete followed by an
+// insert and drops operations that have no effect, so the transformation rules
+// only have to deal with inserts and deletes.
+func normalizeOperations(ops []Operation) []Operation {
+	normalized := make([]Operation, 0, len(ops))
+	for _, op := range ops {
+		switch op.Type {
+		case OperationTypeInsert:
+			if op.Content != "" {
+				normalized = append(normalized, insertOperation(op.Position, op.Content))
+			}
+		case OperationTypeDelete:
+			if op.Length > 0 {
+				normalized = append(normalized, deleteOperation(op.Position, op.Length))
+			}
+		case OperationTypeReplace:
+			if op.Length > 0 {
+				normalized = append(normalized, deleteOperation(op.Position, op.Length))
+			}
+			if op.Content != "" {
+				normalized = append(normalized, insertOperation(op.Position, op.Content))
+			}
+		}
+	}
+	return normalized
+}
+
+// TransformOperations transforms two operation sequences that were produced
+// concurrently against the same document state. It returns incoming' and
+// applied' such that applying applied followed by incoming' yields the same
+// document as applying incoming followed by applied'.
+//
+// When both sides insert at the same position, the already applied side is
+// ordered first, which keeps the committed history stable.
+func TransformOperations(incoming, applied []Operation) ([]Operation, []Operation) {
+	return transformSequences(normalizeOperations(incoming), normalizeOperations(applied))
+}
+
+func transformSequences(a, b []Operation) ([]Operation, []Operation) {
+	if len(a) == 0 || len(b) == 0 {
+		return a, b
+	}
+
+	if len(a) == 1 && len(b) == 1 {
+		return transformOperation(a[0], b[0], false), transformOperation(b[0], a[0], true)
+	}
+
+	if len(a) > 1 {
+		headA, restB := transformSequences(a[:1], b)
+		tailA, finalB := transformSequences(a[1:], restB)
+		return concatOperations(headA, tailA), finalB
+	}
+
+	restA, headB := transformSequences(a, b[:1])
+	finalA, tailB := transformSequences(restA, b[1:])
+	return finalA, concatOperations(headB, tailB)
+}
+
+// transformOperation transforms op so that it can be applied after other.
+// Both operations must be inserts or deletes against the same document state.
+// wins decides the order of two inserts at the same position.
+func transformOperation(op, other Operation, wins bool) []Operation {
+	switch {
+	case op.Type == OperationTypeInsert && other.Type == OperationTypeInsert:
+		if op.Position < other.Position || (op.Position == other.Position && wins) {
+			return []Operation{op}
+		}
+		return []Operation{insertOperation(op.Position+textLength(other.Content), op.Content)}
+
+	case op.Type == OperationTypeInsert && other.Type == OperationTypeDelete:
+		switch {
+		case op.Position <= other.Position:
+			return []Operation{op}
+		case op.Position >= other.Position+other.Length:
+			return []Operation{insertOperation(op.Position-other.Length, op.Content)}
+		default:
+			// The insertion point was deleted; keep the text where the range collapsed.
+			return []Operation{insertOperation(other.Position, op.Content)}
+		}
+
+	case op.Type == OperationTypeDelete && other.Type == OperationTypeInsert:
+		inserted := textLength(other.Content)
+		switch {
+		case other.Position <= op.Position:
+			return []Operation{deleteOperation(op.Position+inserted, op.Length)}
+		case other.Position >= op.Position+op.Length:
+			return []Operation{op}
+		default:
+			// The insertion landed inside the deleted range; delete around it.
+			before := other.Position - op.Position
+			return []Operation{
+				deleteOperation(op.Position, before),
+				deleteOperation(op.Position+inserted, op.Length-before),
+			}
+		}
+
+	case op.Type == OperationTypeDelete && other.Type == OperationTypeDelete:
+		opEnd := op.Position + op.Length
+		otherEnd := other.Position + other.Length
+		switch {
+		case opEnd <= other.Position:
+			return []Operation{op}
+		case op.Position >= otherEnd:
+			return []Operation{deleteOperation(op.Position-other.Length, op.Length)}
+		default:
+			overlap := min(opEnd, otherEnd) - max(op.Position, other.Position)
+			remaining := op.Length - overlap
+			if remaining <= 0 {
+				return nil
+			}
+			return []Operation{deleteOperation(min(op.Position, other.Position), remaining)}
+		}
+	}
+
+	return []Operation{op}
+}
+
+// TransformPosition maps an offset in the document before operations to the
+// same place in the document after them. Text inserted at the offset ends up
+// before it, and an offset inside deleted text moves to where the text was.
+func TransformPosition(position int32, operations []Operation) int32 {
+	for _, op := range normalizeOperations(operations) {
+		switch op.Type {
+		case OperationTypeInsert:
+			if op.Position <= position {
+				position += textLength(op.Content)
+			}
+		case OperationTypeDelete:
+			if op.Position+op.Length <= position {
+				position -= op.Length
+			} else if op.Position < position {
+				position = op.Position
+			}
+		}
+	}
+	return position
+}
+
+// TransformSelections maps selections through operations like
+// TransformPosition.
+func TransformSelections(selections []Selection, operations []Operation) []Selection {
+	transformed := make([]Selection, len(selections))
+	for i, selection := range selections {
+		transformed[i] = Selection{
+			Anchor: TransformPosition(selection.Anchor, operations),
+			Head:   TransformPosition(selection.Head, operations),
+		}
+	}
+	return transformed
+}
+
+func insertOperation(position int32, content string) Operation {
+	return Operation{Type: OperationTypeInsert, Position: position, Content: content}
+}
+
+func deleteOperation(position, length int32) Operation {
+	return Operation{Type: OperationTypeDelete, Position: position, Length: length}
+}
+
+func concatOperations(a, b []Operation) []Operation {
+	result := make([]Operation, 0, len(a)+len(b))
+	result = append(result, a...)
+	return append(result, b...)
+}
@@ -0,0 +1,211 @@
+package collaboration
+
+import (
+	"reflect"
+	"testing"
+)
+
+func replaceOperation(position, length int32, content string) Operation {
+	return Operation{Type: OperationTypeReplace, Position: position, Length: length, Content: content}
+}
+
+// TestTransformOperations checks that both orders of applying two concurrent
+// operation sequences reach the same text (TP1), and that it is the expected
+// one.
+func TestTransformOperations(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		incoming []Operation
+		applied  []Operation
+		want     string
+	}{
+		{
+			name:     "inserts at different positions",
+			content:  "abc",
+			incoming: []Operation{insertOperation(0, "X")},
+			applied:  []Operation{insertOperation(3, "Y")},
+			want:     "XabcY",
+		},
+		{
+			name:     "inserts at the same position order the applied side first",
+			content:  "abc",
+			incoming: []Operation{insertOperation(1, "X")},
+			applied:  []Operation{insertOperation(1, "Y")},
+			want:     "aYXbc",
+		},
+		{
+			name:     "insert after an applied delete",
+			content:  "abcdef",
+			incoming: []Operation{insertOperation(5, "X")},
+			applied:  []Operation{deleteOperation(1, 2)},
+			want:     "adeXf",
+		},
+		{
+			name:     "insert at the start of an applied delete",
+			content:  "abcdef",
+			incoming: []Operation{insertOperation(1, "X")},
+			applied:  []Operation{deleteOperation(1, 2)},
+			want:     "aXdef",
+		},
+		{
+			name:     "insert inside an applied delete",
+			content:  "abcdef",
+			incoming: []Operation{insertOperation(3, "X")},
+			applied:  []Operation{deleteOperation(1, 4)},
+			want:     "aXf",
+		},
+		{
+			name:     "delete around an applied insert",
+			content:  "abcdef",
+			incoming: []Operation{deleteOperation(1, 3)},
+			applied:  []Operation{insertOperation(2, "Y")},
+			want:     "aYef",
+		},
+		{
+			name:     "delete before an applied insert",
+			content:  "abcdef",
+			incoming: []Operation{deleteOperation(0, 2)},
+			applied:  []Operation{insertOperation(4, "Y")},
+			want:     "cdYef",
+		},
+		{
+			name:     "overlapping deletes",
+			content:  "abcdef",
+			incoming: []Operation{deleteOperation(1, 3)},
+			applied:  []Operation{deleteOperation(2, 3)},
+			want:     "af",
+		},
+		{
+			name:     "identical deletes",
+			content:  "abcdef",
+			incoming: []Operation{deleteOperation(1, 2)},
+			applied:  []Operation{deleteOperation(1, 2)},
+			want:     "adef",
+		},
+		{
+			name:     "delete containing an applied delete",
+			content:  "abcdef",
+			incoming: []Operation{deleteOperation(0, 5)},
+			applied:  []Operation{deleteOperation(2, 1)},
+			want:     "f",
+		},
+		{
+			name:     "replace against an applied insert",
+			content:  "abcdef",
+			incoming: []Operation{replaceOperation(1, 2, "XY")},
+			applied:  []Operation{insertOperation(4, "Z")},
+			want:     "aXYdZef",
+		},
+		{
+			name:     "overlapping replaces",
+			content:  "abcdef",
+			incoming: []Operation{replaceOperation(1, 2, "X")},
+			applied:  []Operation{replaceOperation(2, 2, "Y")},
+			want:     "aYXef",
+		},
+		{
+			name:     "replace against an applied delete of the same range",
+			content:  "abcdef",
+			incoming: []Operation{replaceOperation(2, 2, "X")},
+			applied:  []Operation{deleteOperation(2, 2)},
+			want:     "abXef",
+		},
+		{
+			name:     "sequences",
+			content:  "abcdef",
+			incoming: []Operation{insertOperation(0, "A"), deleteOperation(3, 1)},
+			applied:  []Operation{deleteOperation(0, 1), insertOperation(2, "B")},
+			want:     "AbBdef",
+		},
+		{
+			name:     "sequences with a replace",
+			content:  "hello world",
+			incoming: []Operation{replaceOperation(0, 5, "howdy"), insertOperation(11, "!")},
+			applied:  []Operation{insertOperation(6, "big "), deleteOperation(10, 5)},
+			want:     "howdy big !",
+		},
+		{
+			name:     "positions after an inserted surrogate pair",
+			content:  "a😀b",
+			incoming: []Operation{insertOperation(3, "X")},
+			applied:  []Operation{insertOperation(0, "😀")},
+			want:     "😀a😀Xb",
+		},
+		{
+			name:     "delete of a surrogate pair against an insert",
+			content:  "a😀b",
+			incoming: []Operation{deleteOperation(1, 2)},
+			applied:  []Operation{insertOperation(4, "é")},
+			want:     "abé",
+		},
+		{
+			name:     "operations without effect are dropped",
+			content:  "abc",
+			incoming: []Operation{insertOperation(1, ""), deleteOperation(0, 0), replaceOperation(2, 0, "")},
+			applied:  []Operation{insertOperation(0, "X")},
+			want:     "Xabc",
+		},
+		{
+			name:     "nothing applied",
+			content:  "abc",
+			incoming: []Operation{deleteOperation(0, 1)},
+			want:     "bc",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			incoming, applied := TransformOperations(tt.incoming, tt.applied)
+
+			// The server: the applied operations, then the transformed incoming
+			// ones
+			server := mustApply(t, mustApply(t, tt.content, tt.applied), incoming)
+			// The client: its own operations, then the transformed applied ones
+			client := mustApply(t, mustApply(t, tt.content, tt.incoming), applied)
+
+			if server != client {
+				t.Fatalf("server reached %q, client reached %q", server, client)
+			}
+			if server != tt.want {
+				t.Errorf("got %q, want %q", server, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformOperationsTieBreak(t *testing.T) {
+	incoming, applied := TransformOperations(
+		[]Operation{insertOperation(2, "in")},
+		[]Operation{insertOperation(2, "ap")},
+	)
+
+	// The incoming insert moves past the applied one, which stays put
+	if want := []Operation{insertOperation(4, "in")}; !reflect.DeepEqual(incoming, want) {
+		t.Errorf("incoming = %v, want %v", incoming, want)
+	}
+	if want := []Operation{insertOperation(2, "ap")}; !reflect.DeepEqual(applied, want) {
+		t.Errorf("applied = %v, want %v", applied, want)
+	}
+}
+
+func TestTransformOperationsIdenticalDeletes(t *testing.T) {
+	incoming, applied := TransformOperations(
+		[]Operation{deleteOperation(1, 2)},
+		[]Operation{deleteOperation(1, 2)},
+	)
+
+	// Both sides already removed the text
+	if len(incoming) != 0 || len(applied) != 0 {
+		t.Errorf("got %v and %v, want no operations", incoming, applied)
+	}
+}
+
+func mustApply(t *testing.T, content string, operations []Operation) string {
+	t.Helper()
+	result, err := ApplyOperations(content, operations)
+	if err != nil {
+		t.Fatalf("ApplyOperations(%q, %v) error = %v", content, operations, err)
+	}
+	return result
+}
@@ -0,0 +1,229 @@
+package collaboration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/HardMax71/syncwrite/backend/pkg/utils"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+// Transactional outbox for change broadcasts.
+//
+// A change is queued in the outbox by the transaction that commits it, and a
+// relay publishes the queued changes in commit order, marking each delivered
+// once the transport accepted it. A crash or a broker outage between commit
+// and publish therefore delays a broadcast instead of losing it. Delivery is
+// at least once: a change is published again if the relay stops before
+// marking it, so consumers drop changes whose version they already have.
+
+const (
+	outboxBatchSize     = 100
+	outboxMaxBackoff    = 30 * time.Second
+	outboxLockRetry     = 50 * time.Millisecond
+	outboxPruneInterval = time.Minute
+	// outboxLockID is the advisory lock that lets one relay at a time publish,
+	// so changes are broadcast in order even with several replicas.
+	outboxLockID = 0x6f7574626f78
+)
+
+type outboxEntry struct {
+	id      int64
+	topic   string
+	payload []byte
+}
+
+// enqueueChange queues the broadcast of a change within the transaction that
+// commits it. payload is the change encoded as JSON.
+func enqueueChange(ctx context.Context, tx pgx.Tx, change *DocumentChange, payload []byte) error {
+	_, err := tx.Exec(ctx, `
+        INSERT INTO change_outbox (document_id, version, topic, payload)
+        VALUES ($1, $2, $3, $4)
+    `, change.DocumentID, change.Version, GetDocumentTopic(change.DocumentID), payload)
+	if err != nil {
+		return fmt.Errorf("error queueing change broadcast: %w", err)
+	}
+	return nil
+}
+
+// OutboxRelay publishes the changes queued in the outbox.
+type OutboxRelay struct {
+	db     *pgxpool.Pool
+	pubsub PubSub
+	logger *zap.Logger
+	wake   chan struct{}
+}
+
+func NewOutboxRelay(db *pgxpool.Pool, pubsub PubSub) *OutboxRelay {
+	return &OutboxRelay{
+		db:     db,
+		pubsub: pubsub,
+		logger: utils.Logger(),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Notify wakes the relay after a change was committed, so it is published
+// without waiting for the next poll.
+func (r *OutboxRelay) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start relays queued changes when notified and every interval until ctx is
+// done. After a failed publish the relay backs off, up to outboxMaxBackoff.
+// Delivered changes are deleted once they are older than retention.
+func (r *OutboxRelay) Start(ctx context.Context, interval, retention time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var retry <-chan time.Time
+		var pausedUntil, lastPrune time.Time
+		backoff := interval
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-r.wake:
+			case <-retry:
+			case <-ctx.Done():
+				return
+			}
+
+			if time.Now().Before(pausedUntil) {
+				continue
+			}
+			retry = nil
+
+			busy, err := r.relay(ctx)
+			switch {
+			case err != nil:
+				r.logger.Error("Error relaying change broadcasts", zap.Error(err))
+				pausedUntil = time.Now().Add(backoff)
+				retry = time.After(backoff)
+				backoff = min(backoff*2, outboxMaxBackoff)
+			case busy:
+				// Another replica is relaying; it may have missed the change
+				// that woke us
+				retry = time.After(outboxLockRetry)
+			default:
+				backoff = interval
+			}
+
+			if time.Since(lastPrune) >= outboxPruneInterval {
+				if err := r.prune(ctx, retention); err != nil {
+					r.logger.Error("Error pruning change outbox", zap.Error(err))
+				}
+				lastPrune = time.Now()
+			}
+		}
+	}()
+}
+
+// relay publishes queued changes until none are left. It reports busy if
+// another relay holds the lock.
+func (r *OutboxRelay) relay(ctx context.Context) (bool, error) {
+	for {
+		delivered, locked, err := r.deliverBatch(ctx)
+		if err != nil || !locked {
+			return !locked, err
+		}
+		if delivered < outboxBatchSize {
+			return false, nil
+		}
+	}
+}
+
+// deliverBatch publishes the oldest queued changes. It stops at the first
+// change that fails to publish, so none is overtaken by a later one.
+func (r *OutboxRelay) deliverBatch(ctx context.Context) (int, bool, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, false, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var locked bool
+	err = tx.QueryRow(ctx, `
+        SELECT pg_try_advisory_xact_lock($1)
+    `, outboxLockID).Scan(&locked)
+	if err != nil {
+		return 0, false, fmt.Errorf("error locking change outbox: %w", err)
+	}
+	if !locked {
+		return 0, false, nil
+	}
+
+	rows, err := tx.Query(ctx, `
+        SELECT id, topic, payload FROM change_outbox
+        WHERE delivered_at IS NULL
+        ORDER BY id ASC
+        LIMIT $1
+    `, outboxBatchSize)
+	if err != nil {
+		return 0, true, fmt.Errorf("error querying change outbox: %w", err)
+	}
+
+	var entries []outboxEntry
+	for rows.Next() {
+		var entry outboxEntry
+		if err := rows.Scan(&entry.id, &entry.topic, &entry.payload); err != nil {
+			rows.Close()
+			return 0, true, fmt.Errorf("error scanning outbox entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, true, fmt.Errorf("error reading change outbox: %w", err)
+	}
+
+	var delivered []int64
+	var publishErr error
+	for _, entry := range entries {
+		if err := r.pubsub.Publish(entry.topic, json.RawMessage(entry.payload)); err != nil {
+			publishErr = fmt.Errorf("error publishing outbox entry %d: %w", entry.id, err)
+			_, err = tx.Exec(ctx, `
+                UPDATE change_outbox SET attempts = attempts + 1, last_error = $1 WHERE id = $2
+            `, publishErr.Error(), entry.id)
+			if err != nil {
+				return 0, true, fmt.Errorf("error recording failed delivery: %w", err)
+			}
+			break
+		}
+		delivered = append(delivered, entry.id)
+	}
+
+	if len(delivered) > 0 {
+		_, err = tx.Exec(ctx, `
+            UPDATE change_outbox SET delivered_at = NOW(), attempts = attempts + 1
+            WHERE id = ANY($1)
+        `, delivered)
+		if err != nil {
+			return 0, true, fmt.Errorf("error marking outbox entries delivered: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, true, fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return len(delivered), true, publishErr
+}
+
+func (r *OutboxRelay) prune(ctx context.Context, retention time.Duration) error {
+	_, err := r.db.Exec(ctx, `
+        DELETE FROM change_outbox WHERE delivered_at < $1
+    `, time.Now().Add(-retention))
+	if err != nil {
+		return fmt.Errorf("error deleting delivered outbox entries: %w", err)
+	}
+	return nil
+}
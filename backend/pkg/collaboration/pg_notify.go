@@ -0,0 +1,234 @@
+package collaboration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/HardMax71/syncwrite/backend/pkg/utils"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+// Postgres LISTEN/NOTIFY as a broker-less transport, so a single Postgres is
+// enough to run collaboration across replicas.
+//
+// All topics share one notification channel; every replica listens on it with
+// one connection from the pool and dispatches by topic. Notifications are
+// transactional, so a change published within the transaction that commits it
+// is broadcast exactly when it commits, without going through the outbox.
+// Payloads over the notification size limit are stored in pubsub_messages and
+// only their ID is sent. Notifications sent while a replica reconnects are
+// lost to it; change streams recover them from the change history when they
+// see the next change.
+
+const (
+	notifyChannel       = "collaboration"
+	notifyPayloadLimit  = 7900
+	notifyRetry         = time.Second
+	notifyRetention     = time.Minute
+	notifyPruneInterval = time.Minute
+)
+
+// TxPublisher is implemented by transports that can publish a message as part
+// of a database transaction, delivering it only if the transaction commits.
+type TxPublisher interface {
+	PublishTx(ctx context.Context, tx pgx.Tx, topic string, payload interface{}) error
+}
+
+type notification struct {
+	Topic   string          `json:"topic"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// MessageID refers to a payload stored in pubsub_messages.
+	MessageID int64 `json:"message_id,omitempty"`
+}
+
+type execQuerier interface {
+	querier
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// PostgresNotify is a PubSub backed by Postgres notifications.
+type PostgresNotify struct {
+	db       *pgxpool.Pool
+	logger   *zap.Logger
+	handlers *topicHandlers
+	cancel   context.CancelFunc
+}
+
+// NewPostgresNotify starts listening for notifications on a connection from
+// db.
+func NewPostgresNotify(db *pgxpool.Pool) *PostgresNotify {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &PostgresNotify{
+		db:       db,
+		logger:   utils.Logger(),
+		handlers: newTopicHandlers(),
+		cancel:   cancel,
+	}
+	go p.listen(ctx)
+	return p
+}
+
+func (p *PostgresNotify) Publish(topic string, payload interface{}) error {
+	return p.publish(context.Background(), p.db, topic, payload)
+}
+
+// PublishTx sends a message when tx commits.
+func (p *PostgresNotify) PublishTx(ctx context.Context, tx pgx.Tx, topic string, payload interface{}) error {
+	return p.publish(ctx, tx, topic, payload)
+}
+
+func (p *PostgresNotify) Subscribe(filter string, handler MessageHandler) (string, error) {
+	if err := validateFilter(filter); err != nil {
+		return "", err
+	}
+
+	id, _ := p.handlers.add(filter, handler)
+	return id, nil
+}
+
+func (p *PostgresNotify) Unsubscribe(filter, handlerID string) error {
+	p.handlers.remove(filter, handlerID)
+	return nil
+}
+
+func (p *PostgresNotify) Close() {
+	p.cancel()
+}
+
+func (p *PostgresNotify) publish(ctx context.Context, q execQuerier, topic string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error marshaling payload: %w", err)
+	}
+
+	message, err := json.Marshal(notification{Topic: topic, Payload: data})
+	if err != nil {
+		return fmt.Errorf("error marshaling notification: %w", err)
+	}
+
+	if len(message) > notifyPayloadLimit {
+		var id int64
+		err := q.QueryRow(ctx, `
+            INSERT INTO pubsub_messages (topic, payload) VALUES ($1, $2) RETURNING id
+        `, topic, data).Scan(&id)
+		if err != nil {
+			return fmt.Errorf("error storing message: %w", err)
+		}
+
+		message, err = json.Marshal(notification{Topic: topic, MessageID: id})
+		if err != nil {
+			return fmt.Errorf("error marshaling notification: %w", err)
+		}
+	}
+
+	rows, err := q.Query(ctx, `
+        SELECT pg_notify($1, $2)
+    `, notifyChannel, string(message))
+	if err != nil {
+		return fmt.Errorf("error sending notification: %w", err)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error sending notification: %w", err)
+	}
+	return nil
+}
+
+// listen receives notifications until ctx is done, reconnecting whenever the
+// listening connection fails.
+func (p *PostgresNotify) listen(ctx context.Context) {
+	var lastPrune time.Time
+
+	for {
+		err := p.receive(ctx, func() {
+			if time.Since(lastPrune) < notifyPruneInterval {
+				return
+			}
+			if err := p.prune(ctx); err != nil {
+				p.logger.Error("Error pruning stored messages", zap.Error(err))
+			}
+			lastPrune = time.Now()
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		p.logger.Error("Error listening for notifications", zap.Error(err))
+
+		select {
+		case <-time.After(notifyRetry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// receive listens on one connection and dispatches notifications until it
+// fails. idle is called whenever no notification arrived for a while.
+func (p *PostgresNotify) receive(ctx context.Context, idle func()) error {
+	conn, err := p.db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("error acquiring connection: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{notifyChannel}.Sanitize()); err != nil {
+		return fmt.Errorf("error listening on %s: %w", notifyChannel, err)
+	}
+	defer func() {
+		// Leave the connection clean for the pool; a failed connection is
+		// discarded by Release anyway
+		unlistenCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		conn.Exec(unlistenCtx, "UNLISTEN *")
+	}()
+
+	p.logger.Info("Listening for notifications", zap.String("channel", notifyChannel))
+
+	for {
+		waitCtx, cancel := context.WithTimeout(ctx, notifyPruneInterval)
+		n, err := conn.Conn().WaitForNotification(waitCtx)
+		cancel()
+
+		if err != nil {
+			if ctx.Err() == nil && waitCtx.Err() != nil && !conn.Conn().IsClosed() {
+				idle()
+				continue
+			}
+			return err
+		}
+
+		var message notification
+		if err := json.Unmarshal([]byte(n.Payload), &message); err != nil {
+			p.logger.Error("Error unmarshaling notification", zap.Error(err))
+			continue
+		}
+
+		payload := []byte(message.Payload)
+		if message.MessageID != 0 {
+			err := p.db.QueryRow(ctx, `
+                SELECT payload FROM pubsub_messages WHERE id = $1
+            `, message.MessageID).Scan(&payload)
+			if err != nil {
+				p.logger.Error("Error loading stored message",
+					zap.Int64("message_id", message.MessageID), zap.Error(err))
+				continue
+			}
+		}
+
+		p.handlers.dispatch(message.Topic, payload)
+	}
+}
+
+func (p *PostgresNotify) prune(ctx context.Context) error {
+	_, err := p.db.Exec(ctx, `
+        DELETE FROM pubsub_messages WHERE created_at < $1
+    `, time.Now().Add(-notifyRetention))
+	if err != nil {
+		return fmt.Errorf("error deleting stored messages: %w", err)
+	}
+	return nil
+}
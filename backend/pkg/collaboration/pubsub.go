@@ -0,0 +1,208 @@
+package collaboration
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrInvalidTopicFilter  = errors.New("invalid topic filter")
+	ErrWildcardUnsupported = errors.New("transport does not support wildcard subscriptions")
+)
+
+// PubSub carries document changes and presence events between the replicas
+// serving a document. Messages are JSON encoded.
+type PubSub interface {
+	Publish(topic string, payload interface{}) error
+	// Subscribe adds a handler for the messages published on the topics
+	// matching filter and returns its ID. A filter may have any number of
+	// handlers. Filters use the MQTT wildcards: "+" matches one topic level
+	// and a trailing "#" any number of levels, as in "documents/+/presence".
+	Subscribe(filter string, handler MessageHandler) (string, error)
+	// Unsubscribe removes the handler with the given ID from filter.
+	Unsubscribe(filter, handlerID string) error
+	Close()
+}
+
+// MessageHandler handles a message published on topic.
+type MessageHandler func(topic string, payload []byte)
+
+// topicHandlers holds the handlers of every subscribed filter. The number of
+// handlers of a filter is its reference count: a transport subscribes to a
+// filter with its first handler and unsubscribes with its last.
+type topicHandlers struct {
+	handlers map[string]map[string]MessageHandler
+	// wildcards holds the subscribed filters that contain wildcards; every
+	// other filter only matches the topic equal to it.
+	wildcards map[string]bool
+	nextID    uint64
+	mutex     sync.RWMutex
+}
+
+func newTopicHandlers() *topicHandlers {
+	return &topicHandlers{
+		handlers:  make(map[string]map[string]MessageHandler),
+		wildcards: make(map[string]bool),
+	}
+}
+
+// add registers a handler and reports whether it is the first of its filter.
+func (th *topicHandlers) add(filter string, handler MessageHandler) (string, bool) {
+	th.mutex.Lock()
+	defer th.mutex.Unlock()
+
+	th.nextID++
+	id := fmt.Sprintf("%d", th.nextID)
+
+	handlers, exists := th.handlers[filter]
+	if !exists {
+		handlers = make(map[string]MessageHandler)
+		th.handlers[filter] = handlers
+		if isWildcardFilter(filter) {
+			th.wildcards[filter] = true
+		}
+	}
+	handlers[id] = handler
+	return id, !exists
+}
+
+// remove unregisters a handler and reports whether it was the last of its
+// filter.
+func (th *topicHandlers) remove(filter, id string) bool {
+	th.mutex.Lock()
+	defer th.mutex.Unlock()
+
+	handlers, exists := th.handlers[filter]
+	if !exists {
+		return false
+	}
+	if _, ok := handlers[id]; !ok {
+		return false
+	}
+	delete(handlers, id)
+	if len(handlers) > 0 {
+		return false
+	}
+	delete(th.handlers, filter)
+	delete(th.wildcards, filter)
+	return true
+}
+
+// filters returns every subscribed filter.
+func (th *topicHandlers) filters() []string {
+	th.mutex.RLock()
+	defer th.mutex.RUnlock()
+
+	filters := make([]string, 0, len(th.handlers))
+	for filter := range th.handlers {
+		filters = append(filters, filter)
+	}
+	return filters
+}
+
+// dispatch calls the handlers of every filter matching topic. They are called
+// without holding the lock, so a handler may subscribe and unsubscribe.
+func (th *topicHandlers) dispatch(topic string, payload []byte) {
+	th.mutex.RLock()
+	var handlers []MessageHandler
+	for _, handler := range th.handlers[topic] {
+		handlers = append(handlers, handler)
+	}
+	for filter := range th.wildcards {
+		if !matchTopic(filter, topic) {
+			continue
+		}
+		for _, handler := range th.handlers[filter] {
+			handlers = append(handlers, handler)
+		}
+	}
+	th.mutex.RUnlock()
+
+	for _, handler := range handlers {
+		handler(topic, payload)
+	}
+}
+
+func isWildcardFilter(filter string) bool {
+	return strings.ContainsAny(filter, "+#")
+}
+
+// validateFilter checks that wildcards occupy whole topic levels and that
+// "#" only appears as the last level.
+func validateFilter(filter string) error {
+	if filter == "" {
+		return ErrInvalidTopicFilter
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#" && i != len(levels)-1:
+			return fmt.Errorf("%w: %q has \"#\" before the last level", ErrInvalidTopicFilter, filter)
+		case level != "+" && level != "#" && isWildcardFilter(level):
+			return fmt.Errorf("%w: %q has a wildcard within a level", ErrInvalidTopicFilter, filter)
+		}
+	}
+	return nil
+}
+
+// matchTopic reports whether topic matches filter.
+func matchTopic(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// MemoryPubSub delivers messages within the process. It suits tests and
+// deployments with a single replica.
+type MemoryPubSub struct {
+	handlers *topicHandlers
+}
+
+func NewMemoryPubSub() *MemoryPubSub {
+	return &MemoryPubSub{
+		handlers: newTopicHandlers(),
+	}
+}
+
+// Publish delivers a message to the handlers of topic before returning.
+func (m *MemoryPubSub) Publish(topic string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error marshaling payload: %w", err)
+	}
+
+	m.handlers.dispatch(topic, data)
+	return nil
+}
+
+func (m *MemoryPubSub) Subscribe(filter string, handler MessageHandler) (string, error) {
+	if err := validateFilter(filter); err != nil {
+		return "", err
+	}
+
+	id, _ := m.handlers.add(filter, handler)
+	return id, nil
+}
+
+func (m *MemoryPubSub) Unsubscribe(filter, handlerID string) error {
+	m.handlers.remove(filter, handlerID)
+	return nil
+}
+
+func (m *MemoryPubSub) Close() {}
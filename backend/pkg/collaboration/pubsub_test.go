@@ -0,0 +1,220 @@
+package collaboration
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{filter: "documents/1/changes", topic: "documents/1/changes", want: true},
+		{filter: "documents/1/changes", topic: "documents/2/changes", want: false},
+		{filter: "documents/1/changes", topic: "documents/1", want: false},
+		{filter: "documents/1", topic: "documents/1/changes", want: false},
+		{filter: "documents/+/presence", topic: "documents/1/presence", want: true},
+		{filter: "documents/+/presence", topic: "documents/1/changes", want: false},
+		{filter: "documents/+/presence", topic: "documents/1/2/presence", want: false},
+		{filter: "documents/+", topic: "documents", want: false},
+		{filter: "+/+", topic: "/changes", want: true},
+		{filter: "documents/#", topic: "documents/1/changes", want: true},
+		{filter: "documents/#", topic: "documents/1", want: true},
+		// "#" also matches the parent level
+		{filter: "documents/#", topic: "documents", want: true},
+		{filter: "documents/#", topic: "users/1", want: false},
+		{filter: "documents/+/#", topic: "documents/1/presence/extra", want: true},
+		{filter: "#", topic: "anything/at/all", want: true},
+	}
+
+	for _, tt := range tests {
+		if got := matchTopic(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("matchTopic(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		valid  bool
+	}{
+		{filter: "documents/1/changes", valid: true},
+		{filter: "documents/+/presence", valid: true},
+		{filter: "documents/#", valid: true},
+		{filter: "#", valid: true},
+		{filter: "+/+/#", valid: true},
+		{filter: "documents//changes", valid: true},
+		{filter: "", valid: false},
+		{filter: "documents/#/changes", valid: false},
+		{filter: "#/changes", valid: false},
+		{filter: "documents/1#", valid: false},
+		{filter: "documents/+1/changes", valid: false},
+		{filter: "documents+", valid: false},
+	}
+
+	for _, tt := range tests {
+		err := validateFilter(tt.filter)
+		if tt.valid && err != nil {
+			t.Errorf("validateFilter(%q) error = %v, want none", tt.filter, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrInvalidTopicFilter) {
+			t.Errorf("validateFilter(%q) error = %v, want ErrInvalidTopicFilter", tt.filter, err)
+		}
+	}
+}
+
+func TestTopicHandlers(t *testing.T) {
+	th := newTopicHandlers()
+	noop := func(topic string, payload []byte) {}
+
+	first, isFirst := th.add("a", noop)
+	if !isFirst {
+		t.Errorf("first handler of a filter not reported as first")
+	}
+	second, isFirst := th.add("a", noop)
+	if isFirst {
+		t.Errorf("second handler of a filter reported as first")
+	}
+	if first == second {
+		t.Errorf("handlers got the same ID %q", first)
+	}
+	wildcard, _ := th.add("b/+", noop)
+
+	filters := th.filters()
+	sort.Strings(filters)
+	if want := []string{"a", "b/+"}; !reflect.DeepEqual(filters, want) {
+		t.Errorf("filters() = %v, want %v", filters, want)
+	}
+
+	// Unknown handlers and filters are ignored
+	if th.remove("a", "unknown") || th.remove("unknown", first) || th.remove("b/+", first) {
+		t.Errorf("remove() of an unknown handler reported the last handler")
+	}
+
+	if th.remove("a", first) {
+		t.Errorf("remove() reported the last handler with one left")
+	}
+	if !th.remove("a", second) {
+		t.Errorf("remove() did not report the last handler")
+	}
+	// Removing it again does not count twice
+	if th.remove("a", second) {
+		t.Errorf("remove() of a removed handler reported the last handler")
+	}
+	if !th.remove("b/+", wildcard) {
+		t.Errorf("remove() did not report the last wildcard handler")
+	}
+	if len(th.filters()) != 0 || len(th.wildcards) != 0 {
+		t.Errorf("filters remain after removing every handler: %v, %v", th.filters(), th.wildcards)
+	}
+
+	// The filter starts over
+	if _, isFirst := th.add("a", noop); !isFirst {
+		t.Errorf("handler added after the last was removed not reported as first")
+	}
+}
+
+func TestTopicHandlersDispatch(t *testing.T) {
+	th := newTopicHandlers()
+
+	var got []string
+	handler := func(name string) MessageHandler {
+		return func(topic string, payload []byte) {
+			got = append(got, name+" "+topic+" "+string(payload))
+		}
+	}
+	th.add("documents/1/changes", handler("exact"))
+	th.add("documents/+/changes", handler("plus"))
+	th.add("documents/#", handler("hash"))
+	th.add("documents/2/changes", handler("other"))
+
+	th.dispatch("documents/1/changes", []byte("x"))
+	sort.Strings(got)
+	want := []string{
+		"exact documents/1/changes x",
+		"hash documents/1/changes x",
+		"plus documents/1/changes x",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dispatched %v, want %v", got, want)
+	}
+
+	// A handler may unsubscribe itself while being called
+	var id string
+	calls := 0
+	id, _ = th.add("self", func(topic string, payload []byte) {
+		calls++
+		th.remove("self", id)
+	})
+	th.dispatch("self", nil)
+	th.dispatch("self", nil)
+	if calls != 1 {
+		t.Errorf("handler called %d times, want 1", calls)
+	}
+}
+
+func TestMemoryPubSub(t *testing.T) {
+	ps := NewMemoryPubSub()
+	defer ps.Close()
+
+	got := map[string][]string{}
+	handler := func(name string) MessageHandler {
+		return func(topic string, payload []byte) {
+			got[name] = append(got[name], topic+" "+string(payload))
+		}
+	}
+
+	exact, err := ps.Subscribe("documents/1/presence", handler("exact"))
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	if _, err := ps.Subscribe("documents/+/presence", handler("first")); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	if _, err := ps.Subscribe("documents/+/presence", handler("second")); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	if _, err := ps.Subscribe("documents/a/b", handler("other")); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+
+	if err := ps.Publish("documents/1/presence", map[string]int{"version": 3}); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if err := ps.Publish("documents/2/presence", "typing"); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	want := map[string][]string{
+		"exact":  {`documents/1/presence {"version":3}`},
+		"first":  {`documents/1/presence {"version":3}`, `documents/2/presence "typing"`},
+		"second": {`documents/1/presence {"version":3}`, `documents/2/presence "typing"`},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("delivered %v, want %v", got, want)
+	}
+
+	// Nothing reaches a handler after it unsubscribes
+	if err := ps.Unsubscribe("documents/1/presence", exact); err != nil {
+		t.Fatalf("Unsubscribe() error = %v", err)
+	}
+	got = map[string][]string{}
+	if err := ps.Publish("documents/1/presence", nil); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if _, ok := got["exact"]; ok || len(got["first"]) != 1 || len(got["second"]) != 1 {
+		t.Errorf("delivered %v after unsubscribing exact", got)
+	}
+
+	if _, err := ps.Subscribe("documents/#/presence", handler("invalid")); !errors.Is(err, ErrInvalidTopicFilter) {
+		t.Errorf("Subscribe() error = %v, want ErrInvalidTopicFilter", err)
+	}
+	if err := ps.Publish("documents/1/presence", make(chan int)); err == nil {
+		t.Errorf("Publish() of an unmarshalable payload succeeded")
+	}
+}
@@ -0,0 +1,260 @@
+package collaboration
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HardMax71/syncwrite/backend/pkg/utils"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Every topic is a Redis stream that each replica reads on its own, so every
+// replica sees every message. Streams are trimmed to roughly streamMaxLen
+// entries; a reader is never that far behind. Since a reader has to name the
+// streams it reads, filters cannot contain wildcards.
+//
+// A replica reads all of its streams with a single blocking XREAD, so it holds
+// one connection of the Redis pool however many topics it subscribes to. The
+// read also covers a wake stream of the replica, which Subscribe adds to so
+// the read starts over with the new topic.
+
+const (
+	streamMaxLen    = 1000
+	streamReadCount = 100
+	streamBlock     = 5 * time.Second
+	streamRetry     = time.Second
+)
+
+func streamKey(topic string) string {
+	return fmt.Sprintf("pubsub:%s", topic)
+}
+
+// RedisStreams is a PubSub backed by Redis streams.
+type RedisStreams struct {
+	redis    *redis.Client
+	logger   *zap.Logger
+	handlers *topicHandlers
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wakeKey  string
+	// offsets holds the ID of the last message read from every subscribed
+	// topic.
+	offsets map[string]string
+	mutex   sync.Mutex
+}
+
+func NewRedisStreams(client *redis.Client) *RedisStreams {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &RedisStreams{
+		redis:    client,
+		logger:   utils.Logger(),
+		handlers: newTopicHandlers(),
+		ctx:      ctx,
+		cancel:   cancel,
+		wakeKey:  fmt.Sprintf("pubsub-wake:%s", NewConnectionID()),
+		offsets:  make(map[string]string),
+	}
+	go r.read()
+	return r
+}
+
+func (r *RedisStreams) Publish(topic string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error marshaling payload: %w", err)
+	}
+
+	err = r.redis.XAdd(r.ctx, &redis.XAddArgs{
+		Stream: streamKey(topic),
+		MaxLen: streamMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{"payload": data},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("error publishing to stream: %w", err)
+	}
+	return nil
+}
+
+// Subscribe adds a handler for topic. The first handler of a topic starts
+// reading its stream from the latest message, so the handler receives every
+// message published after Subscribe returns.
+func (r *RedisStreams) Subscribe(topic string, handler MessageHandler) (string, error) {
+	if err := validateFilter(topic); err != nil {
+		return "", err
+	}
+	if isWildcardFilter(topic) {
+		return "", fmt.Errorf("%w: %s", ErrWildcardUnsupported, topic)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	id, first := r.handlers.add(topic, handler)
+	if !first {
+		return id, nil
+	}
+
+	lastID, err := r.lastMessageID(topic)
+	if err != nil {
+		r.handlers.remove(topic, id)
+		return "", err
+	}
+	r.offsets[topic] = lastID
+
+	// Without waking it, the reader would only pick up the topic once its
+	// current read times out
+	err = r.redis.XAdd(r.ctx, &redis.XAddArgs{
+		Stream: r.wakeKey,
+		MaxLen: 1,
+		Values: map[string]interface{}{"topic": topic},
+	}).Err()
+	if err != nil {
+		r.logger.Error("Error waking stream reader", zap.String("topic", topic), zap.Error(err))
+	}
+
+	return id, nil
+}
+
+// Unsubscribe removes a handler from topic. The last handler of a topic stops
+// reading its stream.
+func (r *RedisStreams) Unsubscribe(topic, handlerID string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.handlers.remove(topic, handlerID) {
+		delete(r.offsets, topic)
+	}
+	return nil
+}
+
+func (r *RedisStreams) Close() {
+	r.cancel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), streamRetry)
+	defer cancel()
+	if err := r.redis.Del(ctx, r.wakeKey).Err(); err != nil {
+		r.logger.Error("Error deleting wake stream", zap.Error(err))
+	}
+}
+
+func (r *RedisStreams) lastMessageID(topic string) (string, error) {
+	messages, err := r.redis.XRevRangeN(r.ctx, streamKey(topic), "+", "-", 1).Result()
+	if err != nil {
+		return "", fmt.Errorf("error reading stream: %w", err)
+	}
+	if len(messages) == 0 {
+		return "0-0", nil
+	}
+	return messages[0].ID, nil
+}
+
+// read reads the streams of every subscribed topic until the PubSub is
+// closed.
+func (r *RedisStreams) read() {
+	wakeID := "0-0"
+
+	for {
+		// The wake stream comes first, followed by every subscribed topic
+		r.mutex.Lock()
+		topics := make(map[string]string, len(r.offsets))
+		keys := []string{r.wakeKey}
+		ids := []string{wakeID}
+		for topic, offset := range r.offsets {
+			topics[streamKey(topic)] = topic
+			keys = append(keys, streamKey(topic))
+			ids = append(ids, offset)
+		}
+		r.mutex.Unlock()
+
+		streams, err := r.redis.XRead(r.ctx, &redis.XReadArgs{
+			Streams: append(keys, ids...),
+			Count:   streamReadCount,
+			Block:   streamBlock,
+		}).Result()
+
+		if r.ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			r.logger.Error("Error reading streams", zap.Error(err))
+			select {
+			case <-time.After(streamRetry):
+				continue
+			case <-r.ctx.Done():
+				return
+			}
+		}
+
+		for _, stream := range streams {
+			if stream.Stream == r.wakeKey {
+				if len(stream.Messages) > 0 {
+					wakeID = stream.Messages[len(stream.Messages)-1].ID
+				}
+				continue
+			}
+			if topic, ok := topics[stream.Stream]; ok {
+				r.dispatch(topic, stream.Messages)
+			}
+		}
+	}
+}
+
+// dispatch hands the messages read from the stream of topic to its handlers.
+// Messages are dropped once the topic was unsubscribed, or subscribed anew
+// from a later message, while they were being read.
+func (r *RedisStreams) dispatch(topic string, messages []redis.XMessage) {
+	for _, message := range messages {
+		if r.ctx.Err() != nil {
+			return
+		}
+
+		r.mutex.Lock()
+		offset, subscribed := r.offsets[topic]
+		current := subscribed && compareStreamIDs(offset, message.ID) < 0
+		if current {
+			r.offsets[topic] = message.ID
+		}
+		r.mutex.Unlock()
+		if !current {
+			continue
+		}
+
+		payload, ok := message.Values["payload"].(string)
+		if !ok {
+			r.logger.Error("Stream message without payload",
+				zap.String("topic", topic), zap.String("id", message.ID))
+			continue
+		}
+		r.handlers.dispatch(topic, []byte(payload))
+	}
+}
+
+// compareStreamIDs compares two stream entry IDs, which are a millisecond
+// time and a sequence number.
+func compareStreamIDs(a, b string) int {
+	aTime, aSeq := parseStreamID(a)
+	bTime, bSeq := parseStreamID(b)
+	if aTime != bTime {
+		return cmp.Compare(aTime, bTime)
+	}
+	return cmp.Compare(aSeq, bSeq)
+}
+
+func parseStreamID(id string) (uint64, uint64) {
+	timePart, seqPart, _ := strings.Cut(id, "-")
+	ms, _ := strconv.ParseUint(timePart, 10, 64)
+	seq, _ := strconv.ParseUint(seqPart, 10, 64)
+	return ms, seq
+}
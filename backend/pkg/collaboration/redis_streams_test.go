@@ -0,0 +1,25 @@
+package collaboration
+
+import "testing"
+
+func TestCompareStreamIDs(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{a: "1700000000000-0", b: "1700000000000-0", want: 0},
+		{a: "1700000000000-1", b: "1700000000000-2", want: -1},
+		{a: "1700000000000-10", b: "1700000000000-9", want: 1},
+		{a: "1700000000000-5", b: "1700000000001-0", want: -1},
+		// Compared as numbers, not strings
+		{a: "999-0", b: "1000-0", want: -1},
+		{a: "0-0", b: "1-0", want: -1},
+		{a: "5", b: "5-0", want: 0},
+	}
+
+	for _, tt := range tests {
+		if got := compareStreamIDs(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareStreamIDs(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -8,41 +8,164 @@ import (
 	"sync"
 	"time"
 
+	"github.com/HardMax71/syncwrite/backend/pkg/document"
 	"github.com/HardMax71/syncwrite/backend/pkg/utils"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 )
 
 var (
-	ErrSessionNotFound = errors.New("session not found")
-	ErrUserNotFound    = errors.New("user not found")
+	ErrSessionNotFound    = errors.New("session not found")
+	ErrUserNotFound       = errors.New("user not found")
+	ErrHistoryUnavailable = errors.New("change history unavailable")
 )
 
+// Service serves collaboration sessions. Several replicas may serve the same
+// document: sessions live in Redis, changes and presence fan out to every
+// replica over the PubSub transport, and edits are sequenced by Postgres. Every
+// edit locks the row of its document with SELECT ... FOR UPDATE before reading
+// its version, so edits from any replica commit one version at a time.
+// Selections carry the version they point into, and are moved through every
+// change after it, so presence stays on the same text even when the
+// transforms of consecutive changes run out of order.
 type Service struct {
-	db            *pgxpool.Pool
-	logger        *zap.Logger
-	mqtt          *MQTTClient
-	sessionMgr    *SessionManager
-	changeStreams map[string]map[string]chan *DocumentChange
-	streamsMutex  sync.RWMutex
+	db              *pgxpool.Pool
+	logger          *zap.Logger
+	pubsub          PubSub
+	sessionMgr      *SessionManager
+	outbox          *OutboxRelay
+	compactor       *HistoryCompactor
+	checkpointer    *Checkpointer
+	changeStreams   map[string]map[string]*ChangeSubscription
+	presenceStreams map[string]map[string]chan *PresenceEvent
+	streamsMutex    sync.RWMutex
+	// localSessions holds the sessions this replica serves connections of,
+	// by document. The replica is subscribed to the topics of a document
+	// while it serves a connection or change stream of it.
+	localSessions map[string]*localSession
+	localMutex    sync.Mutex
 }
 
-func NewService(db *pgxpool.Pool, mqtt *MQTTClient) *Service {
+type localSession struct {
+	connections map[string]bool
+	// streams counts the change streams open on this replica, which need the
+	// changes of the document whether or not their client joined the session
+	// here
+	streams         int
+	changeHandler   string
+	presenceHandler string
+}
+
+func NewService(db *pgxpool.Pool, pubsub PubSub, redisClient *redis.Client) *Service {
 	return &Service{
-		db:            db,
-		logger:        utils.Logger(),
-		mqtt:          mqtt,
-		sessionMgr:    NewSessionManager(),
-		changeStreams: make(map[string]map[string]chan *DocumentChange),
+		db:              db,
+		logger:          utils.Logger(),
+		pubsub:          pubsub,
+		sessionMgr:      NewSessionManager(redisClient),
+		outbox:          NewOutboxRelay(db, pubsub),
+		compactor:       NewHistoryCompactor(db),
+		checkpointer:    NewCheckpointer(db),
+		changeStreams:   make(map[string]map[string]*ChangeSubscription),
+		presenceStreams: make(map[string]map[string]chan *PresenceEvent),
+		localSessions:   make(map[string]*localSession),
+	}
+}
+
+func (s *Service) JoinSession(ctx context.Context, documentID string, user *ActiveUser) ([]*ActiveUser, error) {
+	user.Presence.Color = PresenceColor(user.UserID)
+
+	if err := s.sessionMgr.AddUser(ctx, documentID, user); err != nil {
+		return nil, err
+	}
+
+	if err := s.addLocalConnection(documentID, user.ConnectionID); err != nil {
+		if _, err := s.sessionMgr.RemoveConnection(ctx, documentID, user.ConnectionID, user.UserID); err != nil {
+			s.logger.Error("Error removing connection from session", zap.Error(err))
+		}
+		return nil, err
+	}
+
+	// Notify other users about the new user
+	presenceUpdate := &PresenceEvent{
+		Type:         PresenceEventJoin,
+		UserID:       user.UserID,
+		ConnectionID: user.ConnectionID,
+		User:         user,
+	}
+	if err := s.pubsub.Publish(GetPresenceTopic(documentID), presenceUpdate); err != nil {
+		s.logger.Error("Error publishing presence update", zap.Error(err))
+	}
+
+	return s.sessionMgr.GetActiveUsers(ctx, documentID)
+}
+
+// addLocalConnection records a connection served by this replica.
+func (s *Service) addLocalConnection(documentID, connectionID string) error {
+	s.localMutex.Lock()
+	defer s.localMutex.Unlock()
+
+	session, err := s.openLocalSession(documentID)
+	if err != nil {
+		return err
 	}
+	session.connections[connectionID] = true
+	return nil
+}
+
+// dropLocalConnection ends the presence stream of a connection that left a
+// session and forgets the connection.
+func (s *Service) dropLocalConnection(documentID, connectionID string) {
+	s.endPresenceStream(documentID, connectionID)
+
+	s.localMutex.Lock()
+	defer s.localMutex.Unlock()
+
+	session, exists := s.localSessions[documentID]
+	if !exists || !session.connections[connectionID] {
+		return
+	}
+	delete(session.connections, connectionID)
+	s.closeLocalSession(documentID, session)
+}
+
+// addLocalStream records a change stream served by this replica.
+func (s *Service) addLocalStream(documentID string) error {
+	s.localMutex.Lock()
+	defer s.localMutex.Unlock()
+
+	session, err := s.openLocalSession(documentID)
+	if err != nil {
+		return err
+	}
+	session.streams++
+	return nil
+}
+
+// dropLocalStream forgets a change stream that ended.
+func (s *Service) dropLocalStream(documentID string) {
+	s.localMutex.Lock()
+	defer s.localMutex.Unlock()
+
+	session, exists := s.localSessions[documentID]
+	if !exists || session.streams == 0 {
+		return
+	}
+	session.streams--
+	s.closeLocalSession(documentID, session)
 }
 
-func (s *Service) JoinSession(documentID string, user *ActiveUser) ([]*ActiveUser, error) {
-	session := s.sessionMgr.GetOrCreateSession(documentID)
-	session.AddUser(user)
+// openLocalSession returns the local session of a document. The first local
+// connection or stream of a document subscribes to its topics. The caller
+// must hold localMutex.
+func (s *Service) openLocalSession(documentID string) (*localSession, error) {
+	if session, exists := s.localSessions[documentID]; exists {
+		return session, nil
+	}
 
 	// Subscribe to document changes
-	err := s.mqtt.Subscribe(GetDocumentTopic(documentID), func(payload []byte) {
+	changeHandler, err := s.pubsub.Subscribe(GetDocumentTopic(documentID), func(topic string, payload []byte) {
 		var change DocumentChange
 		if err := json.Unmarshal(payload, &change); err != nil {
 			s.logger.Error("Error unmarshaling document change", zap.Error(err))
@@ -55,178 +178,785 @@ func (s *Service) JoinSession(documentID string, user *ActiveUser) ([]*ActiveUse
 		return nil, fmt.Errorf("error subscribing to document changes: %w", err)
 	}
 
-	// Notify other users about the new user
-	presenceUpdate := map[string]interface{}{
-		"type": "join",
-		"user": user,
+	// Subscribe to presence updates
+	presenceHandler, err := s.pubsub.Subscribe(GetPresenceTopic(documentID), func(topic string, payload []byte) {
+		var event PresenceEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			s.logger.Error("Error unmarshaling presence update", zap.Error(err))
+			return
+		}
+		s.broadcastPresence(documentID, &event)
+
+		// A connection of this replica may have been removed by another
+		// replica, e.g. by its reaper. Unsubscribing may wait for a broker,
+		// so it must not block the message handler.
+		if event.Type == PresenceEventLeave {
+			go s.dropLocalConnection(documentID, event.ConnectionID)
+		}
+	})
+
+	if err != nil {
+		if err := s.pubsub.Unsubscribe(GetDocumentTopic(documentID), changeHandler); err != nil {
+			s.logger.Error("Error unsubscribing from document topic", zap.Error(err))
+		}
+		return nil, fmt.Errorf("error subscribing to presence updates: %w", err)
 	}
-	if err := s.mqtt.Publish(GetPresenceTopic(documentID), presenceUpdate); err != nil {
-		s.logger.Error("Error publishing presence update", zap.Error(err))
+
+	session := &localSession{
+		connections:     make(map[string]bool),
+		changeHandler:   changeHandler,
+		presenceHandler: presenceHandler,
+	}
+	s.localSessions[documentID] = session
+	return session, nil
+}
+
+// closeLocalSession unsubscribes from the topics of a document once this
+// replica serves no connection or stream of it. The caller must hold
+// localMutex.
+func (s *Service) closeLocalSession(documentID string, session *localSession) {
+	if len(session.connections) > 0 || session.streams > 0 {
+		return
 	}
 
-	return session.GetActiveUsers(), nil
+	delete(s.localSessions, documentID)
+	if err := s.pubsub.Unsubscribe(GetDocumentTopic(documentID), session.changeHandler); err != nil {
+		s.logger.Error("Error unsubscribing from document topic", zap.Error(err))
+	}
+	if err := s.pubsub.Unsubscribe(GetPresenceTopic(documentID), session.presenceHandler); err != nil {
+		s.logger.Error("Error unsubscribing from presence topic", zap.Error(err))
+	}
 }
 
-func (s *Service) LeaveSession(documentID, userID string) error {
-	session := s.sessionMgr.GetOrCreateSession(documentID)
-	session.RemoveUser(userID)
+// LeaveSession removes a connection of userID from the session of a
+// document. An empty connectionID removes every connection of the user, on
+// any replica.
+func (s *Service) LeaveSession(ctx context.Context, documentID, userID, connectionID string) error {
+	var removed []*ActiveUser
+	if connectionID == "" {
+		users, err := s.sessionMgr.RemoveUser(ctx, documentID, userID)
+		if err != nil {
+			return err
+		}
+		removed = users
+	} else {
+		user, err := s.sessionMgr.RemoveConnection(ctx, documentID, connectionID, userID)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return ErrSessionNotFound
+		}
+		removed = []*ActiveUser{user}
+	}
 
-	// If no users left, remove the session and unsubscribe from MQTT topics
-	if len(session.GetActiveUsers()) == 0 {
-		s.sessionMgr.RemoveSession(documentID)
-		if err := s.mqtt.Unsubscribe(GetDocumentTopic(documentID)); err != nil {
-			s.logger.Error("Error unsubscribing from document topic", zap.Error(err))
+	s.endConnections(ctx, documentID, removed)
+	return nil
+}
+
+// Heartbeat keeps a connection of userID in the session of a document. It
+// fails with ErrSessionNotFound once the connection has been evicted, after
+// which the client has to join again.
+func (s *Service) Heartbeat(ctx context.Context, documentID, userID, connectionID string) error {
+	found, err := s.sessionMgr.Touch(ctx, documentID, connectionID, userID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// StartOutboxRelay broadcasts committed changes from the outbox, polling
+// every interval until ctx is done. Broadcasts are kept for retention after
+// delivery.
+func (s *Service) StartOutboxRelay(ctx context.Context, interval, retention time.Duration) {
+	s.outbox.Start(ctx, interval, retention)
+}
+
+// StartHistoryCompactor folds logged changes older than retention into
+// snapshots, every interval until ctx is done.
+func (s *Service) StartHistoryCompactor(ctx context.Context, interval, retention time.Duration) {
+	s.compactor.Start(ctx, interval, retention)
+}
+
+// StartCheckpointer adds automatic versions of live-edited documents to their
+// version history after maxChanges changes, once they have been idle for
+// idleTimeout, and when the last user leaves their session.
+func (s *Service) StartCheckpointer(ctx context.Context, maxChanges int, idleTimeout time.Duration) {
+	s.checkpointer.Start(ctx, maxChanges, idleTimeout)
+}
+
+// StartPresenceReaper evicts connections without a heartbeat or other
+// activity for timeout, checking every interval until ctx is done.
+func (s *Service) StartPresenceReaper(ctx context.Context, interval, timeout time.Duration) {
+	s.sessionMgr.StartReaper(ctx, interval, timeout, func(documentID string, evicted []*ActiveUser) {
+		for _, user := range evicted {
+			s.logger.Info("Evicting idle connection",
+				zap.String("document_id", documentID),
+				zap.String("user_id", user.UserID),
+				zap.String("connection_id", user.ConnectionID))
+		}
+		s.endConnections(ctx, documentID, evicted)
+	})
+}
+
+// endConnections announces connections that left a session. Connections
+// served by other replicas are ended there when the announcement arrives.
+// Once the session is empty the document is checkpointed.
+func (s *Service) endConnections(ctx context.Context, documentID string, users []*ActiveUser) {
+	// Notify other users about the connections leaving
+	for _, user := range users {
+		s.dropLocalConnection(documentID, user.ConnectionID)
+
+		presenceUpdate := &PresenceEvent{
+			Type:         PresenceEventLeave,
+			UserID:       user.UserID,
+			ConnectionID: user.ConnectionID,
+		}
+		if err := s.pubsub.Publish(GetPresenceTopic(documentID), presenceUpdate); err != nil {
+			s.logger.Error("Error publishing presence update", zap.Error(err))
 		}
 	}
 
-	// Notify other users about the user leaving
-	presenceUpdate := map[string]interface{}{
-		"type":    "leave",
-		"user_id": userID,
+	remaining, err := s.sessionMgr.GetActiveUsers(ctx, documentID)
+	if err != nil {
+		s.logger.Error("Error getting active users", zap.Error(err))
+		return
 	}
-	if err := s.mqtt.Publish(GetPresenceTopic(documentID), presenceUpdate); err != nil {
-		s.logger.Error("Error publishing presence update", zap.Error(err))
+	if len(remaining) == 0 {
+		s.checkpointer.Flush(documentID)
 	}
+}
 
-	return nil
+func (s *Service) GetActiveUsers(ctx context.Context, documentID string) ([]*ActiveUser, error) {
+	return s.sessionMgr.GetActiveUsers(ctx, documentID)
 }
 
-func (s *Service) GetActiveUsers(documentID string) ([]*ActiveUser, error) {
-	session := s.sessionMgr.GetOrCreateSession(documentID)
-	return session.GetActiveUsers(), nil
+// UpdatePresence records the presence of a connection of userID and publishes
+// it on the presence topic. Selections made against an older version of an OT
+// document are first transformed through the changes committed since, so
+// they point at the same text in the current version.
+func (s *Service) UpdatePresence(ctx context.Context, documentID, userID, connectionID string, presence Presence) (Presence, error) {
+	if presence.Version > 0 && len(presence.Selections) > 0 {
+		changes, err := s.ChangesSince(ctx, documentID, presence.Version)
+		switch {
+		case err == nil:
+			for _, change := range changes {
+				presence.Selections = TransformSelections(presence.Selections, change.Operations)
+				presence.Version = change.Version
+			}
+		case errors.Is(err, document.ErrVersionMismatch):
+			return Presence{}, err
+		default:
+			// Positions that cannot be transformed are still better than none
+			s.logger.Debug("Publishing untransformed selections",
+				zap.String("document_id", documentID), zap.Error(err))
+		}
+	}
+
+	presence, found, err := s.sessionMgr.UpdatePresence(ctx, documentID, connectionID, userID, presence)
+	if err != nil {
+		return Presence{}, err
+	}
+	if !found {
+		return Presence{}, ErrSessionNotFound
+	}
+
+	// Publish presence update
+	update := &PresenceEvent{
+		Type:         PresenceEventUpdate,
+		UserID:       userID,
+		ConnectionID: connectionID,
+		Presence:     &presence,
+	}
+	if err := s.pubsub.Publish(GetPresenceTopic(documentID), update); err != nil {
+		return Presence{}, fmt.Errorf("error publishing presence update: %w", err)
+	}
+
+	return presence, nil
 }
 
-func (s *Service) UpdateUserActivity(documentID, userID, cursorPosition string) error {
-	session := s.sessionMgr.GetOrCreateSession(documentID)
-	session.UpdateUserActivity(userID, cursorPosition)
+// endPresenceStream closes the presence stream of a connection that left the
+// session, which ends the Collaborate stream serving it.
+func (s *Service) endPresenceStream(documentID, connectionID string) {
+	s.streamsMutex.Lock()
+	defer s.streamsMutex.Unlock()
 
-	// Publish cursor position update
-	update := map[string]interface{}{
-		"type":            "cursor",
-		"user_id":         userID,
-		"cursor_position": cursorPosition,
+	if streams, exists := s.presenceStreams[documentID]; exists {
+		if ch, ok := streams[connectionID]; ok {
+			close(ch)
+			delete(streams, connectionID)
+		}
+		if len(streams) == 0 {
+			delete(s.presenceStreams, documentID)
+		}
 	}
-	return s.mqtt.Publish(GetPresenceTopic(documentID), update)
 }
 
-func (s *Service) StreamChanges(documentID, userID string) (<-chan *DocumentChange, func(), error) {
+// StreamChanges subscribes a connection of userID to the changes of a
+// document. The replica stays subscribed to the document topic while the
+// stream is open, even if the client joined the session on another replica.
+func (s *Service) StreamChanges(documentID, userID, connectionID string) (*ChangeSubscription, func(), error) {
+	if err := s.addLocalStream(documentID); err != nil {
+		return nil, nil, err
+	}
+
 	s.streamsMutex.Lock()
 	defer s.streamsMutex.Unlock()
 
 	if _, exists := s.changeStreams[documentID]; !exists {
-		s.changeStreams[documentID] = make(map[string]chan *DocumentChange)
+		s.changeStreams[documentID] = make(map[string]*ChangeSubscription)
+	}
+
+	// A connection streams changes once; a stream it reopened replaces the
+	// previous one, which is ended
+	if previous, ok := s.changeStreams[documentID][connectionID]; ok {
+		close(previous.changes)
+	}
+
+	subscription := newChangeSubscription(userID, connectionID)
+	s.changeStreams[documentID][connectionID] = subscription
+
+	cleanup := func() {
+		s.streamsMutex.Lock()
+		if streams, exists := s.changeStreams[documentID]; exists {
+			if sub, ok := streams[connectionID]; ok && sub == subscription {
+				close(sub.changes)
+				delete(streams, connectionID)
+			}
+			if len(streams) == 0 {
+				delete(s.changeStreams, documentID)
+			}
+		}
+		s.streamsMutex.Unlock()
+
+		// Unsubscribing may wait for a broker, so it happens without holding
+		// streamsMutex, which broadcasts need
+		s.dropLocalStream(documentID)
+	}
+
+	return subscription, cleanup, nil
+}
+
+// StreamStats returns the backlog of every change stream of a document.
+func (s *Service) StreamStats(documentID string) []StreamStats {
+	s.streamsMutex.RLock()
+	defer s.streamsMutex.RUnlock()
+
+	stats := make([]StreamStats, 0, len(s.changeStreams[documentID]))
+	for _, sub := range s.changeStreams[documentID] {
+		stats = append(stats, sub.stats())
+	}
+	return stats
+}
+
+// StreamPresence subscribes a connection to the presence events of a
+// document.
+func (s *Service) StreamPresence(documentID, connectionID string) (<-chan *PresenceEvent, func(), error) {
+	s.streamsMutex.Lock()
+	defer s.streamsMutex.Unlock()
+
+	if _, exists := s.presenceStreams[documentID]; !exists {
+		s.presenceStreams[documentID] = make(map[string]chan *PresenceEvent)
+	}
+
+	// As with change streams, a reopened stream ends the previous one
+	if previous, ok := s.presenceStreams[documentID][connectionID]; ok {
+		close(previous)
 	}
 
-	changeChan := make(chan *DocumentChange, 100)
-	s.changeStreams[documentID][userID] = changeChan
+	presenceChan := make(chan *PresenceEvent, 100)
+	s.presenceStreams[documentID][connectionID] = presenceChan
 
 	cleanup := func() {
 		s.streamsMutex.Lock()
 		defer s.streamsMutex.Unlock()
 
-		if streams, exists := s.changeStreams[documentID]; exists {
-			if ch, ok := streams[userID]; ok {
+		if streams, exists := s.presenceStreams[documentID]; exists {
+			if ch, ok := streams[connectionID]; ok && ch == presenceChan {
 				close(ch)
-				delete(streams, userID)
+				delete(streams, connectionID)
 			}
 			if len(streams) == 0 {
-				delete(s.changeStreams, documentID)
+				delete(s.presenceStreams, documentID)
 			}
 		}
 	}
 
-	return changeChan, cleanup, nil
+	return presenceChan, cleanup, nil
 }
 
-func (s *Service) SyncDocument(ctx context.Context, documentID string, operations []Operation, baseVersion string) (string, []*DocumentChange, error) {
+// SyncDocument commits operations that the client produced against
+// baseVersion. Changes committed since baseVersion are transformed against the
+// incoming operations, so a stale client no longer has to retry: the returned
+// change carries the operations as they were committed, and the concurrent
+// changes are returned transformed so they can be applied on top of the
+// client's local state.
+func (s *Service) SyncDocument(ctx context.Context, documentID, userID string, operations []Operation, baseVersion int64) (*DocumentChange, []*DocumentChange, error) {
 	// Start transaction
 	tx, err := s.db.Begin(ctx)
 	if err != nil {
-		return "", nil, fmt.Errorf("error starting transaction: %w", err)
+		return nil, nil, fmt.Errorf("error starting transaction: %w", err)
 	}
 	defer tx.Rollback(ctx)
 
-	// Check current version
-	var currentVersion string
+	// Lock the document so concurrent syncs are sequenced one at a time
+	var currentVersion int64
+	var content, syncMode string
+	var authorship []byte
 	err = tx.QueryRow(ctx, `
-        SELECT version FROM documents WHERE id = $1
-    `, documentID).Scan(&currentVersion)
+        SELECT version, COALESCE(content, ''), sync_mode, authorship FROM documents WHERE id = $1 FOR UPDATE
+    `, documentID).Scan(&currentVersion, &content, &syncMode, &authorship)
 
 	if err != nil {
-		return "", nil, fmt.Errorf("error getting current version: %w", err)
+		return nil, nil, fmt.Errorf("error getting current version: %w", err)
 	}
 
+	if syncMode != document.SyncModeOT {
+		return nil, nil, ErrSyncModeMismatch
+	}
+
+	if baseVersion > currentVersion {
+		return nil, nil, document.ErrVersionMismatch
+	}
+
+	var concurrentChanges []*DocumentChange
 	if currentVersion != baseVersion {
 		// Get concurrent changes
-		rows, err := tx.Query(ctx, `
-            SELECT content FROM document_versions
-            WHERE document_id = $1 AND version > $2
-            ORDER BY created_at ASC
-        `, documentID, baseVersion)
+		concurrentChanges, err = loadChanges(ctx, tx, documentID, baseVersion, currentVersion)
 		if err != nil {
-			return "", nil, fmt.Errorf("error getting concurrent changes: %w", err)
+			return nil, nil, err
 		}
-		defer rows.Close()
-
-		var concurrentChanges []*DocumentChange
-		for rows.Next() {
-			var content string
-			if err := rows.Scan(&content); err != nil {
-				return "", nil, fmt.Errorf("error scanning concurrent change: %w", err)
-			}
 
-			var change DocumentChange
-			if err := json.Unmarshal([]byte(content), &change); err != nil {
-				return "", nil, fmt.Errorf("error unmarshaling concurrent change: %w", err)
-			}
-			concurrentChanges = append(concurrentChanges, &change)
+		// Transform the incoming operations past every concurrent change, and
+		// each concurrent change past the incoming operations
+		for _, concurrent := range concurrentChanges {
+			operations, concurrent.Operations = TransformOperations(operations, concurrent.Operations)
 		}
+	}
 
-		return currentVersion, concurrentChanges, nil
+	// Apply changes to the canonical text and create new version
+	newContent, err := ApplyOperations(content, operations)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// Apply changes and create new version
-	newVersion := fmt.Sprintf("%d", time.Now().UnixNano())
 	change := &DocumentChange{
 		DocumentID: documentID,
-		Version:    newVersion,
+		UserID:     userID,
+		Version:    currentVersion + 1,
 		Operations: operations,
 		Timestamp:  time.Now(),
 	}
 
 	changeJSON, err := json.Marshal(change)
 	if err != nil {
-		return "", nil, fmt.Errorf("error marshaling change: %w", err)
+		return nil, nil, fmt.Errorf("error marshaling change: %w", err)
 	}
 
-	// Update document version
+	newAuthorship, err := json.Marshal(spliceAuthorship(
+		document.LoadAuthorship(authorship, content), operations, userID, change.Timestamp))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshaling authorship: %w", err)
+	}
+
+	// Update document content, authorship and version
 	_, err = tx.Exec(ctx, `
-        UPDATE documents SET version = $1 WHERE id = $2
-    `, newVersion, documentID)
+        UPDATE documents SET content = $1, authorship = $2, version = $3, updated_at = NOW() WHERE id = $4
+    `, newContent, newAuthorship, change.Version, documentID)
 	if err != nil {
-		return "", nil, fmt.Errorf("error updating document version: %w", err)
+		return nil, nil, fmt.Errorf("error updating document: %w", err)
+	}
+
+	// Append the change to the operation log
+	if err := recordChange(ctx, tx, change, changeJSON); err != nil {
+		return nil, nil, err
+	}
+
+	// Queue the broadcast with the change, so a committed change is always
+	// broadcast
+	if err := s.queueBroadcast(ctx, tx, change, changeJSON); err != nil {
+		return nil, nil, err
+	}
+
+	// Commit transaction
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	// Keep the selections of connected users on the same text
+	if err := s.transformPresence(ctx, documentID, change); err != nil {
+		s.logger.Error("Error transforming presence", zap.Error(err))
 	}
 
-	// Store change in version history
+	// Have the outbox relay broadcast the change to all connected clients
+	s.outbox.Notify()
+	s.checkpointer.Record(documentID)
+
+	return change, concurrentChanges, nil
+}
+
+// transformPresence moves the presence of every connection that refers to a
+// version before change through the changes logged since. Transforms run after
+// their commit, so they may run out of order: a presence can be several
+// versions behind, and one already moved past change is left alone.
+func (s *Service) transformPresence(ctx context.Context, documentID string, change *DocumentChange) error {
+	users, err := s.sessionMgr.GetActiveUsers(ctx, documentID)
+	if err != nil {
+		return err
+	}
+
+	from := change.Version - 1
+	for _, user := range users {
+		from = min(from, user.Presence.Version)
+	}
+
+	changes := []*DocumentChange{change}
+	if from < change.Version-1 {
+		loaded, err := loadChanges(ctx, s.db, documentID, from, change.Version)
+		switch {
+		case err == nil:
+			changes = loaded
+		case !errors.Is(err, ErrHistoryUnavailable):
+			return err
+		}
+	}
+
+	return s.sessionMgr.TransformPresence(ctx, documentID, changes)
+}
+
+// MergeOperations integrates CRDT operations into a document in CRDT sync
+// mode. Operations may arrive in any order across clients and may be
+// redelivered; already applied operations are ignored. It returns the
+// operations the caller is missing according to stateVector, followed by the
+// document's state vector after the merge.
+func (s *Service) MergeOperations(ctx context.Context, documentID, userID string, operations []CRDTOperation, stateVector StateVector) ([]CRDTOperation, StateVector, error) {
+	// Start transaction
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the document so concurrent merges are sequenced one at a time
+	var currentVersion int64
+	var content, syncMode string
+	var state, authorship []byte
+	err = tx.QueryRow(ctx, `
+        SELECT version, COALESCE(content, ''), sync_mode, crdt_state, authorship
+        FROM documents WHERE id = $1 FOR UPDATE
+    `, documentID).Scan(&currentVersion, &content, &syncMode, &state, &authorship)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting document state: %w", err)
+	}
+
+	if syncMode != document.SyncModeCRDT {
+		return nil, nil, ErrSyncModeMismatch
+	}
+
+	var doc *CRDTDocument
+	if state == nil {
+		// The text was last written outside of the CRDT; seed the state with
+		// IDs that are unique to this version of the text
+		doc = SeedCRDTDocument(fmt.Sprintf("seed:%d", currentVersion), content)
+	} else {
+		doc, err = LoadCRDTDocument(state)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Compute what the client is missing before merging its own operations,
+	// so they are not echoed back
+	missing := doc.OperationsSince(stateVector)
+
+	var applied []CRDTOperation
+	for i, op := range operations {
+		ok, err := doc.Apply(op)
+		if err != nil {
+			return nil, nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+		if ok {
+			applied = append(applied, op)
+		}
+	}
+
+	// Nothing new; a freshly seeded state need not be stored since seeding is
+	// deterministic for a given version
+	if len(applied) == 0 {
+		return missing, doc.StateVector(), nil
+	}
+
+	newState, err := doc.MarshalJSON()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshaling CRDT state: %w", err)
+	}
+
+	change := &DocumentChange{
+		DocumentID:     documentID,
+		UserID:         userID,
+		Version:        currentVersion + 1,
+		CRDTOperations: applied,
+		Timestamp:      time.Now(),
+	}
+
+	changeJSON, err := json.Marshal(change)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshaling change: %w", err)
+	}
+
+	// CRDT operations address characters by ID, so attribute the text that
+	// changed instead
+	newContent := doc.Text()
+	newAuthorship, err := json.Marshal(document.LoadAuthorship(authorship, content).
+		Rewrite(content, newContent, userID, change.Timestamp))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshaling authorship: %w", err)
+	}
+
+	// Update document content, authorship, CRDT state and version
+	_, err = tx.Exec(ctx, `
+        UPDATE documents
+        SET content = $1, authorship = $2, crdt_state = $3, version = $4, updated_at = NOW()
+        WHERE id = $5
+    `, newContent, newAuthorship, newState, change.Version, documentID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error updating document: %w", err)
+	}
+
+	// Append the change to the operation log
+	if err := recordChange(ctx, tx, change, changeJSON); err != nil {
+		return nil, nil, err
+	}
+
+	// Queue the broadcast with the change, so a committed change is always
+	// broadcast
+	if err := s.queueBroadcast(ctx, tx, change, changeJSON); err != nil {
+		return nil, nil, err
+	}
+
+	// Commit transaction
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	// Have the outbox relay broadcast the change to all connected clients
+	s.outbox.Notify()
+	s.checkpointer.Record(documentID)
+
+	return missing, doc.StateVector(), nil
+}
+
+// ApplyYjsUpdate merges a Yjs v1 update into the stored state of a document
+// in YJS sync mode and relays it to the other clients. It returns the new
+// document version.
+func (s *Service) ApplyYjsUpdate(ctx context.Context, documentID, userID string, update []byte) (int64, error) {
+	// Start transaction
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the document so concurrent updates are sequenced one at a time
+	var currentVersion int64
+	var syncMode string
+	var state []byte
+	err = tx.QueryRow(ctx, `
+        SELECT version, sync_mode, yjs_state FROM documents WHERE id = $1 FOR UPDATE
+    `, documentID).Scan(&currentVersion, &syncMode, &state)
+
+	if err != nil {
+		return 0, fmt.Errorf("error getting document state: %w", err)
+	}
+
+	if syncMode != document.SyncModeYJS {
+		return 0, ErrSyncModeMismatch
+	}
+
+	updates := [][]byte{update}
+	if state != nil {
+		updates = append([][]byte{state}, update)
+	}
+	newState, err := MergeYjsUpdates(updates...)
+	if err != nil {
+		return 0, err
+	}
+
+	change := &DocumentChange{
+		DocumentID: documentID,
+		UserID:     userID,
+		Version:    currentVersion + 1,
+		YjsUpdate:  update,
+		Timestamp:  time.Now(),
+	}
+
+	changeJSON, err := json.Marshal(change)
+	if err != nil {
+		return 0, fmt.Errorf("error marshaling change: %w", err)
+	}
+
+	// Update Yjs state and version
 	_, err = tx.Exec(ctx, `
-        INSERT INTO document_versions (document_id, content, version)
-        VALUES ($1, $2, $3)
-    `, documentID, string(changeJSON), newVersion)
+        UPDATE documents SET yjs_state = $1, version = $2, updated_at = NOW() WHERE id = $3
+    `, newState, change.Version, documentID)
 	if err != nil {
-		return "", nil, fmt.Errorf("error storing version history: %w", err)
+		return 0, fmt.Errorf("error updating document: %w", err)
+	}
+
+	// Append the change to the operation log
+	if err := recordChange(ctx, tx, change, changeJSON); err != nil {
+		return 0, err
+	}
+
+	// Queue the broadcast with the change, so a committed change is always
+	// broadcast
+	if err := s.queueBroadcast(ctx, tx, change, changeJSON); err != nil {
+		return 0, err
 	}
 
 	// Commit transaction
 	if err := tx.Commit(ctx); err != nil {
-		return "", nil, fmt.Errorf("error committing transaction: %w", err)
+		return 0, fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	// Have the outbox relay broadcast the change to all connected clients
+	s.outbox.Notify()
+
+	return change.Version, nil
+}
+
+// SyncYjs returns the Yjs update a client with the given encoded state vector
+// is missing, together with the encoded state vector of the stored document.
+// An empty state vector yields the full document state.
+func (s *Service) SyncYjs(ctx context.Context, documentID string, stateVector []byte) ([]byte, []byte, error) {
+	var syncMode string
+	var state []byte
+	err := s.db.QueryRow(ctx, `
+        SELECT sync_mode, yjs_state FROM documents WHERE id = $1
+    `, documentID).Scan(&syncMode, &state)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting document state: %w", err)
+	}
+
+	if syncMode != document.SyncModeYJS {
+		return nil, nil, ErrSyncModeMismatch
+	}
+
+	if state == nil {
+		// An empty update: no structs and no deletions
+		state = []byte{0, 0}
+	}
+
+	diff, err := DiffYjsUpdate(state, stateVector)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serverStateVector, err := YjsStateVectorFromUpdate(state)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return diff, serverStateVector, nil
+}
+
+// queueBroadcast arranges for a change to be broadcast once tx commits. A
+// transport that publishes within transactions sends it directly; otherwise
+// the change goes through the outbox.
+func (s *Service) queueBroadcast(ctx context.Context, tx pgx.Tx, change *DocumentChange, payload []byte) error {
+	if publisher, ok := s.pubsub.(TxPublisher); ok {
+		return publisher.PublishTx(ctx, tx, GetDocumentTopic(change.DocumentID), json.RawMessage(payload))
 	}
+	return enqueueChange(ctx, tx, change, payload)
+}
+
+// ChangesSince returns the persisted changes committed after fromVersion, in
+// order, up to the current document version. It fails with
+// ErrHistoryUnavailable when the history no longer holds every one of them.
+func (s *Service) ChangesSince(ctx context.Context, documentID string, fromVersion int64) ([]*DocumentChange, error) {
+	var currentVersion int64
+	err := s.db.QueryRow(ctx, `
+        SELECT version FROM documents WHERE id = $1
+    `, documentID).Scan(&currentVersion)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting current version: %w", err)
+	}
+
+	if fromVersion > currentVersion {
+		return nil, document.ErrVersionMismatch
+	}
+
+	return loadChanges(ctx, s.db, documentID, fromVersion, currentVersion)
+}
+
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
 
-	// Broadcast change to all connected clients
-	if err := s.mqtt.Publish(GetDocumentTopic(documentID), change); err != nil {
-		s.logger.Error("Error broadcasting document change", zap.Error(err))
+// loadChanges reads the changes after fromVersion up to and including
+// toVersion from the operation log.
+func loadChanges(ctx context.Context, q querier, documentID string, fromVersion, toVersion int64) ([]*DocumentChange, error) {
+	changes, err := loadLoggedChanges(ctx, q, documentID, fromVersion, toVersion)
+	if err != nil {
+		return nil, err
 	}
 
-	return newVersion, nil, nil
+	// Versions written by the document service replaced the whole document
+	// and are not in the log
+	if expected := fromVersion + int64(len(changes)) + 1; expected != toVersion+1 {
+		return nil, fmt.Errorf("%w: no change logged for version %d", ErrHistoryUnavailable, expected)
+	}
+	return changes, nil
+}
+
+// loadLoggedChanges reads the changes after fromVersion up to and including
+// toVersion from the operation log, stopping short of the first version not
+// in it.
+func loadLoggedChanges(ctx context.Context, q querier, documentID string, fromVersion, toVersion int64) ([]*DocumentChange, error) {
+	rows, err := q.Query(ctx, `
+        SELECT change, version FROM document_operations
+        WHERE document_id = $1 AND version > $2 AND version <= $3
+        ORDER BY version ASC
+    `, documentID, fromVersion, toVersion)
+	if err != nil {
+		return nil, fmt.Errorf("error querying changes: %w", err)
+	}
+	defer rows.Close()
+
+	var changes []*DocumentChange
+	expected := fromVersion + 1
+	for rows.Next() {
+		var payload []byte
+		var version int64
+		if err := rows.Scan(&payload, &version); err != nil {
+			return nil, fmt.Errorf("error scanning change: %w", err)
+		}
+
+		if version != expected {
+			break
+		}
+
+		var change DocumentChange
+		if err := json.Unmarshal(payload, &change); err != nil {
+			return nil, fmt.Errorf("error unmarshaling change %d: %w", version, err)
+		}
+
+		changes = append(changes, &change)
+		expected++
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading changes: %w", err)
+	}
+
+	return changes, nil
 }
 
 func (s *Service) broadcastChange(documentID string, change *DocumentChange) {
@@ -234,11 +964,28 @@ func (s *Service) broadcastChange(documentID string, change *DocumentChange) {
 	defer s.streamsMutex.RUnlock()
 
 	if streams, exists := s.changeStreams[documentID]; exists {
+		for _, sub := range streams {
+			if sub.offer(change) {
+				s.logger.Warn("Change stream fell behind, resyncing",
+					zap.String("document_id", documentID),
+					zap.String("user_id", sub.userID),
+					zap.String("connection_id", sub.connectionID),
+					zap.Int64("version", change.Version-1))
+			}
+		}
+	}
+}
+
+func (s *Service) broadcastPresence(documentID string, event *PresenceEvent) {
+	s.streamsMutex.RLock()
+	defer s.streamsMutex.RUnlock()
+
+	if streams, exists := s.presenceStreams[documentID]; exists {
 		for _, ch := range streams {
 			select {
-			case ch <- change:
+			case ch <- event:
 			default:
-				s.logger.Warn("Change channel full, dropping message",
+				s.logger.Warn("Presence channel full, dropping message",
 					zap.String("document_id", documentID))
 			}
 		}
@@ -0,0 +1,306 @@
+package collaboration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/HardMax71/syncwrite/backend/pkg/utils"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Session state lives in Redis so that every replica sees the same active
+// users. The session of a document is a hash from connection ID to the JSON
+// encoded ActiveUser, and a set lists the documents with a session so the
+// reaper can find them. Updates run as optimistic transactions that retry when
+// another replica changes the same session concurrently.
+
+const (
+	sessionsKey       = "collaboration:sessions"
+	maxSessionRetries = 10
+)
+
+var ErrSessionConflict = errors.New("session changed concurrently")
+
+func sessionKey(documentID string) string {
+	return fmt.Sprintf("collaboration:session:%s", documentID)
+}
+
+type SessionManager struct {
+	redis  *redis.Client
+	logger *zap.Logger
+}
+
+func NewSessionManager(client *redis.Client) *SessionManager {
+	return &SessionManager{
+		redis:  client,
+		logger: utils.Logger(),
+	}
+}
+
+func (sm *SessionManager) AddUser(ctx context.Context, documentID string, user *ActiveUser) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return fmt.Errorf("error marshaling active user: %w", err)
+	}
+
+	_, err = sm.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, sessionKey(documentID), user.ConnectionID, data)
+		pipe.SAdd(ctx, sessionsKey, documentID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error adding user to session: %w", err)
+	}
+	return nil
+}
+
+func (sm *SessionManager) GetActiveUsers(ctx context.Context, documentID string) ([]*ActiveUser, error) {
+	connections, err := loadSession(ctx, sm.redis, documentID)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]*ActiveUser, 0, len(connections))
+	for _, user := range connections {
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// RemoveConnection removes a connection of userID and returns it, or nil if
+// it does not exist.
+func (sm *SessionManager) RemoveConnection(ctx context.Context, documentID, connectionID, userID string) (*ActiveUser, error) {
+	var removed *ActiveUser
+	err := sm.update(ctx, documentID, func(connections map[string]*ActiveUser) []*ActiveUser {
+		removed = nil
+		if user, exists := connections[connectionID]; exists && user.UserID == userID {
+			removed = user
+			delete(connections, connectionID)
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// RemoveUser removes every connection of userID and returns them.
+func (sm *SessionManager) RemoveUser(ctx context.Context, documentID, userID string) ([]*ActiveUser, error) {
+	var removed []*ActiveUser
+	err := sm.update(ctx, documentID, func(connections map[string]*ActiveUser) []*ActiveUser {
+		removed = nil
+		for connectionID, user := range connections {
+			if user.UserID == userID {
+				removed = append(removed, user)
+				delete(connections, connectionID)
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// Touch marks a connection of userID as active and reports whether the
+// connection exists.
+func (sm *SessionManager) Touch(ctx context.Context, documentID, connectionID, userID string) (bool, error) {
+	var found bool
+	err := sm.update(ctx, documentID, func(connections map[string]*ActiveUser) []*ActiveUser {
+		user, exists := connections[connectionID]
+		found = exists && user.UserID == userID
+		if !found {
+			return nil
+		}
+		user.LastActive = time.Now()
+		return []*ActiveUser{user}
+	})
+	return found, err
+}
+
+// UpdatePresence records the presence of a connection of userID, keeping the
+// color assigned to the user, and returns it as stored. It reports false if
+// the connection does not exist.
+func (sm *SessionManager) UpdatePresence(ctx context.Context, documentID, connectionID, userID string, presence Presence) (Presence, bool, error) {
+	var stored Presence
+	var found bool
+	err := sm.update(ctx, documentID, func(connections map[string]*ActiveUser) []*ActiveUser {
+		user, exists := connections[connectionID]
+		found = exists && user.UserID == userID
+		if !found {
+			return nil
+		}
+		stored = presence
+		stored.Color = user.Presence.Color
+		user.Presence = stored
+		user.LastActive = time.Now()
+		return []*ActiveUser{user}
+	})
+	return stored, found, err
+}
+
+// TransformPresence moves every presence that refers to a version before the
+// last of changes to that version, so its selections stay on the same text.
+// changes must be consecutive; see advancePresence.
+func (sm *SessionManager) TransformPresence(ctx context.Context, documentID string, changes []*DocumentChange) error {
+	last := changes[len(changes)-1].Version
+	return sm.update(ctx, documentID, func(connections map[string]*ActiveUser) []*ActiveUser {
+		var changed []*ActiveUser
+		for _, user := range connections {
+			if user.Presence.Version >= last {
+				continue
+			}
+			user.Presence = advancePresence(user.Presence, changes)
+			changed = append(changed, user)
+		}
+		return changed
+	})
+}
+
+// advancePresence moves a presence to the version of the last of changes,
+// which must be consecutive, transforming its selections through the changes
+// after its version. Selections referring to a version before the first change
+// cannot be transformed; they are dropped until the client sets them again.
+func advancePresence(presence Presence, changes []*DocumentChange) Presence {
+	first := changes[0].Version
+	if presence.Version < first-1 {
+		presence.Selections = nil
+	} else {
+		for _, change := range changes[presence.Version-(first-1):] {
+			presence.Selections = TransformSelections(presence.Selections, change.Operations)
+		}
+	}
+	presence.Version = changes[len(changes)-1].Version
+	return presence
+}
+
+// StartReaper evicts connections that have not been active for timeout,
+// checking every interval until ctx is done. onEvict is called with the
+// connections evicted from each session. Every replica runs a reaper; a
+// connection is only ever evicted by one of them.
+func (sm *SessionManager) StartReaper(ctx context.Context, interval, timeout time.Duration, onEvict func(documentID string, evicted []*ActiveUser)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := sm.evictIdle(ctx, time.Now().Add(-timeout), onEvict); err != nil {
+					sm.logger.Error("Error evicting idle connections", zap.Error(err))
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (sm *SessionManager) evictIdle(ctx context.Context, cutoff time.Time, onEvict func(documentID string, evicted []*ActiveUser)) error {
+	documentIDs, err := sm.redis.SMembers(ctx, sessionsKey).Result()
+	if err != nil {
+		return fmt.Errorf("error listing sessions: %w", err)
+	}
+
+	for _, documentID := range documentIDs {
+		var evicted []*ActiveUser
+		err := sm.update(ctx, documentID, func(connections map[string]*ActiveUser) []*ActiveUser {
+			evicted = nil
+			for connectionID, user := range connections {
+				if user.LastActive.Before(cutoff) {
+					evicted = append(evicted, user)
+					delete(connections, connectionID)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(evicted) > 0 {
+			onEvict(documentID, evicted)
+		}
+	}
+	return nil
+}
+
+// update runs fn on the connections of a session in an optimistic
+// transaction. Connections fn deletes from the map are removed from the
+// session, and the connections it returns are stored. fn may run several
+// times and must not keep state between runs.
+func (sm *SessionManager) update(ctx context.Context, documentID string, fn func(connections map[string]*ActiveUser) []*ActiveUser) error {
+	key := sessionKey(documentID)
+
+	txf := func(tx *redis.Tx) error {
+		connections, err := loadSession(ctx, tx, documentID)
+		if err != nil {
+			return err
+		}
+
+		existing := make([]string, 0, len(connections))
+		for connectionID := range connections {
+			existing = append(existing, connectionID)
+		}
+
+		changed := fn(connections)
+
+		var removed []string
+		for _, connectionID := range existing {
+			if _, exists := connections[connectionID]; !exists {
+				removed = append(removed, connectionID)
+			}
+		}
+
+		if len(changed) == 0 && len(removed) == 0 && len(connections) > 0 {
+			return nil
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, user := range changed {
+				data, err := json.Marshal(user)
+				if err != nil {
+					return fmt.Errorf("error marshaling active user: %w", err)
+				}
+				pipe.HSet(ctx, key, user.ConnectionID, data)
+			}
+			if len(removed) > 0 {
+				pipe.HDel(ctx, key, removed...)
+			}
+			if len(connections) == 0 {
+				pipe.SRem(ctx, sessionsKey, documentID)
+			}
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < maxSessionRetries; i++ {
+		err := sm.redis.Watch(ctx, txf, key)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error updating session: %w", err)
+		}
+		return nil
+	}
+	return ErrSessionConflict
+}
+
+func loadSession(ctx context.Context, client redis.Cmdable, documentID string) (map[string]*ActiveUser, error) {
+	fields, err := client.HGetAll(ctx, sessionKey(documentID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error loading session: %w", err)
+	}
+
+	connections := make(map[string]*ActiveUser, len(fields))
+	for connectionID, data := range fields {
+		var user ActiveUser
+		if err := json.Unmarshal([]byte(data), &user); err != nil {
+			return nil, fmt.Errorf("error unmarshaling active user: %w", err)
+		}
+		connections[connectionID] = &user
+	}
+	return connections, nil
+}
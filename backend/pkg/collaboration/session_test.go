@@ -0,0 +1,60 @@
+package collaboration
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAdvancePresence(t *testing.T) {
+	// "hello world" at version 1 becomes "> Oh, world" at version 4
+	changes := []*DocumentChange{
+		{Version: 2, Operations: []Operation{insertOperation(0, "Oh, ")}},
+		{Version: 3, Operations: []Operation{deleteOperation(4, 6)}},
+		{Version: 4, Operations: []Operation{insertOperation(0, "> ")}},
+	}
+	world := []Selection{{Anchor: 6, Head: 11}}
+
+	tests := []struct {
+		name     string
+		presence Presence
+		want     Presence
+	}{
+		{
+			name:     "before every change",
+			presence: Presence{Version: 1, Selections: []Selection{{Anchor: 6, Head: 11}}, Color: "red"},
+			want:     Presence{Version: 4, Selections: world, Color: "red"},
+		},
+		{
+			name:     "after some of the changes",
+			presence: Presence{Version: 2, Selections: []Selection{{Anchor: 10, Head: 15}}},
+			want:     Presence{Version: 4, Selections: world},
+		},
+		{
+			name:     "before the last change",
+			presence: Presence{Version: 3, Selections: []Selection{{Anchor: 9, Head: 4}}},
+			want:     Presence{Version: 4, Selections: []Selection{{Anchor: 11, Head: 6}}},
+		},
+		{
+			name:     "older than the changes",
+			presence: Presence{Version: 0, Selections: []Selection{{Anchor: 1, Head: 2}}, IsTyping: true},
+			want:     Presence{Version: 4, IsTyping: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := advancePresence(tt.presence, changes); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("advancePresence() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// The selections still cover the same text
+	content := "hello world"
+	for _, change := range changes {
+		content = mustApply(t, content, change.Operations)
+	}
+	if got := content[world[0].Anchor:world[0].Head]; got != "world" {
+		t.Errorf("selection covers %q, want %q", got, "world")
+	}
+}
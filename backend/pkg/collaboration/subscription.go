@@ -0,0 +1,117 @@
+package collaboration
+
+import (
+	"sync"
+)
+
+// Slow-consumer handling for change streams.
+//
+// Every stream reads changes from a bounded queue. When a stream falls so far
+// behind that its queue fills up, it is marked as lagging: later changes are no
+// longer queued and the stream is signalled instead. The consumer then reloads
+// everything it missed from the change history in one read, which coalesces
+// the pending changes, or tells its client to resync if the history cannot
+// cover them. Either way the client never silently misses a change.
+
+const changeQueueSize = 100
+
+// ChangeSubscription delivers the changes of one document to one stream.
+type ChangeSubscription struct {
+	userID       string
+	connectionID string
+	changes      chan *DocumentChange
+	lagged       chan struct{}
+
+	mutex    sync.Mutex
+	lagging  bool
+	behindAt int64
+	dropped  uint64
+	lags     uint64
+}
+
+// StreamStats describes the backlog of a change stream.
+type StreamStats struct {
+	UserID       string
+	ConnectionID string
+	Queued       int
+	Capacity     int
+	Lagging      bool
+	// BehindAt is the version of the last change queued before the stream
+	// most recently fell behind.
+	BehindAt int64
+	// Dropped counts the changes that were not queued because the stream was
+	// lagging, and Lags the number of times it fell behind.
+	Dropped uint64
+	Lags    uint64
+}
+
+func newChangeSubscription(userID, connectionID string) *ChangeSubscription {
+	return &ChangeSubscription{
+		userID:       userID,
+		connectionID: connectionID,
+		changes:      make(chan *DocumentChange, changeQueueSize),
+		lagged:       make(chan struct{}, 1),
+	}
+}
+
+// Changes returns the queued changes, in the order they were broadcast.
+func (sub *ChangeSubscription) Changes() <-chan *DocumentChange {
+	return sub.changes
+}
+
+// Lagged is signalled when the stream falls behind. The consumer must call
+// Resume and then reload the changes after the last version it sent.
+func (sub *ChangeSubscription) Lagged() <-chan struct{} {
+	return sub.lagged
+}
+
+// Resume queues changes again after the stream fell behind.
+func (sub *ChangeSubscription) Resume() {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	sub.lagging = false
+}
+
+// offer queues change unless the stream is lagging. It reports whether the
+// stream fell behind with this change.
+func (sub *ChangeSubscription) offer(change *DocumentChange) bool {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+
+	if sub.lagging {
+		sub.dropped++
+		return false
+	}
+
+	select {
+	case sub.changes <- change:
+		return false
+	default:
+	}
+
+	sub.lagging = true
+	sub.behindAt = change.Version - 1
+	sub.dropped++
+	sub.lags++
+	select {
+	case sub.lagged <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (sub *ChangeSubscription) stats() StreamStats {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+
+	return StreamStats{
+		UserID:       sub.userID,
+		ConnectionID: sub.connectionID,
+		Queued:       len(sub.changes),
+		Capacity:     cap(sub.changes),
+		Lagging:      sub.lagging,
+		BehindAt:     sub.behindAt,
+		Dropped:      sub.dropped,
+		Lags:         sub.lags,
+	}
+}
@@ -0,0 +1,81 @@
+package collaboration
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf16"
+)
+
+var ErrInvalidOperation = errors.New("invalid operation")
+
+// ApplyOperations applies operations in order to content and returns the
+// resulting text. Positions and lengths are UTF-16 code unit offsets, the same
+// unit JavaScript uses for string indexing, so the browser editor can send its
+// selection offsets unchanged. An operation that falls outside the text or
+// splits a surrogate pair is rejected with ErrInvalidOperation.
+func ApplyOperations(content string, operations []Operation) (string, error) {
+	text := utf16.Encode([]rune(content))
+
+	for i, op := range operations {
+		var err error
+		text, err = applyOperation(text, op)
+		if err != nil {
+			return "", fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+
+	return string(utf16.Decode(text)), nil
+}
+
+func applyOperation(text []uint16, op Operation) ([]uint16, error) {
+	length := op.Length
+	if op.Type == OperationTypeInsert {
+		length = 0
+	}
+
+	if err := validateRange(text, op.Position, length); err != nil {
+		return nil, err
+	}
+
+	var inserted []uint16
+	switch op.Type {
+	case OperationTypeInsert, OperationTypeReplace:
+		inserted = utf16.Encode([]rune(op.Content))
+	case OperationTypeDelete:
+	default:
+		return nil, fmt.Errorf("%w: unknown operation type %d", ErrInvalidOperation, op.Type)
+	}
+
+	result := make([]uint16, 0, len(text)-int(length)+len(inserted))
+	result = append(result, text[:op.Position]...)
+	result = append(result, inserted...)
+	result = append(result, text[op.Position+length:]...)
+	return result, nil
+}
+
+func validateRange(text []uint16, position, length int32) error {
+	if position < 0 || length < 0 {
+		return fmt.Errorf("%w: negative position or length", ErrInvalidOperation)
+	}
+
+	if int(position)+int(length) > len(text) {
+		return fmt.Errorf("%w: range %d+%d exceeds document length %d",
+			ErrInvalidOperation, position, length, len(text))
+	}
+
+	if splitsSurrogatePair(text, int(position)) || splitsSurrogatePair(text, int(position+length)) {
+		return fmt.Errorf("%w: offset splits a surrogate pair", ErrInvalidOperation)
+	}
+
+	return nil
+}
+
+// splitsSurrogatePair reports whether offset points between the high and low
+// halves of a UTF-16 surrogate pair.
+func splitsSurrogatePair(text []uint16, offset int) bool {
+	if offset <= 0 || offset >= len(text) {
+		return false
+	}
+	high, low := text[offset-1], text[offset]
+	return high >= 0xd800 && high < 0xdc00 && low >= 0xdc00 && low < 0xe000
+}
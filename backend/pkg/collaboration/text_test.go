@@ -0,0 +1,159 @@
+package collaboration
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestApplyOperations(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		operations []Operation
+		want       string
+	}{
+		{
+			name:    "no operations",
+			content: "hello",
+			want:    "hello",
+		},
+		{
+			name:       "insert at start",
+			content:    "world",
+			operations: []Operation{insertOperation(0, "hello ")},
+			want:       "hello world",
+		},
+		{
+			name:       "insert at end",
+			content:    "hello",
+			operations: []Operation{insertOperation(5, "!")},
+			want:       "hello!",
+		},
+		{
+			name:       "insert into empty text",
+			content:    "",
+			operations: []Operation{insertOperation(0, "hi")},
+			want:       "hi",
+		},
+		{
+			name:       "delete",
+			content:    "hello world",
+			operations: []Operation{deleteOperation(5, 6)},
+			want:       "hello",
+		},
+		{
+			name:       "replace",
+			content:    "hello world",
+			operations: []Operation{{Type: OperationTypeReplace, Position: 6, Length: 5, Content: "there"}},
+			want:       "hello there",
+		},
+		{
+			name:    "operations apply in sequence",
+			content: "abc",
+			operations: []Operation{
+				insertOperation(3, "d"),
+				deleteOperation(0, 1),
+				{Type: OperationTypeReplace, Position: 1, Length: 1, Content: "X"},
+			},
+			want: "bXd",
+		},
+		{
+			name:       "positions count UTF-16 code units",
+			content:    "a😀b",
+			operations: []Operation{insertOperation(3, "X")},
+			want:       "a😀Xb",
+		},
+		{
+			name:       "delete a surrogate pair",
+			content:    "a😀b",
+			operations: []Operation{deleteOperation(1, 2)},
+			want:       "ab",
+		},
+		{
+			name:       "replace with a surrogate pair",
+			content:    "aéb",
+			operations: []Operation{{Type: OperationTypeReplace, Position: 1, Length: 1, Content: "😀"}},
+			want:       "a😀b",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ApplyOperations(tt.content, tt.operations)
+			if err != nil {
+				t.Fatalf("ApplyOperations() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ApplyOperations() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyOperationsInvalid(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		operations []Operation
+	}{
+		{
+			name:       "negative position",
+			content:    "abc",
+			operations: []Operation{insertOperation(-1, "x")},
+		},
+		{
+			name:       "negative length",
+			content:    "abc",
+			operations: []Operation{deleteOperation(1, -1)},
+		},
+		{
+			name:       "insert past the end",
+			content:    "abc",
+			operations: []Operation{insertOperation(4, "x")},
+		},
+		{
+			name:       "delete past the end",
+			content:    "abc",
+			operations: []Operation{deleteOperation(2, 2)},
+		},
+		{
+			name:       "replace past the end",
+			content:    "abc",
+			operations: []Operation{{Type: OperationTypeReplace, Position: 3, Length: 1, Content: "x"}},
+		},
+		{
+			name:       "later operation past the end",
+			content:    "abc",
+			operations: []Operation{deleteOperation(0, 2), deleteOperation(1, 1)},
+		},
+		{
+			name:       "insert between surrogate halves",
+			content:    "a😀b",
+			operations: []Operation{insertOperation(2, "x")},
+		},
+		{
+			name:       "delete starting between surrogate halves",
+			content:    "a😀b",
+			operations: []Operation{deleteOperation(2, 2)},
+		},
+		{
+			name:       "delete ending between surrogate halves",
+			content:    "a😀b",
+			operations: []Operation{deleteOperation(0, 2)},
+		},
+		{
+			name:       "unknown operation type",
+			content:    "abc",
+			operations: []Operation{{Type: OperationType(42), Position: 0}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ApplyOperations(tt.content, tt.operations)
+			if !errors.Is(err, ErrInvalidOperation) {
+				t.Fatalf("ApplyOperations() = %q, %v, want ErrInvalidOperation", got, err)
+			}
+		})
+	}
+}
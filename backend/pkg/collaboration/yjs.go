@@ -0,0 +1,587 @@
+package collaboration
+
+import (
+	"fmt"
+	"sort"
+	"unicode/utf16"
+)
+
+// Yjs update handling for documents in YJS sync mode.
+//
+// The server never integrates Yjs structs into a document tree. Like the
+// mergeUpdates/diffUpdate helpers of Yjs itself, it works on the struct level of
+// the v1 update encoding: updates are merged by client and clock range, state
+// vectors are read from the merged update, and diffs are cut out of it. This is
+// enough to store a document, catch clients up and relay their edits, while
+// Yjs clients remain responsible for resolving the resulting document.
+
+const (
+	yjsStructGC   = 0
+	yjsStructSkip = 10
+
+	yjsContentDeleted = 1
+	yjsContentJSON    = 2
+	yjsContentBinary  = 3
+	yjsContentString  = 4
+	yjsContentEmbed   = 5
+	yjsContentFormat  = 6
+	yjsContentType    = 7
+	yjsContentAny     = 8
+	yjsContentDoc     = 9
+
+	yjsTypeXMLElement = 3
+	yjsTypeXMLHook    = 5
+
+	yjsHasOrigin      = 0x80
+	yjsHasRightOrigin = 0x40
+	yjsHasParentSub   = 0x20
+	yjsContentRefMask = 0x1f
+)
+
+type yjsID struct {
+	client uint64
+	clock  uint64
+}
+
+type yjsRange struct {
+	clock  uint64
+	length uint64
+}
+
+// yjsContent keeps item content in its encoded form. Splittable content keeps
+// one raw entry per element so it can be sliced without being decoded.
+type yjsContent struct {
+	ref     byte
+	length  uint64
+	str     string   // yjsContentString
+	parts   [][]byte // yjsContentJSON and yjsContentAny
+	encoded []byte   // content that always has length 1
+}
+
+type yjsStruct struct {
+	ref    byte // yjsStructGC, yjsStructSkip, or the content ref of an item
+	id     yjsID
+	length uint64
+
+	// Item fields
+	info        byte
+	origin      *yjsID
+	rightOrigin *yjsID
+	parentKey   *string
+	parentID    *yjsID
+	parentSub   *string
+	content     *yjsContent
+}
+
+func (s *yjsStruct) end() uint64 {
+	return s.id.clock + s.length
+}
+
+type yjsUpdate struct {
+	structs map[uint64][]*yjsStruct
+	deletes map[uint64][]yjsRange
+}
+
+// MergeYjsUpdates merges Yjs v1 updates into a single update that contains
+// every struct and deletion of its inputs exactly once.
+func MergeYjsUpdates(updates ...[]byte) ([]byte, error) {
+	merged := &yjsUpdate{
+		structs: make(map[uint64][]*yjsStruct),
+		deletes: make(map[uint64][]yjsRange),
+	}
+
+	for _, data := range updates {
+		update, err := decodeYjsUpdate(data)
+		if err != nil {
+			return nil, err
+		}
+		for client, structs := range update.structs {
+			merged.structs[client] = append(merged.structs[client], structs...)
+		}
+		for client, ranges := range update.deletes {
+			merged.deletes[client] = append(merged.deletes[client], ranges...)
+		}
+	}
+
+	for client, structs := range merged.structs {
+		merged.structs[client] = mergeYjsStructs(structs)
+	}
+	for client, ranges := range merged.deletes {
+		merged.deletes[client] = mergeYjsRanges(ranges)
+	}
+
+	return merged.encode(), nil
+}
+
+// YjsStateVectorFromUpdate returns the encoded state vector of update: for
+// every client, the clock up to which its structs are contiguous from zero.
+func YjsStateVectorFromUpdate(data []byte) ([]byte, error) {
+	update, err := decodeYjsUpdate(data)
+	if err != nil {
+		return nil, err
+	}
+
+	stateVector := make(map[uint64]uint64)
+	for client, structs := range update.structs {
+		structs = mergeYjsStructs(structs)
+		if len(structs) == 0 || structs[0].id.clock != 0 {
+			continue
+		}
+		clock := uint64(0)
+		for _, s := range structs {
+			if s.ref == yjsStructSkip || s.id.clock != clock {
+				break
+			}
+			clock = s.end()
+		}
+		stateVector[client] = clock
+	}
+
+	return encodeYjsStateVector(stateVector), nil
+}
+
+// DiffYjsUpdate returns the part of update that a client with the encoded
+// state vector has not seen yet. Deletions are always included in full.
+func DiffYjsUpdate(data, stateVector []byte) ([]byte, error) {
+	update, err := decodeYjsUpdate(data)
+	if err != nil {
+		return nil, err
+	}
+
+	known, err := decodeYjsStateVector(stateVector)
+	if err != nil {
+		return nil, err
+	}
+
+	for client, structs := range update.structs {
+		structs = mergeYjsStructs(structs)
+		clock := known[client]
+
+		var missing []*yjsStruct
+		for _, s := range structs {
+			if s.end() <= clock {
+				continue
+			}
+			if s.id.clock < clock {
+				s = s.slice(clock - s.id.clock)
+			}
+			if len(missing) == 0 && s.ref == yjsStructSkip {
+				continue
+			}
+			missing = append(missing, s)
+		}
+
+		if len(missing) == 0 {
+			delete(update.structs, client)
+		} else {
+			update.structs[client] = missing
+		}
+	}
+
+	return update.encode(), nil
+}
+
+// mergeYjsStructs sorts the structs of a single client, drops ranges that are
+// already covered and fills gaps with skip structs.
+func mergeYjsStructs(structs []*yjsStruct) []*yjsStruct {
+	sort.SliceStable(structs, func(i, j int) bool {
+		if structs[i].id.clock != structs[j].id.clock {
+			return structs[i].id.clock < structs[j].id.clock
+		}
+		return structs[i].length > structs[j].length
+	})
+
+	var merged []*yjsStruct
+	var clock uint64
+	for _, s := range structs {
+		if s.ref == yjsStructSkip || s.length == 0 {
+			continue
+		}
+		if len(merged) > 0 {
+			if s.end() <= clock {
+				continue
+			}
+			if s.id.clock < clock {
+				s = s.slice(clock - s.id.clock)
+			} else if s.id.clock > clock {
+				merged = append(merged, &yjsStruct{
+					ref:    yjsStructSkip,
+					id:     yjsID{client: s.id.client, clock: clock},
+					length: s.id.clock - clock,
+				})
+			}
+		}
+		merged = append(merged, s)
+		clock = s.end()
+	}
+	return merged
+}
+
+func mergeYjsRanges(ranges []yjsRange) []yjsRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].clock < ranges[j].clock
+	})
+
+	var merged []yjsRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r.clock <= merged[n-1].clock+merged[n-1].length {
+			last := &merged[n-1]
+			last.length = max(last.length, r.clock+r.length-last.clock)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// slice returns the part of s starting offset clock units in. The cut-off
+// part becomes the left origin of the returned item, as in Yjs.
+func (s *yjsStruct) slice(offset uint64) *yjsStruct {
+	sliced := *s
+	sliced.id.clock += offset
+	sliced.length -= offset
+
+	if s.content != nil {
+		sliced.info |= yjsHasOrigin
+		sliced.origin = &yjsID{client: s.id.client, clock: s.id.clock + offset - 1}
+		sliced.content = s.content.slice(offset)
+	}
+	return &sliced
+}
+
+func (c *yjsContent) slice(offset uint64) *yjsContent {
+	sliced := *c
+	sliced.length -= offset
+
+	switch c.ref {
+	case yjsContentString:
+		// Like Yjs, a surrogate pair cut in half decodes to U+FFFD
+		sliced.str = string(utf16.Decode(utf16.Encode([]rune(c.str))[offset:]))
+	case yjsContentJSON, yjsContentAny:
+		sliced.parts = c.parts[offset:]
+	}
+	return &sliced
+}
+
+func decodeYjsUpdate(data []byte) (*yjsUpdate, error) {
+	d := newYjsDecoder(data)
+	update := &yjsUpdate{
+		structs: make(map[uint64][]*yjsStruct),
+		deletes: make(map[uint64][]yjsRange),
+	}
+
+	numClients, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < numClients; i++ {
+		numStructs, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		client, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		clock, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+
+		for j := uint64(0); j < numStructs; j++ {
+			s, err := decodeYjsStruct(d, yjsID{client: client, clock: clock})
+			if err != nil {
+				return nil, err
+			}
+			update.structs[client] = append(update.structs[client], s)
+			clock = s.end()
+		}
+	}
+
+	numDeleteClients, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < numDeleteClients; i++ {
+		client, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		numRanges, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < numRanges; j++ {
+			clock, err := d.readVarUint()
+			if err != nil {
+				return nil, err
+			}
+			length, err := d.readVarUint()
+			if err != nil {
+				return nil, err
+			}
+			update.deletes[client] = append(update.deletes[client], yjsRange{clock: clock, length: length})
+		}
+	}
+
+	if d.hasContent() {
+		return nil, fmt.Errorf("%w: trailing data", ErrInvalidYjsUpdate)
+	}
+
+	return update, nil
+}
+
+func decodeYjsStruct(d *yjsDecoder, id yjsID) (*yjsStruct, error) {
+	info, err := d.readUint8()
+	if err != nil {
+		return nil, err
+	}
+
+	ref := info & yjsContentRefMask
+	if ref == yjsStructGC || ref == yjsStructSkip {
+		length, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		return &yjsStruct{ref: ref, id: id, length: length}, nil
+	}
+
+	s := &yjsStruct{ref: ref, id: id, info: info}
+	if info&yjsHasOrigin != 0 {
+		if s.origin, err = decodeYjsID(d); err != nil {
+			return nil, err
+		}
+	}
+	if info&yjsHasRightOrigin != 0 {
+		if s.rightOrigin, err = decodeYjsID(d); err != nil {
+			return nil, err
+		}
+	}
+	if info&(yjsHasOrigin|yjsHasRightOrigin) == 0 {
+		parentInfo, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		if parentInfo == 1 {
+			key, err := d.readVarString()
+			if err != nil {
+				return nil, err
+			}
+			s.parentKey = &key
+		} else if s.parentID, err = decodeYjsID(d); err != nil {
+			return nil, err
+		}
+		if info&yjsHasParentSub != 0 {
+			sub, err := d.readVarString()
+			if err != nil {
+				return nil, err
+			}
+			s.parentSub = &sub
+		}
+	}
+
+	if s.content, err = decodeYjsContent(d, ref); err != nil {
+		return nil, err
+	}
+	s.length = s.content.length
+	return s, nil
+}
+
+func decodeYjsID(d *yjsDecoder) (*yjsID, error) {
+	client, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	clock, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	return &yjsID{client: client, clock: clock}, nil
+}
+
+func decodeYjsContent(d *yjsDecoder, ref byte) (*yjsContent, error) {
+	c := &yjsContent{ref: ref, length: 1}
+	start := d.pos
+
+	var err error
+	switch ref {
+	case yjsContentDeleted:
+		c.length, err = d.readVarUint()
+	case yjsContentJSON, yjsContentAny:
+		var n uint64
+		if n, err = d.readVarUint(); err != nil {
+			return nil, err
+		}
+		c.length = n
+		for i := uint64(0); i < n; i++ {
+			partStart := d.pos
+			if ref == yjsContentJSON {
+				_, err = d.readVarBytes()
+			} else {
+				err = d.skipAny()
+			}
+			if err != nil {
+				return nil, err
+			}
+			c.parts = append(c.parts, d.data[partStart:d.pos])
+		}
+	case yjsContentString:
+		if c.str, err = d.readVarString(); err != nil {
+			return nil, err
+		}
+		c.length = uint64(len(utf16.Encode([]rune(c.str))))
+	case yjsContentBinary, yjsContentEmbed:
+		_, err = d.readVarBytes()
+	case yjsContentFormat:
+		if _, err = d.readVarBytes(); err == nil {
+			_, err = d.readVarBytes()
+		}
+	case yjsContentType:
+		var typeRef uint64
+		if typeRef, err = d.readVarUint(); err == nil && (typeRef == yjsTypeXMLElement || typeRef == yjsTypeXMLHook) {
+			_, err = d.readVarBytes()
+		}
+	case yjsContentDoc:
+		if _, err = d.readVarBytes(); err == nil {
+			err = d.skipAny()
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown content type %d", ErrInvalidYjsUpdate, ref)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if c.length == 0 {
+		return nil, fmt.Errorf("%w: empty content", ErrInvalidYjsUpdate)
+	}
+
+	c.encoded = d.data[start:d.pos]
+	return c, nil
+}
+
+func (u *yjsUpdate) encode() []byte {
+	e := &yjsEncoder{}
+
+	// Yjs writes clients in descending order
+	clients := sortedYjsClients(u.structs)
+	e.writeVarUint(uint64(len(clients)))
+	for _, client := range clients {
+		structs := u.structs[client]
+		e.writeVarUint(uint64(len(structs)))
+		e.writeVarUint(client)
+		e.writeVarUint(structs[0].id.clock)
+		for _, s := range structs {
+			s.encode(e)
+		}
+	}
+
+	deleteClients := sortedYjsClients(u.deletes)
+	e.writeVarUint(uint64(len(deleteClients)))
+	for _, client := range deleteClients {
+		ranges := u.deletes[client]
+		e.writeVarUint(client)
+		e.writeVarUint(uint64(len(ranges)))
+		for _, r := range ranges {
+			e.writeVarUint(r.clock)
+			e.writeVarUint(r.length)
+		}
+	}
+
+	return e.bytes()
+}
+
+func (s *yjsStruct) encode(e *yjsEncoder) {
+	if s.content == nil {
+		e.writeUint8(s.ref)
+		e.writeVarUint(s.length)
+		return
+	}
+
+	e.writeUint8(s.info)
+	if s.origin != nil {
+		e.writeVarUint(s.origin.client)
+		e.writeVarUint(s.origin.clock)
+	}
+	if s.rightOrigin != nil {
+		e.writeVarUint(s.rightOrigin.client)
+		e.writeVarUint(s.rightOrigin.clock)
+	}
+	if s.origin == nil && s.rightOrigin == nil {
+		if s.parentKey != nil {
+			e.writeVarUint(1)
+			e.writeVarString(*s.parentKey)
+		} else {
+			e.writeVarUint(0)
+			e.writeVarUint(s.parentID.client)
+			e.writeVarUint(s.parentID.clock)
+		}
+		if s.parentSub != nil {
+			e.writeVarString(*s.parentSub)
+		}
+	}
+	s.content.encode(e)
+}
+
+func (c *yjsContent) encode(e *yjsEncoder) {
+	switch c.ref {
+	case yjsContentDeleted:
+		e.writeVarUint(c.length)
+	case yjsContentJSON, yjsContentAny:
+		e.writeVarUint(uint64(len(c.parts)))
+		for _, part := range c.parts {
+			e.writeRaw(part)
+		}
+	case yjsContentString:
+		e.writeVarString(c.str)
+	default:
+		e.writeRaw(c.encoded)
+	}
+}
+
+func decodeYjsStateVector(data []byte) (map[uint64]uint64, error) {
+	stateVector := make(map[uint64]uint64)
+	if len(data) == 0 {
+		return stateVector, nil
+	}
+
+	d := newYjsDecoder(data)
+	n, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < n; i++ {
+		client, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		clock, err := d.readVarUint()
+		if err != nil {
+			return nil, err
+		}
+		stateVector[client] = clock
+	}
+	return stateVector, nil
+}
+
+func encodeYjsStateVector(stateVector map[uint64]uint64) []byte {
+	e := &yjsEncoder{}
+	clients := sortedYjsClients(stateVector)
+	e.writeVarUint(uint64(len(clients)))
+	for _, client := range clients {
+		e.writeVarUint(client)
+		e.writeVarUint(stateVector[client])
+	}
+	return e.bytes()
+}
+
+func sortedYjsClients[V any](m map[uint64]V) []uint64 {
+	clients := make([]uint64, 0, len(m))
+	for client := range m {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i] > clients[j]
+	})
+	return clients
+}
@@ -0,0 +1,175 @@
+package collaboration
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Primitives of the lib0 binary encoding used by Yjs.
+
+var ErrInvalidYjsUpdate = errors.New("invalid Yjs update")
+
+type yjsDecoder struct {
+	data []byte
+	pos  int
+}
+
+func newYjsDecoder(data []byte) *yjsDecoder {
+	return &yjsDecoder{data: data}
+}
+
+func (d *yjsDecoder) hasContent() bool {
+	return d.pos < len(d.data)
+}
+
+func (d *yjsDecoder) readUint8() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, fmt.Errorf("%w: unexpected end of data", ErrInvalidYjsUpdate)
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b, nil
+}
+
+func (d *yjsDecoder) readVarUint() (uint64, error) {
+	var value uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		b, err := d.readUint8()
+		if err != nil {
+			return 0, err
+		}
+		value |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return value, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: varuint overflow", ErrInvalidYjsUpdate)
+}
+
+// skipVarInt skips a lib0 signed varint; its value is never needed by the
+// server.
+func (d *yjsDecoder) skipVarInt() error {
+	for {
+		b, err := d.readUint8()
+		if err != nil {
+			return err
+		}
+		if b < 0x80 {
+			return nil
+		}
+	}
+}
+
+func (d *yjsDecoder) readBytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, fmt.Errorf("%w: unexpected end of data", ErrInvalidYjsUpdate)
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+func (d *yjsDecoder) readVarBytes() ([]byte, error) {
+	n, err := d.readVarUint()
+	if err != nil {
+		return nil, err
+	}
+	return d.readBytes(n)
+}
+
+func (d *yjsDecoder) readVarString() (string, error) {
+	b, err := d.readVarBytes()
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// readAny returns the raw encoding of a lib0 "any" value without decoding it.
+func (d *yjsDecoder) readAny() ([]byte, error) {
+	start := d.pos
+	if err := d.skipAny(); err != nil {
+		return nil, err
+	}
+	return d.data[start:d.pos], nil
+}
+
+func (d *yjsDecoder) skipAny() error {
+	tag, err := d.readUint8()
+	if err != nil {
+		return err
+	}
+
+	switch tag {
+	case 127, 126, 121, 120: // undefined, null, false, true
+		return nil
+	case 125: // integer
+		return d.skipVarInt()
+	case 124: // float32
+		_, err = d.readBytes(4)
+	case 123, 122: // float64, bigint
+		_, err = d.readBytes(8)
+	case 119, 116: // string, Uint8Array
+		_, err = d.readVarBytes()
+	case 118: // object
+		var n uint64
+		if n, err = d.readVarUint(); err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, err := d.readVarBytes(); err != nil {
+				return err
+			}
+			if err := d.skipAny(); err != nil {
+				return err
+			}
+		}
+	case 117: // array
+		var n uint64
+		if n, err = d.readVarUint(); err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if err := d.skipAny(); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%w: unknown any type %d", ErrInvalidYjsUpdate, tag)
+	}
+	return err
+}
+
+type yjsEncoder struct {
+	buf []byte
+}
+
+func (e *yjsEncoder) writeUint8(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *yjsEncoder) writeVarUint(value uint64) {
+	for value >= 0x80 {
+		e.buf = append(e.buf, byte(value)|0x80)
+		value >>= 7
+	}
+	e.buf = append(e.buf, byte(value))
+}
+
+func (e *yjsEncoder) writeRaw(b []byte) {
+	e.buf = append(e.buf, b...)
+}
+
+func (e *yjsEncoder) writeVarBytes(b []byte) {
+	e.writeVarUint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *yjsEncoder) writeVarString(s string) {
+	e.writeVarUint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *yjsEncoder) bytes() []byte {
+	return e.buf
+}
@@ -0,0 +1,129 @@
+package collaboration
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestYjsVarUint(t *testing.T) {
+	tests := []struct {
+		value   uint64
+		encoded []byte
+	}{
+		{value: 0, encoded: []byte{0}},
+		{value: 127, encoded: []byte{127}},
+		{value: 128, encoded: []byte{128, 1}},
+		{value: 300, encoded: []byte{172, 2}},
+		{value: 2000, encoded: []byte{208, 15}},
+		{value: 1 << 32, encoded: []byte{128, 128, 128, 128, 16}},
+		{value: math.MaxUint64, encoded: []byte{255, 255, 255, 255, 255, 255, 255, 255, 255, 1}},
+	}
+
+	for _, tt := range tests {
+		e := &yjsEncoder{}
+		e.writeVarUint(tt.value)
+		if !bytes.Equal(e.bytes(), tt.encoded) {
+			t.Errorf("writeVarUint(%d) = %v, want %v", tt.value, e.bytes(), tt.encoded)
+		}
+
+		d := newYjsDecoder(tt.encoded)
+		value, err := d.readVarUint()
+		if err != nil || value != tt.value || d.hasContent() {
+			t.Errorf("readVarUint(%v) = %d, %v, want %d", tt.encoded, value, err, tt.value)
+		}
+	}
+}
+
+func TestYjsVarString(t *testing.T) {
+	for _, s := range []string{"", "text", "héllo 😀"} {
+		e := &yjsEncoder{}
+		e.writeVarString(s)
+
+		d := newYjsDecoder(e.bytes())
+		got, err := d.readVarString()
+		if err != nil || got != s || d.hasContent() {
+			t.Errorf("readVarString() = %q, %v, want %q", got, err, s)
+		}
+	}
+}
+
+func TestYjsReadAny(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded []byte
+	}{
+		{name: "undefined", encoded: []byte{127}},
+		{name: "null", encoded: []byte{126}},
+		{name: "integer", encoded: []byte{125, 172, 2}},
+		{name: "float32", encoded: []byte{124, 0, 0, 128, 63}},
+		{name: "float64", encoded: []byte{123, 63, 240, 0, 0, 0, 0, 0, 0}},
+		{name: "bigint", encoded: []byte{122, 0, 0, 0, 0, 0, 0, 0, 1}},
+		{name: "false", encoded: []byte{121}},
+		{name: "true", encoded: []byte{120}},
+		{name: "string", encoded: yjsData(119, "\x02hi")},
+		{name: "object", encoded: yjsData(118, 2, "\x01a", 125, 1, "\x01b", 117, 1, 120)},
+		{name: "array", encoded: yjsData(117, 3, 126, 119, "\x01x", 118, 0)},
+		{name: "Uint8Array", encoded: []byte{116, 2, 1, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The value is returned as is, and followed by the next one
+			d := newYjsDecoder(append(append([]byte(nil), tt.encoded...), 127))
+			got, err := d.readAny()
+			if err != nil {
+				t.Fatalf("readAny() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.encoded) {
+				t.Errorf("readAny() = %v, want %v", got, tt.encoded)
+			}
+			if next, err := d.readAny(); err != nil || !bytes.Equal(next, []byte{127}) {
+				t.Errorf("next readAny() = %v, %v, want [127]", next, err)
+			}
+		})
+	}
+}
+
+func TestYjsDecoderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		read func(d *yjsDecoder) error
+		data []byte
+	}{
+		{
+			name: "varuint past the end",
+			read: func(d *yjsDecoder) error { _, err := d.readVarUint(); return err },
+			data: []byte{128},
+		},
+		{
+			name: "varuint overflow",
+			read: func(d *yjsDecoder) error { _, err := d.readVarUint(); return err },
+			data: bytes.Repeat([]byte{255}, 11),
+		},
+		{
+			name: "string past the end",
+			read: func(d *yjsDecoder) error { _, err := d.readVarString(); return err },
+			data: yjsData(5, "abc"),
+		},
+		{
+			name: "any of an unknown type",
+			read: func(d *yjsDecoder) error { _, err := d.readAny(); return err },
+			data: []byte{100},
+		},
+		{
+			name: "array past the end",
+			read: func(d *yjsDecoder) error { _, err := d.readAny(); return err },
+			data: []byte{117, 2, 126},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.read(newYjsDecoder(tt.data)); !errors.Is(err, ErrInvalidYjsUpdate) {
+				t.Errorf("error = %v, want ErrInvalidYjsUpdate", err)
+			}
+		})
+	}
+}
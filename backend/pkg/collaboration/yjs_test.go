@@ -0,0 +1,317 @@
+package collaboration
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// Yjs v1 updates for a Y.Text named "text", written by two clients. Client
+// 1000 is encoded as 232 7 and client 2000 as 208 15.
+var (
+	// Client 1000 types "hello"
+	yjsHello = yjsData(1, 1, 232, 7, 0, yjsContentString, 1, "\x04text", "\x05hello", 0)
+	// Client 2000 types " world" after the "o" of 1000
+	yjsWorld = yjsData(1, 1, 208, 15, 0, yjsContentString|yjsHasOrigin, 232, 7, 4, "\x06 world", 0)
+	// Client 1000 deletes the "h"
+	yjsDeleteH = yjsData(0, 1, 232, 7, 1, 0, 1)
+	// Client 1000 types "!" after the "d" of 2000
+	yjsBang = yjsData(1, 1, 232, 7, 5, yjsContentString|yjsHasOrigin, 208, 15, 5, "\x01!", 0)
+	// Client 1000 types "?" at clock 7, after changes at clocks 5 and 6 that
+	// have not arrived
+	yjsQuestion = yjsData(1, 1, 232, 7, 7, yjsContentString|yjsHasOrigin, 232, 7, 4, "\x01?", 0)
+
+	// All of the above but the question mark, as merged by the server:
+	// clients in descending order, the structs of a client in clock order
+	yjsMerged = yjsData(
+		2,
+		1, 208, 15, 0, yjsContentString|yjsHasOrigin, 232, 7, 4, "\x06 world",
+		2, 232, 7, 0, yjsContentString, 1, "\x04text", "\x05hello",
+		yjsContentString|yjsHasOrigin, 208, 15, 5, "\x01!",
+		1, 232, 7, 1, 0, 1,
+	)
+)
+
+func TestMergeYjsUpdates(t *testing.T) {
+	tests := []struct {
+		name    string
+		updates [][]byte
+		want    []byte
+	}{
+		{
+			name:    "a single update is unchanged",
+			updates: [][]byte{yjsHello},
+			want:    yjsHello,
+		},
+		{
+			name:    "updates in order",
+			updates: [][]byte{yjsHello, yjsWorld, yjsDeleteH, yjsBang},
+			want:    yjsMerged,
+		},
+		{
+			name:    "updates out of order and redelivered",
+			updates: [][]byte{yjsBang, yjsDeleteH, yjsWorld, yjsHello, yjsWorld, yjsHello, yjsDeleteH},
+			want:    yjsMerged,
+		},
+		{
+			name:    "merged updates merge again",
+			updates: [][]byte{yjsMerged, yjsHello, yjsMerged},
+			want:    yjsMerged,
+		},
+		{
+			name:    "missing clocks become a skip",
+			updates: [][]byte{yjsQuestion, yjsHello},
+			want: yjsData(
+				1,
+				3, 232, 7, 0, yjsContentString, 1, "\x04text", "\x05hello",
+				yjsStructSkip, 2,
+				yjsContentString|yjsHasOrigin, 232, 7, 4, "\x01?",
+				0,
+			),
+		},
+		{
+			name: "overlapping deletes",
+			updates: [][]byte{
+				yjsData(0, 1, 232, 7, 2, 0, 2, 4, 1),
+				yjsData(0, 1, 232, 7, 1, 1, 3),
+			},
+			want: yjsData(0, 1, 232, 7, 1, 0, 5),
+		},
+		{
+			name: "a map entry",
+			updates: [][]byte{
+				// Client 9 sets "k" to "v" in the Y.Map "m"
+				yjsData(1, 1, 9, 0, yjsContentAny|yjsHasParentSub, 1, "\x01m", "\x01k", 1, 119, "\x01v", 0),
+			},
+			want: yjsData(1, 1, 9, 0, yjsContentAny|yjsHasParentSub, 1, "\x01m", "\x01k", 1, 119, "\x01v", 0),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MergeYjsUpdates(tt.updates...)
+			if err != nil {
+				t.Fatalf("MergeYjsUpdates() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("MergeYjsUpdates() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestYjsStateVectorFromUpdate(t *testing.T) {
+	tests := []struct {
+		name   string
+		update []byte
+		want   []byte
+	}{
+		{
+			name:   "empty update",
+			update: []byte{0, 0},
+			want:   []byte{0},
+		},
+		{
+			name:   "deletions only",
+			update: yjsDeleteH,
+			want:   []byte{0},
+		},
+		{
+			name:   "one client",
+			update: yjsHello,
+			want:   yjsData(1, 232, 7, 5),
+		},
+		{
+			name:   "several clients",
+			update: yjsMerged,
+			want:   yjsData(2, 208, 15, 6, 232, 7, 6),
+		},
+		{
+			name:   "a client not starting at zero",
+			update: yjsBang,
+			want:   []byte{0},
+		},
+		{
+			name:   "a client with a gap",
+			update: mustMergeYjs(t, yjsQuestion, yjsHello),
+			want:   yjsData(1, 232, 7, 5),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := YjsStateVectorFromUpdate(tt.update)
+			if err != nil {
+				t.Fatalf("YjsStateVectorFromUpdate() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("YjsStateVectorFromUpdate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffYjsUpdate(t *testing.T) {
+	tests := []struct {
+		name        string
+		update      []byte
+		stateVector []byte
+		want        []byte
+	}{
+		{
+			name:   "empty state vector",
+			update: yjsMerged,
+			want:   yjsMerged,
+		},
+		{
+			name:        "state vector of no clients",
+			update:      yjsMerged,
+			stateVector: []byte{0},
+			want:        yjsMerged,
+		},
+		{
+			name:        "up to date",
+			update:      yjsMerged,
+			stateVector: yjsData(2, 208, 15, 6, 232, 7, 6),
+			// Deletions are always sent
+			want: yjsData(0, 1, 232, 7, 1, 0, 1),
+		},
+		{
+			name:        "missing whole structs",
+			update:      yjsMerged,
+			stateVector: yjsData(2, 208, 15, 6, 232, 7, 5),
+			want: yjsData(
+				1,
+				1, 232, 7, 5, yjsContentString|yjsHasOrigin, 208, 15, 5, "\x01!",
+				1, 232, 7, 1, 0, 1,
+			),
+		},
+		{
+			name:        "missing part of a struct",
+			update:      yjsMerged,
+			stateVector: yjsData(1, 232, 7, 2),
+			// "llo" is cut from "hello" and placed after the "e"
+			want: yjsData(
+				2,
+				1, 208, 15, 0, yjsContentString|yjsHasOrigin, 232, 7, 4, "\x06 world",
+				2, 232, 7, 2, yjsContentString|yjsHasOrigin, 232, 7, 1, "\x03llo",
+				yjsContentString|yjsHasOrigin, 208, 15, 5, "\x01!",
+				1, 232, 7, 1, 0, 1,
+			),
+		},
+		{
+			name:        "a gap is not sent first",
+			update:      mustMergeYjs(t, yjsQuestion, yjsHello),
+			stateVector: yjsData(1, 232, 7, 5),
+			want:        yjsData(1, 1, 232, 7, 7, yjsContentString|yjsHasOrigin, 232, 7, 4, "\x01?", 0),
+		},
+		{
+			name: "a surrogate pair cut in half",
+			// Client 1 types "a😀" into the Y.Text "t"
+			update:      yjsData(1, 1, 1, 0, yjsContentString, 1, "\x01t", "\x05a😀", 0),
+			stateVector: yjsData(1, 1, 2),
+			want:        yjsData(1, 1, 1, 2, yjsContentString|yjsHasOrigin, 1, 1, "\x03�", 0),
+		},
+		{
+			name: "a surrogate pair kept whole",
+			// Client 1 types "a😀" into the Y.Text "t"
+			update:      yjsData(1, 1, 1, 0, yjsContentString, 1, "\x01t", "\x05a😀", 0),
+			stateVector: yjsData(1, 1, 1),
+			want:        yjsData(1, 1, 1, 1, yjsContentString|yjsHasOrigin, 1, 0, "\x04😀", 0),
+		},
+		{
+			name: "part of an array",
+			// Client 5 pushes 3 and "x" onto the Y.Array "list"
+			update:      yjsData(1, 1, 5, 0, yjsContentAny, 1, "\x04list", 2, 125, 3, 119, "\x01x", 0),
+			stateVector: yjsData(1, 5, 1),
+			want:        yjsData(1, 1, 5, 1, yjsContentAny|yjsHasOrigin, 5, 0, 1, 119, "\x01x", 0),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DiffYjsUpdate(tt.update, tt.stateVector)
+			if err != nil {
+				t.Fatalf("DiffYjsUpdate() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("DiffYjsUpdate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDiffYjsUpdateCatchesUp checks that a client merging the diff for its
+// state vector ends up with the full state.
+func TestDiffYjsUpdateCatchesUp(t *testing.T) {
+	client := mustMergeYjs(t, yjsHello, yjsWorld)
+	stateVector, err := YjsStateVectorFromUpdate(client)
+	if err != nil {
+		t.Fatalf("YjsStateVectorFromUpdate() error = %v", err)
+	}
+
+	diff, err := DiffYjsUpdate(yjsMerged, stateVector)
+	if err != nil {
+		t.Fatalf("DiffYjsUpdate() error = %v", err)
+	}
+
+	if got := mustMergeYjs(t, client, diff); !bytes.Equal(got, yjsMerged) {
+		t.Errorf("merged diff = %v, want %v", got, yjsMerged)
+	}
+}
+
+func TestYjsInvalidUpdates(t *testing.T) {
+	tests := []struct {
+		name   string
+		update []byte
+	}{
+		{name: "empty", update: nil},
+		{name: "truncated", update: yjsHello[:len(yjsHello)-3]},
+		{name: "trailing data", update: append(append([]byte(nil), yjsHello...), 0)},
+		{name: "unknown content", update: yjsData(1, 1, 1, 0, 11, 1, "\x01t", 0)},
+		{name: "empty string", update: yjsData(1, 1, 1, 0, yjsContentString, 1, "\x01t", "\x00", 0)},
+		{name: "unknown any", update: yjsData(1, 1, 1, 0, yjsContentAny, 1, "\x01t", 1, 100, 0)},
+		{name: "overlong varuint", update: yjsData(0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := MergeYjsUpdates(tt.update); !errors.Is(err, ErrInvalidYjsUpdate) {
+				t.Errorf("MergeYjsUpdates() error = %v, want ErrInvalidYjsUpdate", err)
+			}
+			if _, err := YjsStateVectorFromUpdate(tt.update); !errors.Is(err, ErrInvalidYjsUpdate) {
+				t.Errorf("YjsStateVectorFromUpdate() error = %v, want ErrInvalidYjsUpdate", err)
+			}
+		})
+	}
+
+	if _, err := DiffYjsUpdate(yjsHello, []byte{1, 232}); !errors.Is(err, ErrInvalidYjsUpdate) {
+		t.Errorf("DiffYjsUpdate() with a truncated state vector error = %v, want ErrInvalidYjsUpdate", err)
+	}
+}
+
+// yjsData concatenates bytes and strings; a string is written as is, so
+// varstrings carry their length as the first byte.
+func yjsData(parts ...any) []byte {
+	var data []byte
+	for _, part := range parts {
+		switch p := part.(type) {
+		case int:
+			data = append(data, byte(p))
+		case string:
+			data = append(data, p...)
+		default:
+			panic("unsupported part")
+		}
+	}
+	return data
+}
+
+func mustMergeYjs(t *testing.T, updates ...[]byte) []byte {
+	t.Helper()
+	merged, err := MergeYjsUpdates(updates...)
+	if err != nil {
+		t.Fatalf("MergeYjsUpdates() error = %v", err)
+	}
+	return merged
+}
@@ -13,7 +13,13 @@ type Config struct {
 	Database    DatabaseConfig
 	Redis       RedisConfig
 	MQTT        MQTTConfig
+	PubSub      PubSubConfig
 	JWT         JWTConfig
+	Presence    PresenceConfig
+	Outbox      OutboxConfig
+	History     HistoryConfig
+	Checkpoint  CheckpointConfig
+	Versions    VersionsConfig
 }
 
 type ServerConfig struct {
@@ -30,12 +36,68 @@ type DatabaseConfig struct {
 }
 
 type RedisConfig struct {
-	Host string
-	Port int
+	Host     string
+	Port     int
+	Password string
 }
 
 type MQTTConfig struct {
 	BrokerURL string
+	// CredentialTTL is how long the broker credentials issued to clients
+	// and to the server itself last, and AuthPort the port of the HTTP
+	// endpoints the broker checks them against.
+	CredentialTTL time.Duration
+	AuthPort      int
+	// Embedded runs an MQTT broker within the server, listening for TCP and
+	// WebSocket clients on EmbeddedTCPPort and EmbeddedWSPort.
+	Embedded        bool
+	EmbeddedTCPPort int
+	EmbeddedWSPort  int
+}
+
+// PubSubConfig selects the transport that carries changes and presence
+// between replicas: "mqtt", "redis" (Redis streams), "postgres" (LISTEN/NOTIFY)
+// or "memory" (a single replica only).
+type PubSubConfig struct {
+	Driver string
+}
+
+type PresenceConfig struct {
+	// Timeout is how long a connection may go without a heartbeat before it
+	// is evicted from its session.
+	Timeout      time.Duration
+	ReapInterval time.Duration
+}
+
+// OutboxConfig controls the relay that broadcasts committed changes.
+// PollInterval bounds the delay of a broadcast whose relay was not notified,
+// e.g. after a restart, and delivered broadcasts are kept for Retention.
+type OutboxConfig struct {
+	PollInterval time.Duration
+	Retention    time.Duration
+}
+
+// HistoryConfig controls the compaction of the collaboration history. Logged
+// changes are kept for at least Retention, and compacted every
+// CompactionInterval.
+type HistoryConfig struct {
+	CompactionInterval time.Duration
+	Retention          time.Duration
+}
+
+// CheckpointConfig controls the automatic versions of live-edited documents,
+// taken after MaxChanges changes or once a document was idle for IdleTimeout.
+type CheckpointConfig struct {
+	MaxChanges  int
+	IdleTimeout time.Duration
+}
+
+// VersionsConfig controls pruning of the version history: unpinned versions
+// older than Retention are deleted every PruneInterval, keeping the latest
+// version of each document.
+type VersionsConfig struct {
+	PruneInterval time.Duration
+	Retention     time.Duration
 }
 
 type JWTConfig struct {
@@ -59,17 +121,47 @@ func Load() (*Config, error) {
 			SSLMode:  getEnvOrDefault("DB_SSLMODE", "disable"),
 		},
 		Redis: RedisConfig{
-			Host: getEnvOrDefault("REDIS_HOST", "localhost"),
-			Port: getEnvAsIntOrDefault("REDIS_PORT", 6379),
+			Host:     getEnvOrDefault("REDIS_HOST", "localhost"),
+			Port:     getEnvAsIntOrDefault("REDIS_PORT", 6379),
+			Password: getEnvOrDefault("REDIS_PASSWORD", ""),
 		},
 		MQTT: MQTTConfig{
-			BrokerURL: getEnvOrDefault("MQTT_BROKER", "mqtt://localhost:1883"),
+			BrokerURL:     getEnvOrDefault("MQTT_BROKER", "mqtt://localhost:1883"),
+			CredentialTTL: getEnvAsDurationOrDefault("MQTT_CREDENTIAL_TTL", 15*time.Minute),
+			AuthPort:      getEnvAsIntOrDefault("MQTT_AUTH_PORT", 8081),
+
+			Embedded:        getEnvAsBoolOrDefault("MQTT_EMBEDDED", false),
+			EmbeddedTCPPort: getEnvAsIntOrDefault("MQTT_EMBEDDED_TCP_PORT", 1883),
+			EmbeddedWSPort:  getEnvAsIntOrDefault("MQTT_EMBEDDED_WS_PORT", 9001),
+		},
+		PubSub: PubSubConfig{
+			Driver: getEnvOrDefault("PUBSUB_DRIVER", "mqtt"),
 		},
 		JWT: JWTConfig{
 			Secret:          getEnvOrDefault("JWT_SECRET", "your_jwt_secret_here"),
 			ExpiryDuration:  getEnvAsDurationOrDefault("JWT_EXPIRY", 24*time.Hour),
 			RefreshDuration: getEnvAsDurationOrDefault("REFRESH_TOKEN_EXPIRY", 720*time.Hour),
 		},
+		Presence: PresenceConfig{
+			Timeout:      getEnvAsDurationOrDefault("PRESENCE_TIMEOUT", time.Minute),
+			ReapInterval: getEnvAsDurationOrDefault("PRESENCE_REAP_INTERVAL", 15*time.Second),
+		},
+		Outbox: OutboxConfig{
+			PollInterval: getEnvAsDurationOrDefault("OUTBOX_POLL_INTERVAL", time.Second),
+			Retention:    getEnvAsDurationOrDefault("OUTBOX_RETENTION", time.Hour),
+		},
+		History: HistoryConfig{
+			CompactionInterval: getEnvAsDurationOrDefault("HISTORY_COMPACTION_INTERVAL", 10*time.Minute),
+			Retention:          getEnvAsDurationOrDefault("HISTORY_RETENTION", 24*time.Hour),
+		},
+		Checkpoint: CheckpointConfig{
+			MaxChanges:  getEnvAsIntOrDefault("CHECKPOINT_MAX_CHANGES", 200),
+			IdleTimeout: getEnvAsDurationOrDefault("CHECKPOINT_IDLE_TIMEOUT", 2*time.Minute),
+		},
+		Versions: VersionsConfig{
+			PruneInterval: getEnvAsDurationOrDefault("VERSION_PRUNE_INTERVAL", time.Hour),
+			Retention:     getEnvAsDurationOrDefault("VERSION_RETENTION", 2160*time.Hour),
+		},
 	}
 
 	return config, nil
@@ -82,6 +174,10 @@ func (c *DatabaseConfig) GetConnectionString() string {
 	)
 }
 
+func (c *RedisConfig) GetAddress() string {
+	return fmt.Sprintf("%s:%d", c.Host, c.Port)
+}
+
 func getEnvOrDefault(key, defaultValue string) string {
 	if value, exists := os.LookupEnv(key); exists {
 		return value
@@ -98,6 +194,15 @@ func getEnvAsIntOrDefault(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getEnvAsBoolOrDefault(key string, defaultValue bool) bool {
+	if value, exists := os.LookupEnv(key); exists {
+		if boolVal, err := strconv.ParseBool(value); err == nil {
+			return boolVal
+		}
+	}
+	return defaultValue
+}
+
 func getEnvAsDurationOrDefault(key string, defaultValue time.Duration) time.Duration {
 	if value, exists := os.LookupEnv(key); exists {
 		if duration, err := time.ParseDuration(value); err == nil {
@@ -0,0 +1,33 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/HardMax71/syncwrite/backend/pkg/config"
+	"github.com/HardMax71/syncwrite/backend/pkg/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+func NewRedis(cfg *config.RedisConfig) (*redis.Client, error) {
+	logger := utils.Logger()
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.GetAddress(),
+		Password: cfg.Password,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Verify connection
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("error pinging redis: %w", err)
+	}
+
+	logger.Info("Successfully connected to Redis")
+
+	return client, nil
+}
@@ -0,0 +1,150 @@
+package document
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Authorship.
+//
+// Every document stores who last edited each part of its text, as spans
+// covering the text in order. Lengths are UTF-16 code units, the unit live
+// edits address text in. Live edits splice the spans they touch, and
+// replacing the whole text attributes what differs from the old text. Adjacent
+// spans of the same user are merged, keeping the later edit time, so the
+// spans only grow with the number of changes of author.
+
+// AuthorshipSpan is a run of text last edited by one user. Text written
+// before authorship was tracked has no user.
+type AuthorshipSpan struct {
+	Length   int       `json:"length"`
+	UserID   string    `json:"user_id,omitempty"`
+	EditedAt time.Time `json:"edited_at"`
+}
+
+type Authorship []AuthorshipSpan
+
+// NewAuthorship attributes the whole of text to a user.
+func NewAuthorship(text, userID string, at time.Time) Authorship {
+	return Authorship{}.add(AuthorshipSpan{Length: utf16Length(text), UserID: userID, EditedAt: at})
+}
+
+// LoadAuthorship decodes the stored authorship of text. Text whose authorship
+// was not stored, or no longer matches it, is attributed to no one.
+func LoadAuthorship(data []byte, text string) Authorship {
+	var authorship Authorship
+	if data != nil {
+		if err := json.Unmarshal(data, &authorship); err != nil {
+			authorship = nil
+		}
+	}
+
+	if authorship.Len() != utf16Length(text) {
+		return Authorship{}.add(AuthorshipSpan{Length: utf16Length(text)})
+	}
+	return authorship
+}
+
+// Len returns the length of the text the spans cover.
+func (a Authorship) Len() int {
+	length := 0
+	for _, span := range a {
+		length += span.Length
+	}
+	return length
+}
+
+// Splice replaces deleted code units at position with inserted code units
+// written by a user.
+func (a Authorship) Splice(position, deleted, inserted int, userID string, at time.Time) Authorship {
+	length := a.Len()
+	position = min(max(position, 0), length)
+	end := min(position+max(deleted, 0), length)
+
+	result := a.slice(0, position)
+	result = result.add(AuthorshipSpan{Length: inserted, UserID: userID, EditedAt: at})
+	for _, span := range a.slice(end, length) {
+		result = result.add(span)
+	}
+	return result
+}
+
+// Rewrite attributes the parts of newText that differ from oldText, the text
+// the spans cover, to a user.
+func (a Authorship) Rewrite(oldText, newText, userID string, at time.Time) Authorship {
+	oldRunes, newRunes := []rune(oldText), []rune(newText)
+
+	result := a
+	position, deleted, inserted := 0, 0, 0
+	flush := func() {
+		if deleted > 0 || inserted > 0 {
+			result = result.Splice(position, deleted, inserted, userID, at)
+			position += inserted
+			deleted, inserted = 0, 0
+		}
+	}
+
+	for _, e := range diffTokens(oldRunes, newRunes) {
+		switch e.kind {
+		case editEqual:
+			flush()
+			position += utf16Width(newRunes[e.newIndex])
+		case editDelete:
+			deleted += utf16Width(oldRunes[e.oldIndex])
+		case editInsert:
+			inserted += utf16Width(newRunes[e.newIndex])
+		}
+	}
+	flush()
+
+	return result
+}
+
+// slice returns the spans covering code units from to to.
+func (a Authorship) slice(from, to int) Authorship {
+	var result Authorship
+	offset := 0
+	for _, span := range a {
+		start, end := max(offset, from), min(offset+span.Length, to)
+		offset += span.Length
+		if start < end {
+			span.Length = end - start
+			result = result.add(span)
+		}
+	}
+	return result
+}
+
+// add appends a span, merging it into the last one if both are by the same
+// user.
+func (a Authorship) add(span AuthorshipSpan) Authorship {
+	if span.Length <= 0 {
+		return a
+	}
+
+	if last := len(a) - 1; last >= 0 && a[last].UserID == span.UserID {
+		a[last].Length += span.Length
+		if span.EditedAt.After(a[last].EditedAt) {
+			a[last].EditedAt = span.EditedAt
+		}
+		return a
+	}
+	return append(a, span)
+}
+
+// utf16Width returns the number of UTF-16 code units encoding r.
+func utf16Width(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+// utf16Length returns the length of text in UTF-16 code units.
+func utf16Length(text string) int {
+	length := 0
+	for _, r := range text {
+		length += utf16Width(r)
+	}
+	return length
+}
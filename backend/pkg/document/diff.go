@@ -0,0 +1,335 @@
+package document
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Version diffs.
+//
+// Two texts are split into tokens, either words or characters, and compared
+// with Myers' algorithm. The changes are grouped into hunks, each holding the
+// deleted and inserted text along with the requested number of unchanged
+// tokens around it. Inserted text is attributed to the editor of the version
+// that inserted it, found by following it back through the versions between
+// the two being compared.
+
+// maxDiffEdits bounds the work spent on a diff. Texts further apart than this
+// many edits are treated as replaced between their common prefix and suffix.
+const maxDiffEdits = 2000
+
+type editKind int
+
+const (
+	editEqual editKind = iota
+	editDelete
+	editInsert
+)
+
+// edit is one step of a diff: keeping, deleting or inserting the token at
+// oldIndex or newIndex.
+type edit struct {
+	kind     editKind
+	oldIndex int
+	newIndex int
+}
+
+// revision is a text and the author of what it inserted, nil if unknown.
+type revision struct {
+	text   string
+	author *Contributor
+}
+
+// diffTokens returns the edits turning a into b.
+func diffTokens[T comparable](a, b []T) []edit {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	edits := make([]edit, 0, len(a)+len(b)-prefix-suffix)
+	for i := 0; i < prefix; i++ {
+		edits = append(edits, edit{kind: editEqual, oldIndex: i, newIndex: i})
+	}
+
+	oldMiddle, newMiddle := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	middle, ok := myers(oldMiddle, newMiddle)
+	if !ok {
+		middle = middle[:0]
+		for i := range oldMiddle {
+			middle = append(middle, edit{kind: editDelete, oldIndex: i})
+		}
+		for i := range newMiddle {
+			middle = append(middle, edit{kind: editInsert, newIndex: i})
+		}
+	}
+	for _, e := range middle {
+		e.oldIndex += prefix
+		e.newIndex += prefix
+		edits = append(edits, e)
+	}
+
+	for i := suffix; i > 0; i-- {
+		edits = append(edits, edit{kind: editEqual, oldIndex: len(a) - i, newIndex: len(b) - i})
+	}
+	return edits
+}
+
+// myers finds the shortest edit script turning a into b, and reports false if
+// it takes more than maxDiffEdits edits.
+func myers[T comparable](a, b []T) ([]edit, bool) {
+	n, m := len(a), len(b)
+	maxD := min(n+m, maxDiffEdits)
+	offset := maxD + 1
+
+	// v holds the furthest x reached on every diagonal k = x - y; trace holds
+	// the diagonals around -d..d before every step d, to walk the path back
+	v := make([]int, 2*maxD+3)
+	var trace [][]int
+
+	found := false
+	for d := 0; d <= maxD && !found; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		return nil, false
+	}
+
+	var edits []edit
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		window := trace[d]
+		at := func(k int) int { return window[k+d+1] }
+
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			edits = append(edits, edit{kind: editEqual, oldIndex: x, newIndex: y})
+		}
+		if d > 0 {
+			if x == prevX {
+				edits = append(edits, edit{kind: editInsert, newIndex: prevY})
+			} else {
+				edits = append(edits, edit{kind: editDelete, oldIndex: prevX})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits, true
+}
+
+// tokenize splits a text into characters or into words, runs of whitespace
+// and single punctuation characters.
+func tokenize(text, granularity string) []string {
+	var tokens []string
+	if granularity == DiffGranularityCharacter {
+		for _, r := range text {
+			tokens = append(tokens, string(r))
+		}
+		return tokens
+	}
+
+	start := 0
+	lastClass := 0
+	for i, r := range text {
+		class := runeClass(r)
+		if i > start && (class != lastClass || class == 0) {
+			tokens = append(tokens, text[start:i])
+			start = i
+		}
+		lastClass = class
+	}
+	if start < len(text) {
+		tokens = append(tokens, text[start:])
+	}
+	return tokens
+}
+
+// runeClass returns 1 for word characters, 2 for whitespace and 0 for anything
+// else, which makes up a token on its own.
+func runeClass(r rune) int {
+	switch {
+	case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_':
+		return 1
+	case unicode.IsSpace(r):
+		return 2
+	default:
+		return 0
+	}
+}
+
+// attribute returns the author of every character of the last revision,
+// following the words each revision inserted through the later ones. The
+// text of base has no known author.
+func attribute(base string, revisions []revision) []*Contributor {
+	tokens := tokenize(base, DiffGranularityWord)
+	authors := make([]*Contributor, len(tokens))
+
+	for _, rev := range revisions {
+		next := tokenize(rev.text, DiffGranularityWord)
+		nextAuthors := make([]*Contributor, len(next))
+		for _, e := range diffTokens(tokens, next) {
+			switch e.kind {
+			case editEqual:
+				nextAuthors[e.newIndex] = authors[e.oldIndex]
+			case editInsert:
+				nextAuthors[e.newIndex] = rev.author
+			}
+		}
+		tokens, authors = next, nextAuthors
+	}
+
+	var characters []*Contributor
+	for i, token := range tokens {
+		for range token {
+			characters = append(characters, authors[i])
+		}
+	}
+	return characters
+}
+
+// diffTexts compares two texts, keeping context unchanged tokens around every
+// change. authors holds the author of every character of newText.
+func diffTexts(oldText, newText, granularity string, context int, authors []*Contributor) ([]*DiffHunk, int, int) {
+	oldTokens := tokenize(oldText, granularity)
+	newTokens := tokenize(newText, granularity)
+	edits := diffTokens(oldTokens, newTokens)
+
+	// Character offsets of every edit
+	oldOffsets := make([]int, len(edits)+1)
+	newOffsets := make([]int, len(edits)+1)
+	for i, e := range edits {
+		oldOffsets[i+1], newOffsets[i+1] = oldOffsets[i], newOffsets[i]
+		switch e.kind {
+		case editEqual:
+			oldOffsets[i+1] += utf8.RuneCountInString(oldTokens[e.oldIndex])
+			newOffsets[i+1] += utf8.RuneCountInString(newTokens[e.newIndex])
+		case editDelete:
+			oldOffsets[i+1] += utf8.RuneCountInString(oldTokens[e.oldIndex])
+		case editInsert:
+			newOffsets[i+1] += utf8.RuneCountInString(newTokens[e.newIndex])
+		}
+	}
+
+	var hunks []*DiffHunk
+	inserted, deleted := 0, 0
+	for i := 0; i < len(edits); {
+		if edits[i].kind == editEqual {
+			i++
+			continue
+		}
+
+		// Extend the hunk over changes no more than twice the context apart
+		end := i
+		for j := i; j < len(edits) && j-end <= 2*context; j++ {
+			if edits[j].kind != editEqual {
+				end = j + 1
+			}
+		}
+		start := max(i-context, 0)
+		stop := min(end+context, len(edits))
+
+		var spans spanBuilder
+		for j := start; j < stop; j++ {
+			e := edits[j]
+			switch e.kind {
+			case editEqual:
+				spans.add(DiffSpanEqual, newTokens[e.newIndex], nil)
+			case editDelete:
+				spans.add(DiffSpanDelete, oldTokens[e.oldIndex], nil)
+				deleted += utf8.RuneCountInString(oldTokens[e.oldIndex])
+			case editInsert:
+				offset := newOffsets[j]
+				for _, r := range newTokens[e.newIndex] {
+					var author *Contributor
+					if offset < len(authors) {
+						author = authors[offset]
+					}
+					spans.add(DiffSpanInsert, string(r), author)
+					offset++
+					inserted++
+				}
+			}
+		}
+
+		hunks = append(hunks, &DiffHunk{
+			OldStart:  oldOffsets[start],
+			OldLength: oldOffsets[stop] - oldOffsets[start],
+			NewStart:  newOffsets[start],
+			NewLength: newOffsets[stop] - newOffsets[start],
+			Spans:     spans.spans(),
+		})
+		i = end
+	}
+
+	return hunks, inserted, deleted
+}
+
+// spanBuilder joins consecutive text of the same kind and author into spans.
+type spanBuilder struct {
+	kinds   []string
+	authors []*Contributor
+	texts   []*strings.Builder
+}
+
+func (b *spanBuilder) add(kind, text string, author *Contributor) {
+	last := len(b.kinds) - 1
+	if last < 0 || b.kinds[last] != kind || b.authors[last] != author {
+		b.kinds = append(b.kinds, kind)
+		b.authors = append(b.authors, author)
+		b.texts = append(b.texts, &strings.Builder{})
+		last++
+	}
+	b.texts[last].WriteString(text)
+}
+
+func (b *spanBuilder) spans() []*DiffSpan {
+	spans := make([]*DiffSpan, len(b.kinds))
+	for i := range b.kinds {
+		spans[i] = &DiffSpan{
+			Kind:   b.kinds[i],
+			Text:   b.texts[i].String(),
+			Author: b.authors[i],
+		}
+	}
+	return spans
+}
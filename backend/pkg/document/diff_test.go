@@ -0,0 +1,395 @@
+package document
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		// edits is the number of inserted and deleted tokens of the shortest
+		// script
+		edits int
+	}{
+		{name: "both empty", a: "", b: "", edits: 0},
+		{name: "equal", a: "abc", b: "abc", edits: 0},
+		{name: "from empty", a: "", b: "abc", edits: 3},
+		{name: "to empty", a: "abc", b: "", edits: 3},
+		{name: "insert in the middle", a: "abcd", b: "abXYcd", edits: 2},
+		{name: "delete in the middle", a: "abXYcd", b: "abcd", edits: 2},
+		{name: "replace", a: "abcd", b: "aXYd", edits: 4},
+		{name: "several changes", a: "ABCABBA", b: "CBABAC", edits: 5},
+		{name: "nothing in common", a: "abc", b: "xyz", edits: 6},
+		{name: "repeated tokens", a: "aaaa", b: "aaaaaa", edits: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := []rune(tt.a), []rune(tt.b)
+			edits := diffTokens(a, b)
+			checkEdits(t, a, b, edits)
+			if got := changedTokens(edits); got != tt.edits {
+				t.Errorf("diffTokens() has %d changes, want %d", got, tt.edits)
+			}
+		})
+	}
+}
+
+// TestDiffTokensShortest compares the edits of random texts with the length of
+// their longest common subsequence.
+func TestDiffTokensShortest(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	text := func() []rune {
+		s := make([]rune, r.Intn(40))
+		for i := range s {
+			s[i] = rune('a' + r.Intn(3))
+		}
+		return s
+	}
+
+	for i := 0; i < 1000; i++ {
+		a, b := text(), text()
+		edits := diffTokens(a, b)
+		checkEdits(t, a, b, edits)
+		if got, want := changedTokens(edits), len(a)+len(b)-2*longestCommonSubsequence(a, b); got != want {
+			t.Fatalf("diffTokens(%q, %q) has %d changes, want %d", string(a), string(b), got, want)
+		}
+	}
+}
+
+// TestDiffTokensFallback checks that texts further apart than maxDiffEdits are
+// treated as replaced between their common prefix and suffix.
+func TestDiffTokensFallback(t *testing.T) {
+	middleA := strings.Repeat("a", maxDiffEdits)
+	middleB := strings.Repeat("b", maxDiffEdits)
+	a := []rune("prefix " + middleA + " suffix")
+	b := []rune("prefix " + middleB + " suffix")
+
+	edits := diffTokens(a, b)
+	checkEdits(t, a, b, edits)
+
+	prefix, suffix := len("prefix "), len(" suffix")
+	var want []edit
+	for i := 0; i < prefix; i++ {
+		want = append(want, edit{kind: editEqual, oldIndex: i, newIndex: i})
+	}
+	for i := range middleA {
+		want = append(want, edit{kind: editDelete, oldIndex: prefix + i, newIndex: prefix})
+	}
+	for i := range middleB {
+		want = append(want, edit{kind: editInsert, oldIndex: prefix, newIndex: prefix + i})
+	}
+	for i := suffix; i > 0; i-- {
+		want = append(want, edit{kind: editEqual, oldIndex: len(a) - i, newIndex: len(b) - i})
+	}
+	if !reflect.DeepEqual(edits, want) {
+		t.Errorf("diffTokens() did not replace the middle")
+	}
+
+	// Within the bound the shortest script is still found
+	if _, ok := myers([]rune(middleA[:maxDiffEdits/4]), []rune(middleB[:maxDiffEdits/4])); !ok {
+		t.Errorf("myers() gave up within maxDiffEdits")
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name        string
+		text        string
+		granularity string
+		want        []string
+	}{
+		{
+			name:        "empty",
+			text:        "",
+			granularity: DiffGranularityWord,
+			want:        nil,
+		},
+		{
+			name:        "words and whitespace",
+			text:        "the  quick\tbrown\nfox",
+			granularity: DiffGranularityWord,
+			want:        []string{"the", "  ", "quick", "\t", "brown", "\n", "fox"},
+		},
+		{
+			name:        "punctuation stands alone",
+			text:        "Hi!! (ok)",
+			granularity: DiffGranularityWord,
+			want:        []string{"Hi", "!", "!", " ", "(", "ok", ")"},
+		},
+		{
+			name:        "digits, underscores and letters of any script",
+			text:        "x_1 héllo wörld 日本",
+			granularity: DiffGranularityWord,
+			want:        []string{"x_1", " ", "héllo", " ", "wörld", " ", "日本"},
+		},
+		{
+			name:        "characters",
+			text:        "aé 😀",
+			granularity: DiffGranularityCharacter,
+			want:        []string{"a", "é", " ", "😀"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenize(tt.text, tt.granularity); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tokenize() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDiffTexts applies the hunks of every diff to the old text and checks
+// that they reproduce the new one.
+func TestDiffTexts(t *testing.T) {
+	texts := []struct {
+		name     string
+		old, new string
+	}{
+		{name: "equal", old: "same text", new: "same text"},
+		{name: "from empty", old: "", new: "new text"},
+		{name: "to empty", old: "old text", new: ""},
+		{name: "one word", old: "The quick brown fox.", new: "The quick red fox."},
+		{
+			name: "changes far apart",
+			old:  "one two three four five six seven eight nine ten",
+			new:  "zero one two three four five six eight nine ten eleven",
+		},
+		{name: "multibyte", old: "naïve café 😀 ok", new: "naive café 😃 ok!"},
+		{name: "lines", old: "a\nb\nc\n", new: "a\nB\nc\nd\n"},
+	}
+
+	for _, tt := range texts {
+		for _, granularity := range []string{DiffGranularityWord, DiffGranularityCharacter} {
+			for _, context := range []int{0, 1, 3} {
+				hunks, inserted, deleted := diffTexts(tt.old, tt.new, granularity, context, nil)
+
+				if got := applyHunks(t, tt.old, hunks); got != tt.new {
+					t.Errorf("%s, %s, context %d: hunks produce %q, want %q", tt.name, granularity, context, got, tt.new)
+				}
+
+				var wantInserted, wantDeleted int
+				for _, hunk := range hunks {
+					for _, span := range hunk.Spans {
+						switch span.Kind {
+						case DiffSpanInsert:
+							wantInserted += len([]rune(span.Text))
+						case DiffSpanDelete:
+							wantDeleted += len([]rune(span.Text))
+						}
+					}
+				}
+				if inserted != wantInserted || deleted != wantDeleted {
+					t.Errorf("%s, %s, context %d: counted %d inserted and %d deleted, want %d and %d",
+						tt.name, granularity, context, inserted, deleted, wantInserted, wantDeleted)
+				}
+				if tt.old == tt.new && len(hunks) != 0 {
+					t.Errorf("%s: equal texts have %d hunks", tt.name, len(hunks))
+				}
+			}
+		}
+	}
+}
+
+func TestDiffTextsHunks(t *testing.T) {
+	old := "one two three four five six seven eight nine ten"
+	new := "one TWO three four five six seven eight NINE ten"
+
+	// Changes more than twice the context apart get hunks of their own
+	hunks, _, _ := diffTexts(old, new, DiffGranularityWord, 1, nil)
+	want := [][]*DiffSpan{
+		{
+			{Kind: DiffSpanEqual, Text: " "},
+			{Kind: DiffSpanDelete, Text: "two"},
+			{Kind: DiffSpanInsert, Text: "TWO"},
+			{Kind: DiffSpanEqual, Text: " "},
+		},
+		{
+			{Kind: DiffSpanEqual, Text: " "},
+			{Kind: DiffSpanDelete, Text: "nine"},
+			{Kind: DiffSpanInsert, Text: "NINE"},
+			{Kind: DiffSpanEqual, Text: " "},
+		},
+	}
+	if len(hunks) != len(want) {
+		t.Fatalf("got %d hunks, want %d", len(hunks), len(want))
+	}
+	for i, hunk := range hunks {
+		if !reflect.DeepEqual(hunk.Spans, want[i]) {
+			t.Errorf("hunk %d has spans %s, want %s", i, formatSpans(hunk.Spans), formatSpans(want[i]))
+		}
+	}
+	if hunks[1].OldStart != 39 || hunks[1].OldLength != 6 || hunks[1].NewStart != 39 || hunks[1].NewLength != 6 {
+		t.Errorf("second hunk covers old %d+%d, new %d+%d, want 39+6 for both",
+			hunks[1].OldStart, hunks[1].OldLength, hunks[1].NewStart, hunks[1].NewLength)
+	}
+
+	// The 13 tokens between the changes fit in twice a context of 7
+	if hunks, _, _ := diffTexts(old, new, DiffGranularityWord, 6, nil); len(hunks) != 2 {
+		t.Errorf("got %d hunks with context 6, want 2", len(hunks))
+	}
+	if hunks, _, _ := diffTexts(old, new, DiffGranularityWord, 7, nil); len(hunks) != 1 {
+		t.Errorf("got %d hunks, want 1", len(hunks))
+	}
+}
+
+// TestDiffTextsAttribution follows inserted text back to the versions that
+// inserted it.
+func TestDiffTextsAttribution(t *testing.T) {
+	alice := &Contributor{UserID: "1", Username: "alice"}
+	bob := &Contributor{UserID: "2", Username: "bob"}
+
+	base := "The quick brown fox jumps over the lazy dog."
+	revisions := []revision{
+		{text: "The quick red fox jumps over the lazy dog. Maybe.", author: alice},
+		// Bob changes a word and replaces Alice's sentence
+		{text: "The quick red fox leaps over the lazy dog. Done!", author: bob},
+		// Saved without an editor, e.g. the current text
+		{text: "The quick red fox leaps over the lazy dog. Done!"},
+	}
+	newText := revisions[len(revisions)-1].text
+
+	authors := attribute(base, revisions)
+	if len(authors) != len([]rune(newText)) {
+		t.Fatalf("attribute() returned %d authors for %d characters", len(authors), len([]rune(newText)))
+	}
+
+	hunks, _, _ := diffTexts(base, newText, DiffGranularityWord, 0, authors)
+	if got := applyHunks(t, base, hunks); got != newText {
+		t.Fatalf("hunks produce %q, want %q", got, newText)
+	}
+
+	type attributed struct{ text, author string }
+	var got []attributed
+	for _, hunk := range hunks {
+		for _, span := range hunk.Spans {
+			if span.Kind != DiffSpanInsert {
+				continue
+			}
+			author := ""
+			if span.Author != nil {
+				author = span.Author.Username
+			}
+			got = append(got, attributed{span.Text, author})
+		}
+	}
+
+	want := []attributed{
+		{"red", "alice"},
+		{"leaps", "bob"},
+		// The space came with Alice's sentence, which Bob replaced
+		{" ", "alice"},
+		{"Done!", "bob"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("inserted %v, want %v", got, want)
+	}
+}
+
+// checkEdits checks that edits turn a into b, keeping and deleting every token
+// of a in order.
+func checkEdits(t *testing.T, a, b []rune, edits []edit) {
+	t.Helper()
+	var result []rune
+	next := 0
+	for _, e := range edits {
+		switch e.kind {
+		case editEqual:
+			if e.oldIndex != next || a[e.oldIndex] != b[e.newIndex] {
+				t.Fatalf("bad equal edit %+v", e)
+			}
+			result = append(result, a[e.oldIndex])
+			next++
+		case editDelete:
+			if e.oldIndex != next {
+				t.Fatalf("bad delete edit %+v", e)
+			}
+			next++
+		case editInsert:
+			result = append(result, b[e.newIndex])
+		}
+	}
+	if next != len(a) || string(result) != string(b) {
+		t.Fatalf("edits turn %q into %q, want %q", string(a), string(result), string(b))
+	}
+}
+
+func changedTokens(edits []edit) int {
+	changed := 0
+	for _, e := range edits {
+		if e.kind != editEqual {
+			changed++
+		}
+	}
+	return changed
+}
+
+func longestCommonSubsequence(a, b []rune) int {
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			if a[i-1] == b[j-1] {
+				lengths[i][j] = lengths[i-1][j-1] + 1
+			} else {
+				lengths[i][j] = max(lengths[i-1][j], lengths[i][j-1])
+			}
+		}
+	}
+	return lengths[len(a)][len(b)]
+}
+
+// applyHunks applies hunks to old text, checking that each one matches the
+// text it covers.
+func applyHunks(t *testing.T, oldText string, hunks []*DiffHunk) string {
+	t.Helper()
+	old := []rune(oldText)
+
+	var result strings.Builder
+	offset := 0
+	for i, hunk := range hunks {
+		if hunk.OldStart < offset || hunk.OldStart+hunk.OldLength > len(old) {
+			t.Fatalf("hunk %d covers old %d+%d, out of order or range", i, hunk.OldStart, hunk.OldLength)
+		}
+		if result.Len() > 0 && len([]rune(result.String()))+hunk.OldStart-offset != hunk.NewStart {
+			t.Fatalf("hunk %d starts at new offset %d, want %d", i, hunk.NewStart, len([]rune(result.String()))+hunk.OldStart-offset)
+		}
+		result.WriteString(string(old[offset:hunk.OldStart]))
+
+		var before, after strings.Builder
+		for _, span := range hunk.Spans {
+			if span.Kind != DiffSpanInsert {
+				before.WriteString(span.Text)
+			}
+			if span.Kind != DiffSpanDelete {
+				after.WriteString(span.Text)
+			}
+		}
+		if covered := string(old[hunk.OldStart : hunk.OldStart+hunk.OldLength]); before.String() != covered {
+			t.Fatalf("hunk %d removes %q, but covers %q", i, before.String(), covered)
+		}
+		if n := len([]rune(after.String())); n != hunk.NewLength {
+			t.Fatalf("hunk %d has %d new characters, want %d", i, n, hunk.NewLength)
+		}
+
+		result.WriteString(after.String())
+		offset = hunk.OldStart + hunk.OldLength
+	}
+	result.WriteString(string(old[offset:]))
+	return result.String()
+}
+
+func formatSpans(spans []*DiffSpan) string {
+	var parts []string
+	for _, span := range spans {
+		parts = append(parts, span.Kind+" "+strings.ReplaceAll(span.Text, " ", "_"))
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
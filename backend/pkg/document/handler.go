@@ -25,14 +25,20 @@ func (h *Handler) CreateDocument(ctx context.Context, req *documentv1.CreateDocu
 	}
 
 	params := CreateDocumentParams{
-		Title:   req.Title,
-		Content: req.Content,
-		OwnerID: user.ID,
+		Title:    req.Title,
+		Content:  req.Content,
+		OwnerID:  user.ID,
+		SyncMode: convertSyncModeFromProto(req.SyncMode),
 	}
 
 	doc, err := h.service.CreateDocument(ctx, params)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "error creating document")
+		switch err {
+		case ErrInvalidSyncMode:
+			return nil, status.Error(codes.InvalidArgument, "invalid sync mode")
+		default:
+			return nil, status.Error(codes.Internal, "error creating document")
+		}
 	}
 
 	return &documentv1.DocumentResponse{
@@ -86,6 +92,8 @@ func (h *Handler) UpdateDocument(ctx context.Context, req *documentv1.UpdateDocu
 			return nil, status.Error(codes.FailedPrecondition, "version mismatch")
 		case ErrPermissionDenied:
 			return nil, status.Error(codes.PermissionDenied, "permission denied")
+		case ErrYjsDocument:
+			return nil, yjsDocumentError()
 		default:
 			return nil, status.Error(codes.Internal, "internal error")
 		}
@@ -205,18 +213,15 @@ func (h *Handler) GetDocumentHistory(ctx context.Context, req *documentv1.GetDoc
 
 	versions, total, err := h.service.GetDocumentHistory(ctx, req.DocumentId, req.Page, req.PageSize)
 	if err != nil {
+		if err == ErrYjsDocument {
+			return nil, yjsDocumentError()
+		}
 		return nil, status.Error(codes.Internal, "error retrieving document history")
 	}
 
 	protoVersions := make([]*documentv1.DocumentVersion, len(versions))
 	for i, version := range versions {
-		protoVersions[i] = &documentv1.DocumentVersion{
-			Id:         version.ID,
-			DocumentId: version.DocumentID,
-			Content:    version.Content,
-			EditorId:   version.EditorID,
-			CreatedAt:  timestamppb.New(version.CreatedAt),
-		}
+		protoVersions[i] = convertVersionToProto(version)
 	}
 
 	return &documentv1.GetDocumentHistoryResponse{
@@ -238,6 +243,8 @@ func (h *Handler) RestoreVersion(ctx context.Context, req *documentv1.RestoreVer
 			return nil, status.Error(codes.NotFound, "document not found")
 		case ErrPermissionDenied:
 			return nil, status.Error(codes.PermissionDenied, "permission denied")
+		case ErrYjsDocument:
+			return nil, yjsDocumentError()
 		default:
 			return nil, status.Error(codes.Internal, "internal error")
 		}
@@ -248,6 +255,153 @@ func (h *Handler) RestoreVersion(ctx context.Context, req *documentv1.RestoreVer
 	}, nil
 }
 
+func (h *Handler) NameVersion(ctx context.Context, req *documentv1.NameVersionRequest) (*documentv1.DocumentVersionResponse, error) {
+	user, err := auth.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := h.service.NameVersion(ctx, NameVersionParams{
+		DocumentID:  req.DocumentId,
+		VersionID:   req.VersionId,
+		UserID:      user.ID,
+		Name:        req.Name,
+		Description: req.Description,
+	})
+	if err != nil {
+		return nil, versionError(err)
+	}
+
+	return &documentv1.DocumentVersionResponse{
+		Version: convertVersionToProto(version),
+	}, nil
+}
+
+func (h *Handler) PinVersion(ctx context.Context, req *documentv1.PinVersionRequest) (*documentv1.DocumentVersionResponse, error) {
+	user, err := auth.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := h.service.PinVersion(ctx, req.DocumentId, req.VersionId, user.ID, req.Pinned)
+	if err != nil {
+		return nil, versionError(err)
+	}
+
+	return &documentv1.DocumentVersionResponse{
+		Version: convertVersionToProto(version),
+	}, nil
+}
+
+func (h *Handler) ListNamedVersions(ctx context.Context, req *documentv1.ListNamedVersionsRequest) (*documentv1.GetDocumentHistoryResponse, error) {
+	user, err := auth.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check document access first
+	if _, err := h.service.GetDocument(ctx, req.DocumentId, user.ID); err != nil {
+		switch err {
+		case ErrDocumentNotFound:
+			return nil, status.Error(codes.NotFound, "document not found")
+		case ErrPermissionDenied:
+			return nil, status.Error(codes.PermissionDenied, "permission denied")
+		default:
+			return nil, status.Error(codes.Internal, "internal error")
+		}
+	}
+
+	versions, total, err := h.service.ListNamedVersions(ctx, req.DocumentId, req.Page, req.PageSize)
+	if err != nil {
+		if err == ErrYjsDocument {
+			return nil, yjsDocumentError()
+		}
+		return nil, status.Error(codes.Internal, "error retrieving named versions")
+	}
+
+	protoVersions := make([]*documentv1.DocumentVersion, len(versions))
+	for i, version := range versions {
+		protoVersions[i] = convertVersionToProto(version)
+	}
+
+	return &documentv1.GetDocumentHistoryResponse{
+		Versions: protoVersions,
+		Total:    total,
+	}, nil
+}
+
+func (h *Handler) DiffVersions(ctx context.Context, req *documentv1.DiffVersionsRequest) (*documentv1.DiffVersionsResponse, error) {
+	user, err := auth.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check document access first
+	if _, err := h.service.GetDocument(ctx, req.DocumentId, user.ID); err != nil {
+		switch err {
+		case ErrDocumentNotFound:
+			return nil, status.Error(codes.NotFound, "document not found")
+		case ErrPermissionDenied:
+			return nil, status.Error(codes.PermissionDenied, "permission denied")
+		default:
+			return nil, status.Error(codes.Internal, "internal error")
+		}
+	}
+
+	diff, err := h.service.DiffVersions(ctx, DiffVersionsParams{
+		DocumentID:    req.DocumentId,
+		FromVersionID: req.FromVersionId,
+		ToVersionID:   req.ToVersionId,
+		Granularity:   convertDiffGranularityFromProto(req.Granularity),
+		Context:       int(req.Context),
+	})
+	if err != nil {
+		switch err {
+		case ErrInvalidDiffGranularity:
+			return nil, status.Error(codes.InvalidArgument, "invalid diff granularity")
+		default:
+			return nil, versionError(err)
+		}
+	}
+
+	hunks := make([]*documentv1.DiffHunk, len(diff.Hunks))
+	for i, hunk := range diff.Hunks {
+		hunks[i] = convertDiffHunkToProto(hunk)
+	}
+
+	return &documentv1.DiffVersionsResponse{
+		FromVersion: diff.FromVersion,
+		ToVersion:   diff.ToVersion,
+		Hunks:       hunks,
+		Inserted:    int32(diff.Inserted),
+		Deleted:     int32(diff.Deleted),
+	}, nil
+}
+
+// versionError maps an error from looking up a version to a status.
+func versionError(err error) error {
+	switch err {
+	case ErrDocumentNotFound:
+		return status.Error(codes.NotFound, "document not found")
+	case ErrVersionNotFound:
+		return status.Error(codes.NotFound, "version not found")
+	case ErrPermissionDenied:
+		return status.Error(codes.PermissionDenied, "permission denied")
+	case ErrInvalidVersionName:
+		return status.Errorf(codes.InvalidArgument, "version name must be at most %d characters", maxVersionNameLength)
+	case ErrYjsDocument:
+		return yjsDocumentError()
+	default:
+		return status.Error(codes.Internal, "internal error")
+	}
+}
+
+// yjsDocumentError is the status for text writes and text history of
+// documents in Yjs sync mode.
+func yjsDocumentError() error {
+	return status.Error(codes.FailedPrecondition, "documents in Yjs sync mode are edited through Yjs updates and have no text history")
+}
+
 // Helper functions for converting between domain and proto types
 func convertDocumentToProto(doc *Document) *documentv1.Document {
 	return &documentv1.Document{
@@ -256,11 +410,97 @@ func convertDocumentToProto(doc *Document) *documentv1.Document {
 		Content:   doc.Content,
 		OwnerId:   doc.OwnerID,
 		Version:   doc.Version,
+		SyncMode:  convertSyncModeToProto(doc.SyncMode),
 		CreatedAt: timestamppb.New(doc.CreatedAt),
 		UpdatedAt: timestamppb.New(doc.UpdatedAt),
 	}
 }
 
+func convertVersionToProto(version *DocumentVersion) *documentv1.DocumentVersion {
+	contributors := make([]*documentv1.VersionContributor, len(version.Contributors))
+	for i, contributor := range version.Contributors {
+		contributors[i] = &documentv1.VersionContributor{
+			UserId:   contributor.UserID,
+			Username: contributor.Username,
+		}
+	}
+
+	return &documentv1.DocumentVersion{
+		Id:           version.ID,
+		DocumentId:   version.DocumentID,
+		Content:      version.Content,
+		EditorId:     version.EditorID,
+		EditorName:   version.EditorName,
+		Version:      version.Version,
+		Kind:         convertVersionKindToProto(version.Kind),
+		Summary:      version.Summary,
+		Contributors: contributors,
+		Name:         version.Name,
+		Description:  version.Description,
+		Pinned:       version.Pinned,
+		CreatedAt:    timestamppb.New(version.CreatedAt),
+	}
+}
+
+func convertVersionKindToProto(kind string) documentv1.VersionKind {
+	switch kind {
+	case VersionKindManual:
+		return documentv1.VersionKind_VERSION_KIND_MANUAL
+	case VersionKindRestore:
+		return documentv1.VersionKind_VERSION_KIND_RESTORE
+	case VersionKindAutomatic:
+		return documentv1.VersionKind_VERSION_KIND_AUTOMATIC
+	default:
+		return documentv1.VersionKind_VERSION_KIND_UNSPECIFIED
+	}
+}
+
+func convertDiffHunkToProto(hunk *DiffHunk) *documentv1.DiffHunk {
+	spans := make([]*documentv1.DiffSpan, len(hunk.Spans))
+	for i, span := range hunk.Spans {
+		spans[i] = &documentv1.DiffSpan{
+			Kind: convertDiffSpanKindToProto(span.Kind),
+			Text: span.Text,
+		}
+		if span.Author != nil {
+			spans[i].AuthorId = span.Author.UserID
+			spans[i].AuthorName = span.Author.Username
+		}
+	}
+
+	return &documentv1.DiffHunk{
+		OldStart:  int32(hunk.OldStart),
+		OldLength: int32(hunk.OldLength),
+		NewStart:  int32(hunk.NewStart),
+		NewLength: int32(hunk.NewLength),
+		Spans:     spans,
+	}
+}
+
+func convertDiffSpanKindToProto(kind string) documentv1.DiffSpanKind {
+	switch kind {
+	case DiffSpanEqual:
+		return documentv1.DiffSpanKind_DIFF_SPAN_KIND_EQUAL
+	case DiffSpanInsert:
+		return documentv1.DiffSpanKind_DIFF_SPAN_KIND_INSERT
+	case DiffSpanDelete:
+		return documentv1.DiffSpanKind_DIFF_SPAN_KIND_DELETE
+	default:
+		return documentv1.DiffSpanKind_DIFF_SPAN_KIND_UNSPECIFIED
+	}
+}
+
+func convertDiffGranularityFromProto(granularity documentv1.DiffGranularity) string {
+	switch granularity {
+	case documentv1.DiffGranularity_DIFF_GRANULARITY_WORD:
+		return DiffGranularityWord
+	case documentv1.DiffGranularity_DIFF_GRANULARITY_CHARACTER:
+		return DiffGranularityCharacter
+	default:
+		return ""
+	}
+}
+
 func convertPermissionLevelToProto(level string) documentv1.PermissionLevel {
 	switch level {
 	case PermissionLevelViewer:
@@ -286,3 +526,29 @@ func convertPermissionLevelFromProto(level documentv1.PermissionLevel) string {
 		return ""
 	}
 }
+
+func convertSyncModeToProto(mode string) documentv1.SyncMode {
+	switch mode {
+	case SyncModeOT:
+		return documentv1.SyncMode_SYNC_MODE_OT
+	case SyncModeCRDT:
+		return documentv1.SyncMode_SYNC_MODE_CRDT
+	case SyncModeYJS:
+		return documentv1.SyncMode_SYNC_MODE_YJS
+	default:
+		return documentv1.SyncMode_SYNC_MODE_UNSPECIFIED
+	}
+}
+
+func convertSyncModeFromProto(mode documentv1.SyncMode) string {
+	switch mode {
+	case documentv1.SyncMode_SYNC_MODE_OT:
+		return SyncModeOT
+	case documentv1.SyncMode_SYNC_MODE_CRDT:
+		return SyncModeCRDT
+	case documentv1.SyncMode_SYNC_MODE_YJS:
+		return SyncModeYJS
+	default:
+		return ""
+	}
+}
@@ -9,18 +9,64 @@ type Document struct {
 	Title     string    `json:"title"`
 	Content   string    `json:"content"`
 	OwnerID   string    `json:"owner_id"`
-	Version   string    `json:"version"`
+	Version   int64     `json:"version"`
+	SyncMode  string    `json:"sync_mode"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+// DocumentVersion is a checkpoint in the version history of a document. Live
+// edits between checkpoints are only kept by the collaboration history.
 type DocumentVersion struct {
-	ID         string    `json:"id"`
-	DocumentID string    `json:"document_id"`
-	Content    string    `json:"content"`
-	EditorID   string    `json:"editor_id"`
-	Version    string    `json:"version"`
-	CreatedAt  time.Time `json:"created_at"`
+	ID         string `json:"id"`
+	DocumentID string `json:"document_id"`
+	Content    string `json:"content"`
+	EditorID   string `json:"editor_id"`
+	EditorName string `json:"editor_name"`
+	Version    int64  `json:"version"`
+	Kind       string `json:"kind"`
+	Summary    string `json:"summary"`
+	// Name and Description label a version; unnamed versions have an empty
+	// name. Pinned versions are never pruned.
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Pinned      bool   `json:"pinned"`
+	// Contributors are the users whose edits the version includes.
+	Contributors []*Contributor `json:"contributors"`
+	CreatedAt    time.Time      `json:"created_at"`
+}
+
+type Contributor struct {
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+}
+
+// VersionDiff holds the changes between two versions of a document.
+// Inserted and Deleted count characters.
+type VersionDiff struct {
+	FromVersion int64
+	ToVersion   int64
+	Hunks       []*DiffHunk
+	Inserted    int
+	Deleted     int
+}
+
+// DiffHunk is a run of changes with the unchanged text around them. Offsets
+// and lengths count characters of the old and new text.
+type DiffHunk struct {
+	OldStart  int
+	OldLength int
+	NewStart  int
+	NewLength int
+	Spans     []*DiffSpan
+}
+
+// DiffSpan is a run of unchanged, inserted or deleted text. Author is set for
+// inserted text whose author is known.
+type DiffSpan struct {
+	Kind   string
+	Text   string
+	Author *Contributor
 }
 
 type Permission struct {
@@ -33,19 +79,39 @@ type Permission struct {
 }
 
 type CreateDocumentParams struct {
-	Title   string
-	Content string
-	OwnerID string
+	Title    string
+	Content  string
+	OwnerID  string
+	SyncMode string
 }
 
 type UpdateDocumentParams struct {
 	DocumentID string
 	Title      string
 	Content    string
-	Version    string
+	Version    int64
 	EditorID   string
 }
 
+type NameVersionParams struct {
+	DocumentID string
+	// VersionID is empty to name the current version.
+	VersionID   string
+	UserID      string
+	Name        string
+	Description string
+}
+
+type DiffVersionsParams struct {
+	DocumentID    string
+	FromVersionID string
+	// ToVersionID is empty to compare with the current document.
+	ToVersionID string
+	Granularity string
+	// Context is the number of unchanged tokens kept around every change.
+	Context int
+}
+
 type ShareDocumentParams struct {
 	DocumentID string
 	UserID     string
@@ -57,3 +123,36 @@ const (
 	PermissionLevelEditor = "EDITOR"
 	PermissionLevelOwner  = "OWNER"
 )
+
+// Kinds of versions: manual versions are saved through UpdateDocument,
+// restore versions by RestoreVersion, and automatic versions are checkpoints
+// of live edits taken by the collaboration service.
+const (
+	VersionKindManual    = "MANUAL"
+	VersionKindRestore   = "RESTORE"
+	VersionKindAutomatic = "AUTOMATIC"
+)
+
+// Diffs compare words, runs of whitespace and punctuation characters, or
+// single characters.
+const (
+	DiffGranularityWord      = "WORD"
+	DiffGranularityCharacter = "CHARACTER"
+)
+
+const (
+	DiffSpanEqual  = "EQUAL"
+	DiffSpanInsert = "INSERT"
+	DiffSpanDelete = "DELETE"
+)
+
+// Sync modes select how live edits of a document are merged: OT documents
+// take position-based operations through SyncDocument, CRDT documents take
+// ID-based operations through MergeOperations, and YJS documents take Yjs
+// binary updates through ApplyYjsUpdate. The content of a YJS document is only
+// updated by UpdateDocument, since the server does not resolve Yjs state.
+const (
+	SyncModeOT   = "OT"
+	SyncModeCRDT = "CRDT"
+	SyncModeYJS  = "YJS"
+)
@@ -2,22 +2,37 @@ package document
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
+	"unicode/utf8"
 
 	"github.com/HardMax71/syncwrite/backend/pkg/utils"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"go.uber.org/zap"
 )
 
 var (
-	ErrDocumentNotFound  = errors.New("document not found")
-	ErrVersionMismatch   = errors.New("version mismatch")
-	ErrPermissionDenied  = errors.New("permission denied")
-	ErrInvalidPermission = errors.New("invalid permission level")
+	ErrDocumentNotFound       = errors.New("document not found")
+	ErrVersionMismatch        = errors.New("version mismatch")
+	ErrPermissionDenied       = errors.New("permission denied")
+	ErrInvalidPermission      = errors.New("invalid permission level")
+	ErrInvalidSyncMode        = errors.New("invalid sync mode")
+	ErrVersionNotFound        = errors.New("version not found")
+	ErrInvalidVersionName     = errors.New("invalid version name")
+	ErrInvalidDiffGranularity = errors.New("invalid diff granularity")
+	// ErrYjsDocument is returned for writes of the text, and for the text
+	// history, of documents in Yjs sync mode. Their text lives in the Yjs
+	// state, which only Yjs updates change, so content keeps the text the
+	// document was created with.
+	ErrYjsDocument = errors.New("not supported for documents in Yjs sync mode")
 )
 
+const maxVersionNameLength = 255
+
 type Service struct {
 	db     *pgxpool.Pool
 	logger *zap.Logger
@@ -31,14 +46,29 @@ func NewService(db *pgxpool.Pool) *Service {
 }
 
 func (s *Service) CreateDocument(ctx context.Context, params CreateDocumentParams) (*Document, error) {
+	// Validate sync mode
+	switch params.SyncMode {
+	case "":
+		params.SyncMode = SyncModeOT
+	case SyncModeOT, SyncModeCRDT, SyncModeYJS:
+		// Valid modes
+	default:
+		return nil, ErrInvalidSyncMode
+	}
+
+	authorship, err := json.Marshal(NewAuthorship(params.Content, params.OwnerID, time.Now()))
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling authorship: %w", err)
+	}
+
 	var doc Document
-	err := s.db.QueryRow(ctx, `
-        INSERT INTO documents (title, content, owner_id, version)
-        VALUES ($1, $2, $3, $4)
-        RETURNING id, title, content, owner_id, version, created_at, updated_at
-    `, params.Title, params.Content, params.OwnerID, "1").Scan(
+	err = s.db.QueryRow(ctx, `
+        INSERT INTO documents (title, content, owner_id, version, sync_mode, authorship)
+        VALUES ($1, $2, $3, 1, $4, $5)
+        RETURNING id, title, content, owner_id, version, sync_mode, created_at, updated_at
+    `, params.Title, params.Content, params.OwnerID, params.SyncMode, authorship).Scan(
 		&doc.ID, &doc.Title, &doc.Content, &doc.OwnerID,
-		&doc.Version, &doc.CreatedAt, &doc.UpdatedAt,
+		&doc.Version, &doc.SyncMode, &doc.CreatedAt, &doc.UpdatedAt,
 	)
 
 	if err != nil {
@@ -55,19 +85,24 @@ func (s *Service) CreateDocument(ctx context.Context, params CreateDocumentParam
 		return nil, fmt.Errorf("error creating document permission: %w", err)
 	}
 
+	// Snapshot the initial state, which the collaboration history starts from
+	if err := snapshotDocument(ctx, s.db, doc.ID); err != nil {
+		return nil, err
+	}
+
 	return &doc, nil
 }
 
 func (s *Service) GetDocument(ctx context.Context, documentID, userID string) (*Document, error) {
 	var doc Document
 	err := s.db.QueryRow(ctx, `
-        SELECT d.id, d.title, d.content, d.owner_id, d.version, d.created_at, d.updated_at
+        SELECT d.id, d.title, d.content, d.owner_id, d.version, d.sync_mode, d.created_at, d.updated_at
         FROM documents d
         JOIN document_permissions p ON d.id = p.document_id
         WHERE d.id = $1 AND p.user_id = $2
     `, documentID, userID).Scan(
 		&doc.ID, &doc.Title, &doc.Content, &doc.OwnerID,
-		&doc.Version, &doc.CreatedAt, &doc.UpdatedAt,
+		&doc.Version, &doc.SyncMode, &doc.CreatedAt, &doc.UpdatedAt,
 	)
 
 	if err != nil {
@@ -86,10 +121,12 @@ func (s *Service) UpdateDocument(ctx context.Context, params UpdateDocumentParam
 	defer tx.Rollback(ctx)
 
 	// Check version
-	var currentVersion string
+	var currentVersion int64
+	var currentTitle, currentContent, syncMode string
+	var currentAuthorship []byte
 	err = tx.QueryRow(ctx, `
-        SELECT version FROM documents WHERE id = $1
-    `, params.DocumentID).Scan(&currentVersion)
+        SELECT version, title, COALESCE(content, ''), sync_mode, authorship FROM documents WHERE id = $1 FOR UPDATE
+    `, params.DocumentID).Scan(&currentVersion, &currentTitle, &currentContent, &syncMode, &currentAuthorship)
 
 	if err != nil {
 		return nil, ErrDocumentNotFound
@@ -99,6 +136,11 @@ func (s *Service) UpdateDocument(ctx context.Context, params UpdateDocumentParam
 		return nil, ErrVersionMismatch
 	}
 
+	// The title of a Yjs document may change, its text only through Yjs
+	if syncMode == SyncModeYJS && params.Content != currentContent {
+		return nil, ErrYjsDocument
+	}
+
 	// Check permission
 	var permissionLevel string
 	err = tx.QueryRow(ctx, `
@@ -114,17 +156,24 @@ func (s *Service) UpdateDocument(ctx context.Context, params UpdateDocumentParam
 		return nil, ErrPermissionDenied
 	}
 
-	// Update document
-	newVersion := fmt.Sprintf("%d", time.Now().UnixNano())
+	// Attribute the text that changed to the editor
+	authorship, err := json.Marshal(LoadAuthorship(currentAuthorship, currentContent).
+		Rewrite(currentContent, params.Content, params.EditorID, time.Now()))
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling authorship: %w", err)
+	}
+
+	// Update document. Replacing the whole text invalidates any CRDT state,
+	// which the collaboration service reseeds from the new content.
 	var doc Document
 	err = tx.QueryRow(ctx, `
         UPDATE documents
-        SET title = $1, content = $2, version = $3, updated_at = NOW()
+        SET title = $1, content = $2, authorship = $3, version = version + 1, crdt_state = NULL, updated_at = NOW()
         WHERE id = $4
-        RETURNING id, title, content, owner_id, version, created_at, updated_at
-    `, params.Title, params.Content, newVersion, params.DocumentID).Scan(
+        RETURNING id, title, content, owner_id, version, sync_mode, created_at, updated_at
+    `, params.Title, params.Content, authorship, params.DocumentID).Scan(
 		&doc.ID, &doc.Title, &doc.Content, &doc.OwnerID,
-		&doc.Version, &doc.CreatedAt, &doc.UpdatedAt,
+		&doc.Version, &doc.SyncMode, &doc.CreatedAt, &doc.UpdatedAt,
 	)
 
 	if err != nil {
@@ -133,14 +182,20 @@ func (s *Service) UpdateDocument(ctx context.Context, params UpdateDocumentParam
 
 	// Create version history
 	_, err = tx.Exec(ctx, `
-        INSERT INTO document_versions (document_id, content, editor_id, version)
-        VALUES ($1, $2, $3, $4)
-    `, doc.ID, params.Content, params.EditorID, newVersion)
+        INSERT INTO document_versions (document_id, content, editor_id, version, kind, summary, contributor_ids)
+        VALUES ($1, $2, $3, $4, $5, $6, ARRAY[$3::uuid])
+    `, doc.ID, params.Content, params.EditorID, doc.Version, VersionKindManual,
+		SummarizeEdit(currentTitle, params.Title, currentContent, params.Content))
 
 	if err != nil {
 		return nil, fmt.Errorf("error creating version history: %w", err)
 	}
 
+	// The new version is not a change the collaboration history can replay
+	if err := snapshotDocument(ctx, tx, doc.ID); err != nil {
+		return nil, err
+	}
+
 	// Commit transaction
 	if err := tx.Commit(ctx); err != nil {
 		return nil, fmt.Errorf("error committing transaction: %w", err)
@@ -190,6 +245,23 @@ func (s *Service) DeleteDocument(ctx context.Context, documentID, userID string)
 		return fmt.Errorf("error deleting versions: %w", err)
 	}
 
+	// Delete collaboration history
+	_, err = tx.Exec(ctx, `
+        DELETE FROM document_operations WHERE document_id = $1
+    `, documentID)
+
+	if err != nil {
+		return fmt.Errorf("error deleting operations: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+        DELETE FROM document_snapshots WHERE document_id = $1
+    `, documentID)
+
+	if err != nil {
+		return fmt.Errorf("error deleting snapshots: %w", err)
+	}
+
 	// Delete document
 	_, err = tx.Exec(ctx, `
         DELETE FROM documents WHERE id = $1
@@ -218,7 +290,7 @@ func (s *Service) ListDocuments(ctx context.Context, userID string, page, pageSi
 
 	// Get documents
 	rows, err := s.db.Query(ctx, `
-        SELECT d.id, d.title, d.content, d.owner_id, d.version, d.created_at, d.updated_at
+        SELECT d.id, d.title, d.content, d.owner_id, d.version, d.sync_mode, d.created_at, d.updated_at
         FROM documents d
         JOIN document_permissions p ON d.id = p.document_id
         WHERE p.user_id = $1
@@ -236,7 +308,7 @@ func (s *Service) ListDocuments(ctx context.Context, userID string, page, pageSi
 		var doc Document
 		err := rows.Scan(
 			&doc.ID, &doc.Title, &doc.Content, &doc.OwnerID,
-			&doc.Version, &doc.CreatedAt, &doc.UpdatedAt,
+			&doc.Version, &doc.SyncMode, &doc.CreatedAt, &doc.UpdatedAt,
 		)
 		if err != nil {
 			return nil, 0, fmt.Errorf("error scanning document: %w", err)
@@ -273,27 +345,66 @@ func (s *Service) ShareDocument(ctx context.Context, params ShareDocumentParams)
 	return &permission, nil
 }
 
+// GetPermissionLevel returns the permission level of a user on a document.
+func (s *Service) GetPermissionLevel(ctx context.Context, documentID, userID string) (string, error) {
+	var permissionLevel string
+	err := s.db.QueryRow(ctx, `
+        SELECT permission_level FROM document_permissions
+        WHERE document_id = $1 AND user_id = $2
+    `, documentID, userID).Scan(&permissionLevel)
+
+	if err != nil {
+		return "", ErrPermissionDenied
+	}
+
+	return permissionLevel, nil
+}
+
+// CheckEditPermission checks that a user may edit a document.
+func (s *Service) CheckEditPermission(ctx context.Context, documentID, userID string) error {
+	permissionLevel, err := s.GetPermissionLevel(ctx, documentID, userID)
+	if err != nil {
+		return err
+	}
+
+	if permissionLevel != PermissionLevelEditor && permissionLevel != PermissionLevelOwner {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
 func (s *Service) GetDocumentHistory(ctx context.Context, documentID string, page, pageSize int32) ([]*DocumentVersion, int32, error) {
+	return s.listVersions(ctx, documentID, false, page, pageSize)
+}
+
+// ListNamedVersions lists the versions of a document that were given a name.
+func (s *Service) ListNamedVersions(ctx context.Context, documentID string, page, pageSize int32) ([]*DocumentVersion, int32, error) {
+	return s.listVersions(ctx, documentID, true, page, pageSize)
+}
+
+func (s *Service) listVersions(ctx context.Context, documentID string, namedOnly bool, page, pageSize int32) ([]*DocumentVersion, int32, error) {
+	if err := s.checkTextHistory(ctx, documentID); err != nil {
+		return nil, 0, err
+	}
+
 	// Get total count
 	var total int32
 	err := s.db.QueryRow(ctx, `
         SELECT COUNT(*)
         FROM document_versions
-        WHERE document_id = $1
-    `, documentID).Scan(&total)
+        WHERE document_id = $1 AND (NOT $2 OR name IS NOT NULL)
+    `, documentID, namedOnly).Scan(&total)
 
 	if err != nil {
 		return nil, 0, fmt.Errorf("error counting versions: %w", err)
 	}
 
 	// Get versions
-	rows, err := s.db.Query(ctx, `
-        SELECT id, document_id, content, editor_id, version, created_at
-        FROM document_versions
-        WHERE document_id = $1
-        ORDER BY created_at DESC
-        LIMIT $2 OFFSET $3
-    `, documentID, pageSize, (page-1)*pageSize)
+	rows, err := s.db.Query(ctx, selectVersions+`
+        WHERE v.document_id = $1 AND (NOT $2 OR v.name IS NOT NULL)
+        ORDER BY v.version DESC
+        LIMIT $3 OFFSET $4
+    `, documentID, namedOnly, pageSize, (page-1)*pageSize)
 
 	if err != nil {
 		return nil, 0, fmt.Errorf("error querying versions: %w", err)
@@ -302,20 +413,332 @@ func (s *Service) GetDocumentHistory(ctx context.Context, documentID string, pag
 
 	var versions []*DocumentVersion
 	for rows.Next() {
-		var version DocumentVersion
-		err := rows.Scan(
-			&version.ID, &version.DocumentID, &version.Content,
-			&version.EditorID, &version.Version, &version.CreatedAt,
-		)
+		version, err := scanVersion(rows)
 		if err != nil {
-			return nil, 0, fmt.Errorf("error scanning version: %w", err)
+			return nil, 0, err
 		}
-		versions = append(versions, &version)
+		versions = append(versions, version)
 	}
 
 	return versions, total, nil
 }
 
+// NameVersion names a version and describes it; an empty name removes the
+// name. Without a version ID the current version of the document is named,
+// adding it to the version history if needed.
+func (s *Service) NameVersion(ctx context.Context, params NameVersionParams) (*DocumentVersion, error) {
+	if utf8.RuneCountInString(params.Name) > maxVersionNameLength {
+		return nil, ErrInvalidVersionName
+	}
+
+	if err := s.CheckEditPermission(ctx, params.DocumentID, params.UserID); err != nil {
+		return nil, err
+	}
+	if err := s.checkTextHistory(ctx, params.DocumentID); err != nil {
+		return nil, err
+	}
+
+	versionID := params.VersionID
+	if versionID == "" {
+		id, err := s.checkpointCurrentVersion(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		versionID = id
+	} else {
+		tag, err := s.db.Exec(ctx, `
+            UPDATE document_versions SET name = NULLIF($1, ''), description = $2
+            WHERE id = $3 AND document_id = $4
+        `, params.Name, params.Description, versionID, params.DocumentID)
+
+		if err != nil {
+			return nil, fmt.Errorf("error naming version: %w", err)
+		}
+		if tag.RowsAffected() == 0 {
+			return nil, ErrVersionNotFound
+		}
+	}
+
+	return s.getVersion(ctx, params.DocumentID, versionID)
+}
+
+// checkpointCurrentVersion names the current version of a document, adding
+// it to the version history as a manual version if it is not in it yet.
+func (s *Service) checkpointCurrentVersion(ctx context.Context, params NameVersionParams) (string, error) {
+	var version int64
+	var title, content string
+	err := s.db.QueryRow(ctx, `
+        SELECT version, title, COALESCE(content, '') FROM documents WHERE id = $1
+    `, params.DocumentID).Scan(&version, &title, &content)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrDocumentNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("error getting document: %w", err)
+	}
+
+	var previousContent string
+	err = s.db.QueryRow(ctx, `
+        SELECT content FROM document_versions
+        WHERE document_id = $1 AND version < $2
+        ORDER BY version DESC
+        LIMIT 1
+    `, params.DocumentID, version).Scan(&previousContent)
+
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return "", fmt.Errorf("error getting previous version: %w", err)
+	}
+
+	var versionID string
+	err = s.db.QueryRow(ctx, `
+        INSERT INTO document_versions
+            (document_id, content, editor_id, version, kind, summary, contributor_ids, name, description)
+        VALUES ($1, $2, $3, $4, $5, $6, ARRAY[$3::uuid], NULLIF($7, ''), $8)
+        ON CONFLICT (document_id, version) DO UPDATE
+        SET name = EXCLUDED.name, description = EXCLUDED.description
+        RETURNING id
+    `, params.DocumentID, content, params.UserID, version, VersionKindManual,
+		SummarizeEdit(title, title, previousContent, content), params.Name, params.Description).Scan(&versionID)
+
+	if err != nil {
+		return "", fmt.Errorf("error naming current version: %w", err)
+	}
+
+	return versionID, nil
+}
+
+// PinVersion pins or unpins a version. Pinned versions are never pruned.
+func (s *Service) PinVersion(ctx context.Context, documentID, versionID, userID string, pinned bool) (*DocumentVersion, error) {
+	if err := s.CheckEditPermission(ctx, documentID, userID); err != nil {
+		return nil, err
+	}
+	if err := s.checkTextHistory(ctx, documentID); err != nil {
+		return nil, err
+	}
+
+	tag, err := s.db.Exec(ctx, `
+        UPDATE document_versions SET pinned = $1 WHERE id = $2 AND document_id = $3
+    `, pinned, versionID, documentID)
+
+	if err != nil {
+		return nil, fmt.Errorf("error pinning version: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, ErrVersionNotFound
+	}
+
+	return s.getVersion(ctx, documentID, versionID)
+}
+
+// DiffVersions compares two versions of a document, or a version with the
+// current document. Text inserted after the older version is attributed to
+// the editor of the version that inserted it.
+func (s *Service) DiffVersions(ctx context.Context, params DiffVersionsParams) (*VersionDiff, error) {
+	switch params.Granularity {
+	case "":
+		params.Granularity = DiffGranularityWord
+	case DiffGranularityWord, DiffGranularityCharacter:
+	default:
+		return nil, ErrInvalidDiffGranularity
+	}
+
+	if err := s.checkTextHistory(ctx, params.DocumentID); err != nil {
+		return nil, err
+	}
+
+	from, err := s.getVersion(ctx, params.DocumentID, params.FromVersionID)
+	if err != nil {
+		return nil, err
+	}
+
+	var toVersion int64
+	var toContent string
+	if params.ToVersionID == "" {
+		err = s.db.QueryRow(ctx, `
+            SELECT version, COALESCE(content, '') FROM documents WHERE id = $1
+        `, params.DocumentID).Scan(&toVersion, &toContent)
+
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrDocumentNotFound
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error getting document: %w", err)
+		}
+	} else {
+		to, err := s.getVersion(ctx, params.DocumentID, params.ToVersionID)
+		if err != nil {
+			return nil, err
+		}
+		toVersion, toContent = to.Version, to.Content
+	}
+
+	// Follow the text inserted after the older version through the versions
+	// in between; text changed after the latest of them has no known author
+	var revisions []revision
+	if from.Version < toVersion {
+		revisions, err = s.revisionsBetween(ctx, params.DocumentID, from.Version, toVersion)
+		if err != nil {
+			return nil, err
+		}
+	}
+	revisions = append(revisions, revision{text: toContent})
+	authors := attribute(from.Content, revisions)
+
+	hunks, inserted, deleted := diffTexts(from.Content, toContent, params.Granularity, max(params.Context, 0), authors)
+	return &VersionDiff{
+		FromVersion: from.Version,
+		ToVersion:   toVersion,
+		Hunks:       hunks,
+		Inserted:    inserted,
+		Deleted:     deleted,
+	}, nil
+}
+
+// revisionsBetween returns the text and editor of the versions after
+// fromVersion, up to and including toVersion, in order.
+func (s *Service) revisionsBetween(ctx context.Context, documentID string, fromVersion, toVersion int64) ([]revision, error) {
+	rows, err := s.db.Query(ctx, `
+        SELECT v.content, v.editor_id, u.username
+        FROM document_versions v
+        JOIN users u ON v.editor_id = u.id
+        WHERE v.document_id = $1 AND v.version > $2 AND v.version <= $3
+        ORDER BY v.version
+    `, documentID, fromVersion, toVersion)
+
+	if err != nil {
+		return nil, fmt.Errorf("error querying versions: %w", err)
+	}
+	defer rows.Close()
+
+	var revisions []revision
+	for rows.Next() {
+		var rev revision
+		var editor Contributor
+		if err := rows.Scan(&rev.text, &editor.UserID, &editor.Username); err != nil {
+			return nil, fmt.Errorf("error scanning version: %w", err)
+		}
+		rev.author = &editor
+		revisions = append(revisions, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading versions: %w", err)
+	}
+
+	return revisions, nil
+}
+
+// StartVersionPruner deletes versions older than retention every interval
+// until ctx is done. Pinned versions and the latest version of each document
+// are kept.
+func (s *Service) StartVersionPruner(ctx context.Context, interval, retention time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+
+			pruned, err := s.pruneVersions(ctx, retention)
+			if err != nil {
+				s.logger.Error("Error pruning versions", zap.Error(err))
+				continue
+			}
+			if pruned > 0 {
+				s.logger.Info("Pruned versions", zap.Int64("count", pruned))
+			}
+		}
+	}()
+}
+
+func (s *Service) pruneVersions(ctx context.Context, retention time.Duration) (int64, error) {
+	tag, err := s.db.Exec(ctx, `
+        DELETE FROM document_versions v
+        WHERE v.created_at < $1 AND NOT v.pinned
+          AND v.version < (SELECT MAX(l.version) FROM document_versions l WHERE l.document_id = v.document_id)
+    `, time.Now().Add(-retention))
+
+	if err != nil {
+		return 0, fmt.Errorf("error deleting versions: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (s *Service) getVersion(ctx context.Context, documentID, versionID string) (*DocumentVersion, error) {
+	version, err := scanVersion(s.db.QueryRow(ctx, selectVersions+`
+        WHERE v.id = $1 AND v.document_id = $2
+    `, versionID, documentID))
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrVersionNotFound
+	}
+	return version, err
+}
+
+// checkTextHistory checks that the version history of a document follows its
+// text, which is not the case for documents in Yjs sync mode.
+func (s *Service) checkTextHistory(ctx context.Context, documentID string) error {
+	var syncMode string
+	err := s.db.QueryRow(ctx, `
+        SELECT sync_mode FROM documents WHERE id = $1
+    `, documentID).Scan(&syncMode)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrDocumentNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("error getting sync mode: %w", err)
+	}
+
+	if syncMode == SyncModeYJS {
+		return ErrYjsDocument
+	}
+	return nil
+}
+
+// selectVersions selects the columns scanVersion reads, with the names of the
+// editor and contributors.
+const selectVersions = `
+        SELECT v.id, v.document_id, v.content, v.editor_id, u.username, v.version, v.kind, v.summary,
+               v.name, v.description, v.pinned, v.created_at,
+               ARRAY(SELECT c.id::text FROM users c WHERE c.id = ANY(v.contributor_ids) ORDER BY c.username, c.id),
+               ARRAY(SELECT c.username FROM users c WHERE c.id = ANY(v.contributor_ids) ORDER BY c.username, c.id)
+        FROM document_versions v
+        JOIN users u ON v.editor_id = u.id`
+
+func scanVersion(row pgx.Row) (*DocumentVersion, error) {
+	var version DocumentVersion
+	var name *string
+	var contributorIDs, contributorNames []string
+	err := row.Scan(
+		&version.ID, &version.DocumentID, &version.Content, &version.EditorID,
+		&version.EditorName, &version.Version, &version.Kind, &version.Summary,
+		&name, &version.Description, &version.Pinned, &version.CreatedAt,
+		&contributorIDs, &contributorNames,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error scanning version: %w", err)
+	}
+
+	if name != nil {
+		version.Name = *name
+	}
+	for i := range contributorIDs {
+		version.Contributors = append(version.Contributors, &Contributor{
+			UserID:   contributorIDs[i],
+			Username: contributorNames[i],
+		})
+	}
+	return &version, nil
+}
+
 func (s *Service) RestoreVersion(ctx context.Context, documentID, versionID, userID string) (*Document, error) {
 	// Start transaction
 	tx, err := s.db.Begin(ctx)
@@ -341,26 +764,47 @@ func (s *Service) RestoreVersion(ctx context.Context, documentID, versionID, use
 
 	// Get version content
 	var versionContent string
+	var restoredVersion int64
 	err = tx.QueryRow(ctx, `
-        SELECT content FROM document_versions
+        SELECT content, version FROM document_versions
         WHERE id = $1 AND document_id = $2
-    `, versionID, documentID).Scan(&versionContent)
+    `, versionID, documentID).Scan(&versionContent, &restoredVersion)
+
+	if err != nil {
+		return nil, ErrDocumentNotFound
+	}
+
+	// Attribute the text that changed to the user restoring the version
+	var currentContent, syncMode string
+	var currentAuthorship []byte
+	err = tx.QueryRow(ctx, `
+        SELECT COALESCE(content, ''), sync_mode, authorship FROM documents WHERE id = $1 FOR UPDATE
+    `, documentID).Scan(&currentContent, &syncMode, &currentAuthorship)
 
 	if err != nil {
 		return nil, ErrDocumentNotFound
 	}
 
-	// Update document with version content
-	newVersion := fmt.Sprintf("%d", time.Now().UnixNano())
+	if syncMode == SyncModeYJS {
+		return nil, ErrYjsDocument
+	}
+
+	authorship, err := json.Marshal(LoadAuthorship(currentAuthorship, currentContent).
+		Rewrite(currentContent, versionContent, userID, time.Now()))
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling authorship: %w", err)
+	}
+
+	// Update document with version content, discarding any CRDT state
 	var doc Document
 	err = tx.QueryRow(ctx, `
         UPDATE documents
-        SET content = $1, version = $2, updated_at = NOW()
+        SET content = $1, authorship = $2, version = version + 1, crdt_state = NULL, updated_at = NOW()
         WHERE id = $3
-        RETURNING id, title, content, owner_id, version, created_at, updated_at
-    `, versionContent, newVersion, documentID).Scan(
+        RETURNING id, title, content, owner_id, version, sync_mode, created_at, updated_at
+    `, versionContent, authorship, documentID).Scan(
 		&doc.ID, &doc.Title, &doc.Content, &doc.OwnerID,
-		&doc.Version, &doc.CreatedAt, &doc.UpdatedAt,
+		&doc.Version, &doc.SyncMode, &doc.CreatedAt, &doc.UpdatedAt,
 	)
 
 	if err != nil {
@@ -369,14 +813,21 @@ func (s *Service) RestoreVersion(ctx context.Context, documentID, versionID, use
 
 	// Create version history entry for restoration
 	_, err = tx.Exec(ctx, `
-        INSERT INTO document_versions (document_id, content, editor_id, version)
-        VALUES ($1, $2, $3, $4)
-    `, doc.ID, versionContent, userID, newVersion)
+        INSERT INTO document_versions (document_id, content, editor_id, version, kind, summary, contributor_ids)
+        VALUES ($1, $2, $3, $4, $5, $6, ARRAY[$3::uuid])
+    `, doc.ID, versionContent, userID, doc.Version, VersionKindRestore,
+		fmt.Sprintf("Restored version %d", restoredVersion))
 
 	if err != nil {
 		return nil, fmt.Errorf("error creating version history: %w", err)
 	}
 
+	// The restored version is not a change the collaboration history can
+	// replay
+	if err := snapshotDocument(ctx, tx, doc.ID); err != nil {
+		return nil, err
+	}
+
 	// Commit transaction
 	if err := tx.Commit(ctx); err != nil {
 		return nil, fmt.Errorf("error committing transaction: %w", err)
@@ -384,3 +835,21 @@ func (s *Service) RestoreVersion(ctx context.Context, documentID, versionID, use
 
 	return &doc, nil
 }
+
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// snapshotDocument stores the current state of a document in the
+// collaboration history, for versions that replace the whole document.
+func snapshotDocument(ctx context.Context, db execer, documentID string) error {
+	_, err := db.Exec(ctx, `
+        INSERT INTO document_snapshots (document_id, version, content, crdt_state, yjs_state)
+        SELECT id, version, COALESCE(content, ''), crdt_state, yjs_state FROM documents WHERE id = $1
+    `, documentID)
+
+	if err != nil {
+		return fmt.Errorf("error creating snapshot: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package document
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// SummarizeEdit describes how a version differs from the one before it, for
+// the version history.
+func SummarizeEdit(oldTitle, newTitle, oldContent, newContent string) string {
+	var parts []string
+	if oldTitle != newTitle {
+		parts = append(parts, fmt.Sprintf("Renamed to %q", newTitle))
+	}
+
+	added, removed := countEdits(oldContent, newContent)
+	switch {
+	case added > 0 && removed > 0:
+		parts = append(parts, fmt.Sprintf("Added %s and removed %s", characters(added), characters(removed)))
+	case added > 0:
+		parts = append(parts, fmt.Sprintf("Added %s", characters(added)))
+	case removed > 0:
+		parts = append(parts, fmt.Sprintf("Removed %s", characters(removed)))
+	}
+
+	if len(parts) == 0 {
+		return "No changes"
+	}
+	return strings.Join(parts, ". ")
+}
+
+// countEdits counts the characters added and removed between two texts,
+// treating everything between their common prefix and suffix as replaced.
+func countEdits(oldText, newText string) (int, int) {
+	prefix := 0
+	for prefix < len(oldText) && prefix < len(newText) && oldText[prefix] == newText[prefix] {
+		prefix++
+	}
+	// Do not split a multi-byte character
+	for prefix > 0 && prefix < len(oldText) && !utf8.RuneStart(oldText[prefix]) {
+		prefix--
+	}
+
+	suffix := 0
+	for suffix < len(oldText)-prefix && suffix < len(newText)-prefix &&
+		oldText[len(oldText)-1-suffix] == newText[len(newText)-1-suffix] {
+		suffix++
+	}
+	for suffix > 0 && !utf8.RuneStart(oldText[len(oldText)-suffix]) {
+		suffix--
+	}
+
+	removed := utf8.RuneCountInString(oldText[prefix : len(oldText)-suffix])
+	added := utf8.RuneCountInString(newText[prefix : len(newText)-suffix])
+	return added, removed
+}
+
+func characters(n int) string {
+	if n == 1 {
+		return "1 character"
+	}
+	return fmt.Sprintf("%d characters", n)
+}
@@ -39,7 +39,9 @@ func ValidateToken(tokenString string, secret string) (*Claims, error) {
 		return nil, err
 	}
 
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+	// Tokens minted for other purposes, such as broker credentials, carry no
+	// user ID
+	if claims, ok := token.Claims.(*Claims); ok && token.Valid && claims.UserID != "" {
 		return claims, nil
 	}
 
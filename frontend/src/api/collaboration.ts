@@ -1,16 +1,24 @@
 import { createClient, getAuthHeader } from './grpc-client';
 import type {
     ActiveUser,
+    BrokerCredentials,
     DocumentChange,
+    GetBlameResponse,
     JoinSessionResponse,
     Operation,
+    ReplayEvent,
+    ReplayOptions,
     SyncDocumentResponse
 } from '../types/collaboration';
 import { connect } from 'mqtt';
 
+// Share of the broker credentials' lifetime after which they are renewed
+const CREDENTIAL_REFRESH_RATIO = 0.8;
+
 class CollaborationService {
     private client = createClient(CollaborationService);
     private mqttClient: any;
+    private refreshTimer: ReturnType<typeof setTimeout> | null = null;
     private subscriptions: Map<string, (change: DocumentChange) => void> = new Map();
 
     async joinSession(documentId: string): Promise<JoinSessionResponse> {
@@ -18,19 +26,35 @@ class CollaborationService {
             { documentId },
             { headers: getAuthHeader() }
         );
-        await this.connectMqtt(response.mqttTopic);
+        await this.connectMqtt(response.mqttTopic, response.brokerCredentials);
+        this.scheduleCredentialRefresh(documentId, response.brokerCredentials);
         return response;
     }
 
-    async leaveSession(sessionId: string, documentId: string): Promise<boolean> {
+    async getBrokerCredentials(documentId: string): Promise<BrokerCredentials> {
+        const response = await this.client.getBrokerCredentials(
+            { documentId },
+            { headers: getAuthHeader() }
+        );
+        return response.credentials;
+    }
+
+    async leaveSession(sessionId: string, documentId: string, connectionId: string): Promise<boolean> {
         const response = await this.client.leaveSession(
-            { sessionId, documentId },
+            { sessionId, documentId, connectionId },
             { headers: getAuthHeader() }
         );
         await this.disconnectMqtt();
         return response.success;
     }
 
+    async heartbeat(documentId: string, connectionId: string): Promise<void> {
+        await this.client.heartbeat(
+            { documentId, connectionId },
+            { headers: getAuthHeader() }
+        );
+    }
+
     async getActiveUsers(documentId: string): Promise<ActiveUser[]> {
         const response = await this.client.getActiveUsers(
             { documentId },
@@ -39,10 +63,41 @@ class CollaborationService {
         return response.users;
     }
 
+    async getBlame(documentId: string): Promise<GetBlameResponse> {
+        const response = await this.client.getBlame(
+            { documentId },
+            { headers: getAuthHeader() }
+        );
+        return {
+            version: response.version,
+            ranges: response.ranges,
+        };
+    }
+
+    // Plays back how a document was written: the state the replay starts from,
+    // then every change, paced by when it was originally made
+    async *replayHistory(documentId: string, options: ReplayOptions = {}): AsyncGenerator<ReplayEvent> {
+        const stream = this.client.replayHistory(
+            {
+                documentId,
+                fromVersion: options.fromVersion ?? 0,
+                toVersion: options.toVersion ?? 0,
+                speed: options.speed ?? 0,
+                maxGapMs: options.maxGapMs ?? 0,
+            },
+            { headers: getAuthHeader() }
+        );
+        for await (const response of stream) {
+            if (response.payload.case) {
+                yield response.payload as ReplayEvent;
+            }
+        }
+    }
+
     async syncDocument(
         documentId: string,
         operations: Operation[],
-        baseVersion: string
+        baseVersion: number
     ): Promise<SyncDocumentResponse> {
         return await this.client.syncDocument(
             { documentId, operations, baseVersion },
@@ -54,7 +109,42 @@ class CollaborationService {
         this.subscriptions.set(documentId, callback);
     }
 
-    private async connectMqtt(topic: string): Promise<void> {
+    // The broker only accepts credentials until they expire, so they are renewed
+    // ahead of time and the client reconnects with the new ones. The connect
+    // handler subscribes again, so subscriptions survive the reconnect.
+    private scheduleCredentialRefresh(documentId: string, credentials: BrokerCredentials) {
+        this.clearCredentialRefresh();
+
+        const ttl = new Date(credentials.expiresAt).getTime() - Date.now();
+        this.refreshTimer = setTimeout(async () => {
+            this.refreshTimer = null;
+            if (!this.mqttClient) {
+                return;
+            }
+
+            try {
+                const renewed = await this.getBrokerCredentials(documentId);
+                if (!this.mqttClient) {
+                    return;
+                }
+                this.mqttClient.options.username = renewed.username;
+                this.mqttClient.options.password = renewed.password;
+                this.mqttClient.end(true, {}, () => this.mqttClient?.reconnect());
+                this.scheduleCredentialRefresh(documentId, renewed);
+            } catch (err) {
+                console.error('Failed to renew broker credentials:', err);
+            }
+        }, Math.max(ttl * CREDENTIAL_REFRESH_RATIO, 0));
+    }
+
+    private clearCredentialRefresh() {
+        if (this.refreshTimer) {
+            clearTimeout(this.refreshTimer);
+            this.refreshTimer = null;
+        }
+    }
+
+    private async connectMqtt(topic: string, credentials: BrokerCredentials): Promise<void> {
         const clientId = `syncwrite_${Math.random().toString(16).substr(2, 8)}`;
 
         this.mqttClient = connect({
@@ -62,6 +152,8 @@ class CollaborationService {
             port: Number(import.meta.env.VITE_MQTT_PORT),
             path: import.meta.env.VITE_MQTT_PATH,
             clientId,
+            username: credentials.username,
+            password: credentials.password,
             clean: true,
             protocol: 'wss',
         });
@@ -92,6 +184,7 @@ class CollaborationService {
     }
 
     private async disconnectMqtt(): Promise<void> {
+        this.clearCredentialRefresh();
         if (this.mqttClient) {
             return new Promise((resolve) => {
                 this.mqttClient.end(false, {}, () => {
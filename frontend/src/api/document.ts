@@ -4,8 +4,10 @@ import type {
     CreateDocumentRequest,
     UpdateDocumentRequest,
     ShareDocumentRequest,
-    DocumentVersion
+    DocumentVersion,
+    VersionDiff
 } from '../types/document';
+import { DiffGranularity } from '../types/document';
 
 class DocumentService {
     private client = createClient(DocumentService);
@@ -86,6 +88,65 @@ class DocumentService {
         );
         return response.document;
     }
+
+    async nameVersion(
+        documentId: string,
+        versionId: string,
+        name: string,
+        description: string = ''
+    ): Promise<DocumentVersion> {
+        const response = await this.client.nameVersion(
+            { documentId, versionId, name, description },
+            { headers: getAuthHeader() }
+        );
+        return response.version;
+    }
+
+    async pinVersion(documentId: string, versionId: string, pinned: boolean): Promise<DocumentVersion> {
+        const response = await this.client.pinVersion(
+            { documentId, versionId, pinned },
+            { headers: getAuthHeader() }
+        );
+        return response.version;
+    }
+
+    async diffVersions(
+        documentId: string,
+        fromVersionId: string,
+        toVersionId: string = '',
+        granularity: DiffGranularity = DiffGranularity.WORD,
+        context: number = 3
+    ): Promise<VersionDiff> {
+        const response = await this.client.diffVersions(
+            { documentId, fromVersionId, toVersionId, granularity, context },
+            { headers: getAuthHeader() }
+        );
+        return {
+            fromVersion: response.fromVersion,
+            toVersion: response.toVersion,
+            hunks: response.hunks,
+            inserted: response.inserted,
+            deleted: response.deleted,
+        };
+    }
+
+    async listNamedVersions(
+        documentId: string,
+        page: number = 1,
+        pageSize: number = 10
+    ): Promise<{
+        versions: DocumentVersion[];
+        total: number;
+    }> {
+        const response = await this.client.listNamedVersions(
+            { documentId, page, pageSize },
+            { headers: getAuthHeader() }
+        );
+        return {
+            versions: response.versions,
+            total: response.total,
+        };
+    }
 }
 
 export const documentService = new DocumentService();
\ No newline at end of file
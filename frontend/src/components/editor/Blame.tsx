@@ -0,0 +1,51 @@
+import { Component, createSignal, For, Show } from 'solid-js';
+import { format } from 'date-fns';
+import { collaborationService } from '@/api/collaboration.ts';
+import { GetBlameResponse } from '@/types/collaboration.ts';
+import Button from '../common/Button';
+
+interface BlameProps {
+    documentId: string;
+    content: string;
+}
+
+// Lists who last edited each part of the document
+const Blame: Component<BlameProps> = (props) => {
+    const [blame, setBlame] = createSignal<GetBlameResponse | null>(null);
+
+    const handleToggle = async () => {
+        setBlame(blame() ? null : await collaborationService.getBlame(props.documentId));
+    };
+
+    return (
+        <div class="blame-panel">
+            <h3 class="title is-5">
+                Authors
+                <Button variant="ghost" size="small" onClick={handleToggle}>
+                    {blame() ? 'Hide' : 'Show'}
+                </Button>
+            </h3>
+            <Show when={blame()}>
+                <div class="blame-ranges">
+                    <For each={blame()!.ranges}>
+                        {(range) => (
+                            <div class="blame-range">
+                                <span class="author">{range.username || 'Unknown'}</span>
+                                <Show when={range.editedAt}>
+                                    <span class="timestamp">
+                                        {format(new Date(range.editedAt!), 'MMM dd, HH:mm')}
+                                    </span>
+                                </Show>
+                                <span class="excerpt">
+                                    {props.content.slice(range.start, range.start + range.length)}
+                                </span>
+                            </div>
+                        )}
+                    </For>
+                </div>
+            </Show>
+        </div>
+    );
+};
+
+export default Blame;
@@ -10,7 +10,10 @@ const Collaboration: Component = () => {
                 <For each={collaborationStore.state.activeUsers}>
                     {(user) => (
                         <div class="active-user">
-                            <span class="user-indicator"></span>
+                            <span
+                                class="user-indicator"
+                                style={{ 'background-color': user.presence?.color }}
+                            ></span>
                             <div class="user-info">
                                 <span class="username">{user.username}</span>
                                 <span class="last-active">
@@ -5,6 +5,7 @@ import { Operation, OperationType } from '../../types/collaboration';
 import Toolbar from './Toolbar';
 import Collaboration from './Collaboration';
 import VersionHistory from './VersionHistory';
+import Blame from './Blame';
 
 interface EditorProps {
     documentId: string;
@@ -13,7 +14,7 @@ interface EditorProps {
 const Editor: Component<EditorProps> = (props) => {
     let editorRef: HTMLDivElement | undefined;
     const [content, setContent] = createSignal('');
-    const [version, setVersion] = createSignal('');
+    const [version, setVersion] = createSignal(0);
     const [isSyncing, setIsSyncing] = createSignal(false);
 
     createEffect(async () => {
@@ -28,7 +29,8 @@ const Editor: Component<EditorProps> = (props) => {
         await collaborationStore.joinSession(props.documentId);
 
         collaborationStore.onDocumentChange(props.documentId, (change) => {
-            if (change.userId !== collaborationStore.state.sessionId) {
+            // Changes are delivered at least once; skip the ones already applied
+            if (change.userId !== collaborationStore.state.sessionId && change.version > version()) {
                 applyChanges(change.operations);
                 setVersion(change.version);
             }
@@ -124,6 +126,7 @@ const Editor: Component<EditorProps> = (props) => {
                 <div class="column is-3">
                     <Collaboration />
                     <VersionHistory documentId={props.documentId} />
+                    <Blame documentId={props.documentId} content={content()} />
                 </div>
             </div>
         </div>
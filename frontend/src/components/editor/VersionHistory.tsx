@@ -1,5 +1,7 @@
-import { Component, createEffect, For } from 'solid-js';
+import { Component, createEffect, createSignal, For, Show } from 'solid-js';
 import { documentStore } from '@/stores/document.ts';
+import { documentService } from '@/api/document.ts';
+import { DiffSpanKind, VersionDiff } from '@/types/document.ts';
 import Button from '../common/Button';
 import { format } from 'date-fns';
 
@@ -16,6 +18,17 @@ const VersionHistory: Component<VersionHistoryProps> = (props) => {
         await documentStore.restoreVersion(props.documentId, versionId);
     };
 
+    // Changes of the version selected for comparison with the current document
+    const [diff, setDiff] = createSignal<{ versionId: string; diff: VersionDiff } | null>(null);
+
+    const handleCompare = async (versionId: string) => {
+        if (diff()?.versionId === versionId) {
+            setDiff(null);
+            return;
+        }
+        setDiff({ versionId, diff: await documentService.diffVersions(props.documentId, versionId) });
+    };
+
     return (
         <div class="version-history-panel">
             <h3 class="title is-5">Version History</h3>
@@ -27,6 +40,26 @@ const VersionHistory: Component<VersionHistoryProps> = (props) => {
                 <span class="timestamp">
                   {format(new Date(version.createdAt), 'MMM dd, HH:mm')}
                 </span>
+                                <span class="editor">
+                                    {version.contributors.length > 1
+                                        ? version.contributors.map((c) => c.username).join(', ')
+                                        : version.editorName}
+                                </span>
+                                <Show when={version.name}>
+                                    <span class="name" title={version.description}>
+                                        {version.name}
+                                    </span>
+                                </Show>
+                                <span class="summary">{version.summary}</span>
+                                <Button
+                                    variant="ghost"
+                                    size="small"
+                                    onClick={() =>
+                                        documentStore.pinVersion(props.documentId, version.id, !version.pinned)
+                                    }
+                                >
+                                    {version.pinned ? 'Unpin' : 'Pin'}
+                                </Button>
                                 <Button
                                     variant="ghost"
                                     size="small"
@@ -34,7 +67,38 @@ const VersionHistory: Component<VersionHistoryProps> = (props) => {
                                 >
                                     Restore
                                 </Button>
+                                <Button
+                                    variant="ghost"
+                                    size="small"
+                                    onClick={() => handleCompare(version.id)}
+                                >
+                                    Changes
+                                </Button>
                             </div>
+                            <Show when={diff()?.versionId === version.id}>
+                                <div class="version-diff">
+                                    <For each={diff()!.diff.hunks}>
+                                        {(hunk) => (
+                                            <div class="hunk">
+                                                <For each={hunk.spans}>
+                                                    {(span) => (
+                                                        <span
+                                                            class={`span-${span.kind.toLowerCase()}`}
+                                                            title={
+                                                                span.kind === DiffSpanKind.INSERT
+                                                                    ? span.authorName
+                                                                    : undefined
+                                                            }
+                                                        >
+                                                            {span.text}
+                                                        </span>
+                                                    )}
+                                                </For>
+                                            </div>
+                                        )}
+                                    </For>
+                                </div>
+                            </Show>
                         </div>
                     )}
                 </For>
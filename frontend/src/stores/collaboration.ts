@@ -9,6 +9,7 @@ import { collaborationService } from '../api/collaboration';
 interface CollaborationState {
     activeUsers: ActiveUser[];
     sessionId: string | null;
+    connectionId: string | null;
     mqttTopic: string | null;
     isConnected: boolean;
     isLoading: boolean;
@@ -18,6 +19,7 @@ interface CollaborationState {
 const initialState: CollaborationState = {
     activeUsers: [],
     sessionId: null,
+    connectionId: null,
     mqttTopic: null,
     isConnected: false,
     isLoading: false,
@@ -26,6 +28,31 @@ const initialState: CollaborationState = {
 
 const [state, setState] = createStore(initialState);
 
+// Must stay below the server's presence timeout
+const HEARTBEAT_INTERVAL_MS = 20_000;
+let heartbeatTimer: ReturnType<typeof setInterval> | null = null;
+
+const stopHeartbeat = () => {
+    if (heartbeatTimer) {
+        clearInterval(heartbeatTimer);
+        heartbeatTimer = null;
+    }
+};
+
+const startHeartbeat = (documentId: string) => {
+    stopHeartbeat();
+    heartbeatTimer = setInterval(async () => {
+        if (!state.connectionId) return;
+        try {
+            await collaborationService.heartbeat(documentId, state.connectionId);
+        } catch {
+            // The connection was evicted; join again
+            stopHeartbeat();
+            await collaborationStore.joinSession(documentId);
+        }
+    }, HEARTBEAT_INTERVAL_MS);
+};
+
 export const collaborationStore = {
     get state() {
         return state;
@@ -37,11 +64,13 @@ export const collaborationStore = {
             const response = await collaborationService.joinSession(documentId);
             setState({
                 sessionId: response.sessionId,
+                connectionId: response.connectionId,
                 activeUsers: response.activeUsers,
                 mqttTopic: response.mqttTopic,
                 isConnected: true,
                 isLoading: false,
             });
+            startHeartbeat(documentId);
         } catch (error) {
             setState({
                 error: error instanceof Error ? error.message : 'Failed to join session',
@@ -51,13 +80,16 @@ export const collaborationStore = {
     },
 
     async leaveSession() {
-        if (!state.sessionId || !state.mqttTopic) return;
+        if (!state.sessionId || !state.connectionId) return;
 
+        stopHeartbeat();
         setState({ isLoading: true, error: null });
         try {
-            await collaborationService.leaveSession(state.sessionId, state.mqttTopic);
+            // The session ID is the ID of the document
+            await collaborationService.leaveSession(state.sessionId, state.sessionId, state.connectionId);
             setState({
                 sessionId: null,
+                connectionId: null,
                 mqttTopic: null,
                 activeUsers: [],
                 isConnected: false,
@@ -71,7 +103,7 @@ export const collaborationStore = {
         }
     },
 
-    async syncDocument(documentId: string, operations: Operation[], baseVersion: string) {
+    async syncDocument(documentId: string, operations: Operation[], baseVersion: number) {
         setState({ isLoading: true, error: null });
         try {
             const response = await collaborationService.syncDocument(
@@ -71,7 +71,7 @@ export const documentStore = {
         }
     },
 
-    async updateDocument(documentId: string, title: string, content: string, version: string) {
+    async updateDocument(documentId: string, title: string, content: string, version: number) {
         setState({ isLoading: true, error: null });
         try {
             const document = await documentService.updateDocument({
@@ -163,6 +163,18 @@ export const documentStore = {
         }
     },
 
+    async pinVersion(documentId: string, versionId: string, pinned: boolean) {
+        setState({ error: null });
+        try {
+            const version = await documentService.pinVersion(documentId, versionId, pinned);
+            setState('versions', (v) => v.id === version.id, version);
+        } catch (error) {
+            setState({
+                error: error instanceof Error ? error.message : 'Failed to pin version',
+            });
+        }
+    },
+
     clearError() {
         setState({ error: null });
     },
@@ -1,10 +1,24 @@
 export interface ActiveUser {
+    connectionId: string;
     userId: string;
     username: string;
-    cursorPosition: string;
+    presence?: Presence;
     lastActive: Date;
 }
 
+// Offsets are UTF-16 code units, like JavaScript string indices
+export interface Selection {
+    anchor: number;
+    head: number;
+}
+
+export interface Presence {
+    selections: Selection[];
+    color: string;
+    isTyping: boolean;
+    version: number;
+}
+
 export interface Operation {
     type: OperationType;
     position: number;
@@ -21,19 +35,65 @@ export enum OperationType {
 export interface DocumentChange {
     documentId: string;
     userId: string;
-    version: string;
+    version: number;
     operations: Operation[];
     timestamp: Date;
 }
 
+export interface BrokerCredentials {
+    username: string;
+    password: string;
+    expiresAt: Date;
+    readTopics: string[];
+    writeTopics: string[];
+}
+
 export interface JoinSessionResponse {
     sessionId: string;
     activeUsers: ActiveUser[];
     mqttTopic: string;
+    connectionId: string;
+    brokerCredentials: BrokerCredentials;
+}
+
+// A run of the current text last edited by one user, in UTF-16 code units.
+// Text written before authorship was tracked has an empty userId.
+export interface BlameRange {
+    start: number;
+    length: number;
+    userId: string;
+    username: string;
+    editedAt?: Date;
+}
+
+export interface GetBlameResponse {
+    version: number;
+    ranges: BlameRange[];
+}
+
+// The state of a document a replay starts from
+export interface ReplayState {
+    version: number;
+    content: string;
+    crdtState: Uint8Array;
+    yjsState: Uint8Array;
+}
+
+export type ReplayEvent =
+    | { case: 'state'; value: ReplayState }
+    | { case: 'change'; value: DocumentChange };
+
+export interface ReplayOptions {
+    fromVersion?: number;
+    toVersion?: number;
+    // Playback speed relative to the original edits; 0 sends changes without pauses
+    speed?: number;
+    maxGapMs?: number;
 }
 
 export interface SyncDocumentResponse {
     success: boolean;
-    newVersion: string;
+    newVersion: number;
     concurrentChanges: DocumentChange[];
+    operations: Operation[];
 }
\ No newline at end of file
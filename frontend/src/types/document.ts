@@ -3,7 +3,7 @@ export interface Document {
     title: string;
     content: string;
     ownerId: string;
-    version: string;
+    version: number;
     createdAt: Date;
     updatedAt: Date;
 }
@@ -20,15 +20,67 @@ export enum PermissionLevel {
     OWNER = 'OWNER',
 }
 
+export enum VersionKind {
+    MANUAL = 'MANUAL',
+    RESTORE = 'RESTORE',
+    AUTOMATIC = 'AUTOMATIC',
+}
+
+export interface VersionContributor {
+    userId: string;
+    username: string;
+}
+
 export interface DocumentVersion {
     id: string;
     documentId: string;
     content: string;
     editorId: string;
-    version: string;
+    editorName: string;
+    version: number;
+    kind: VersionKind;
+    summary: string;
+    contributors: VersionContributor[];
+    name: string;
+    description: string;
+    pinned: boolean;
     createdAt: Date;
 }
 
+export enum DiffGranularity {
+    WORD = 'WORD',
+    CHARACTER = 'CHARACTER',
+}
+
+export enum DiffSpanKind {
+    EQUAL = 'EQUAL',
+    INSERT = 'INSERT',
+    DELETE = 'DELETE',
+}
+
+export interface DiffSpan {
+    kind: DiffSpanKind;
+    text: string;
+    authorId: string;
+    authorName: string;
+}
+
+export interface DiffHunk {
+    oldStart: number;
+    oldLength: number;
+    newStart: number;
+    newLength: number;
+    spans: DiffSpan[];
+}
+
+export interface VersionDiff {
+    fromVersion: number;
+    toVersion: number;
+    hunks: DiffHunk[];
+    inserted: number;
+    deleted: number;
+}
+
 export interface CreateDocumentRequest {
     title: string;
     content: string;
@@ -38,7 +90,7 @@ export interface UpdateDocumentRequest {
     documentId: string;
     title: string;
     content: string;
-    version: string;
+    version: number;
 }
 
 export interface ShareDocumentRequest {